@@ -1,10 +1,12 @@
 module github.sc-corp.net/scaddlive/women-who-go.git
 
-go 1.12
+// Go 1.14 for testing.T.Cleanup, which the kargo tests use.
+go 1.14
 
 require (
 	cloud.google.com/go v0.36.0 // indirect
 	fyne.io/fyne v1.1.0
+	github.com/ghodss/yaml v1.0.0
 	github.com/go-gl/gl v0.0.0-20190320180904-bf2b1f2f34d7 // indirect
 	github.com/go-gl/glfw v0.0.0-20190409004039-e6da0acd62b1 // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
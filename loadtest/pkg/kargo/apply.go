@@ -0,0 +1,215 @@
+package kargo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByKargo = "kargo"
+)
+
+var (
+	replaceTimeout      = 2 * time.Minute
+	replacePollInterval = time.Second
+)
+
+// applyObject creates obj in the collection at collectionPath. If an object
+// with the same name already exists, for example left over from a crashed
+// run, it is deleted and created again when --force-replace is set, updated
+// in place when kargo created it, and otherwise left alone with an error.
+func applyObject(kind, collectionPath, name string, obj interface{}) error {
+	status, data, err := sendObject(http.MethodPost, collectionPath, obj)
+	if err != nil {
+		return err
+	}
+	if status == 201 {
+		return nil
+	}
+	if status != 409 {
+		fmt.Println(string(data))
+		return fmt.Errorf("%s: Unexpected HTTP status code %d", kind, status)
+	}
+
+	objectPath := collectionPath + "/" + name
+	existing, err := getObjectMetadata(objectPath)
+	if err != nil {
+		return err
+	}
+
+	if forceReplace {
+		fmt.Printf("Replacing existing %s %s...\n", kind, name)
+		err := deleteObject(objectPath)
+		if err != nil {
+			return err
+		}
+		status, data, err := sendObject(http.MethodPost, collectionPath, obj)
+		if err != nil {
+			return err
+		}
+		if status != 201 {
+			fmt.Println(string(data))
+			return fmt.Errorf("%s: Unexpected HTTP status code %d", kind, status)
+		}
+		return nil
+	}
+
+	if existing.Labels[managedByLabel] != managedByKargo {
+		return fmt.Errorf("%s %s already exists and was not created by kargo; delete it or rerun with --force-replace", kind, name)
+	}
+
+	fmt.Printf("Updating existing %s %s...\n", kind, name)
+	updated, err := withResourceVersion(obj, existing.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	status, data, err = sendObject(http.MethodPut, objectPath, updated)
+	if err != nil {
+		return err
+	}
+	if status == 409 || status == 422 {
+		fmt.Println(string(data))
+		return fmt.Errorf("%s %s already exists and cannot be updated in place; rerun with --force-replace", kind, name)
+	}
+	if status != 200 {
+		fmt.Println(string(data))
+		return fmt.Errorf("%s: Unexpected HTTP status code %d", kind, status)
+	}
+	return nil
+}
+
+func sendObject(method, path string, obj interface{}) (int, []byte, error) {
+	var b []byte
+	body := bytes.NewBuffer(b)
+	err := json.NewEncoder(body).Encode(obj)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	request := &http.Request{
+		Body:          ioutil.NopCloser(body),
+		ContentLength: int64(body.Len()),
+		Header:        make(http.Header),
+		Method:        method,
+		URL: &url.URL{
+			Path: path,
+		},
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+func getObjectMetadata(path string) (*Metadata, error) {
+	var object struct {
+		Metadata Metadata `json:"metadata"`
+	}
+
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path: path,
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Get object error non 200 reponse: " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+	return &object.Metadata, nil
+}
+
+// deleteObject deletes the object at path along with anything it owns, and
+// waits until it is gone so it can be created again under the same name.
+func deleteObject(path string) error {
+	v := url.Values{}
+	v.Set("propagationPolicy", "Foreground")
+
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodDelete,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 202 && resp.StatusCode != 404 {
+		return errors.New("Delete object error non 200 reponse: " + resp.Status)
+	}
+
+	deadline := time.Now().Add(replaceTimeout)
+	for time.Now().Before(deadline) {
+		_, err := getObjectMetadata(path)
+		if err == ErrNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		time.Sleep(replacePollInterval)
+	}
+	return fmt.Errorf("timed out after %s waiting for %s to be deleted", replaceTimeout, path)
+}
+
+// withResourceVersion returns obj as a generic object with
+// metadata.resourceVersion set, as required to update an existing object.
+func withResourceVersion(obj interface{}, resourceVersion string) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]interface{}
+	err = json.Unmarshal(data, &object)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, ok := object["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		object["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = resourceVersion
+	return object, nil
+}
@@ -0,0 +1,145 @@
+package kargo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	ArchLabel = "kubernetes.io/arch"
+
+	// Clusters older than Kubernetes 1.14 only label nodes with this.
+	legacyArchLabel = "beta.kubernetes.io/arch"
+
+	defaultArch = "amd64"
+)
+
+var nodesEndpoint = "/api/v1/nodes"
+
+func nodeArch(node *Node) string {
+	if arch, ok := node.Metadata.Labels[ArchLabel]; ok {
+		return arch
+	}
+	return node.Metadata.Labels[legacyArchLabel]
+}
+
+// NodeArchitectures returns the sorted architectures of the nodes matching
+// nodeSelector, from their kubernetes.io/arch label. Nodes without the label
+// are left out.
+func (dm *DeploymentManager) NodeArchitectures(nodeSelector map[string]string) ([]string, error) {
+	list, err := listCollection(context.Background(), nodesEndpoint, selectorString(nodeSelector), "")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	arches := make([]string, 0)
+	for _, item := range list.Items {
+		var node Node
+		err := json.Unmarshal(item, &node)
+		if err != nil {
+			return nil, err
+		}
+		arch := nodeArch(&node)
+		if arch != "" && !seen[arch] {
+			seen[arch] = true
+			arches = append(arches, arch)
+		}
+	}
+	sort.Strings(arches)
+	return arches, nil
+}
+
+// Architectures returns the architectures to build the worker binary for:
+// those given with --arch, or else those of the nodes matching nodeSelector.
+// If the nodes cannot be listed or none are labelled, or a --dry-run only
+// renders manifests, the binary is built for amd64 alone. labelled reports
+// whether nodes can be told apart by their architecture label, and so
+// whether DeploymentConfig.ArchAffinity can be set.
+func (dm *DeploymentManager) Architectures(nodeSelector map[string]string) (arches []string, labelled bool, err error) {
+	if architectures != "" {
+		arches, err := parseArchitectures(architectures)
+		return arches, err == nil, err
+	}
+	if renderOnly() {
+		fmt.Fprintf(os.Stderr, "Building for %s without looking up nodes for --dry-run (set --arch to choose)\n", defaultArch)
+		return []string{defaultArch}, false, nil
+	}
+
+	arches, err = dm.NodeArchitectures(nodeSelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot list nodes to find their architectures, building for %s (set --arch to choose): %s\n", defaultArch, err)
+		return []string{defaultArch}, false, nil
+	}
+	if len(arches) == 0 {
+		fmt.Fprintf(os.Stderr, "No nodes are labelled with %s, building for %s (set --arch to choose)\n", ArchLabel, defaultArch)
+		return []string{defaultArch}, false, nil
+	}
+	return arches, true, nil
+}
+
+// parseArchitectures parses --arch, leaving out blank and repeated entries.
+// Only architectures that pods can pick their binary for are allowed.
+func parseArchitectures(s string) ([]string, error) {
+	arches := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, arch := range strings.Split(s, ",") {
+		arch = strings.TrimSpace(arch)
+		if arch == "" || seen[arch] {
+			continue
+		}
+		supported := false
+		for _, a := range binaryArches {
+			supported = supported || a == arch
+		}
+		if !supported {
+			return nil, fmt.Errorf("invalid --arch %q, expected one of %s", arch, strings.Join(binaryArches, ", "))
+		}
+		seen[arch] = true
+		arches = append(arches, arch)
+	}
+	if len(arches) == 0 {
+		return nil, fmt.Errorf("invalid --arch %q, expected architectures such as amd64,arm64", s)
+	}
+	return arches, nil
+}
+
+// archAffinity adds a required node affinity for the architectures of
+// binaries to affinity, which is copied rather than changed. Required node
+// selector terms are ORed, so each of them becomes two: one requiring
+// ArchLabel and one requiring legacyArchLabel, which older nodes carry.
+func archAffinity(affinity *Affinity, binaries []Artifact) *Affinity {
+	arches := make([]string, 0, len(binaries))
+	for _, binary := range binaries {
+		arches = append(arches, binary.Arch)
+	}
+
+	result := &Affinity{}
+	if affinity != nil {
+		*result = *affinity
+	}
+	nodeAffinity := &NodeAffinity{}
+	if result.NodeAffinity != nil {
+		*nodeAffinity = *result.NodeAffinity
+	}
+
+	terms := []NodeSelectorTerm{{}}
+	if required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil && len(required.NodeSelectorTerms) > 0 {
+		terms = required.NodeSelectorTerms
+	}
+	withArch := make([]NodeSelectorTerm, 0, 2*len(terms))
+	for _, term := range terms {
+		for _, label := range []string{ArchLabel, legacyArchLabel} {
+			requirement := NodeSelectorRequirement{Key: label, Operator: "In", Values: arches}
+			expressions := append([]NodeSelectorRequirement{}, term.MatchExpressions...)
+			withArch = append(withArch, NodeSelectorTerm{MatchExpressions: append(expressions, requirement)})
+		}
+	}
+	nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &NodeSelector{NodeSelectorTerms: withArch}
+	result.NodeAffinity = nodeAffinity
+	return result
+}
@@ -0,0 +1,265 @@
+package kargo
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNodeArchitectures(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	arches, labelled, err := dm.Architectures(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(arches, []string{"amd64"}) || labelled {
+		t.Errorf("architectures without labelled nodes are %v, labelled %t, want amd64 unlabelled", arches, labelled)
+	}
+
+	server.AddNode("node-2", map[string]string{ArchLabel: "arm64", "pool": "arm"})
+	server.AddNode("node-3", map[string]string{legacyArchLabel: "amd64"})
+	server.AddNode("node-4", map[string]string{ArchLabel: "arm64"})
+	arches, err = dm.NodeArchitectures(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(arches, []string{"amd64", "arm64"}) {
+		t.Errorf("architectures are %v, want amd64 and arm64", arches)
+	}
+	arches, labelled, err = dm.Architectures(map[string]string{"pool": "arm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(arches, []string{"arm64"}) || !labelled {
+		t.Errorf("architectures of the arm pool are %v, labelled %t, want labelled arm64", arches, labelled)
+	}
+
+	architectures = "arm64, ppc64le,,arm64"
+	arches, labelled, err = dm.Architectures(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(arches, []string{"arm64", "ppc64le"}) || !labelled {
+		t.Errorf("architectures with --arch are %v, want arm64 and ppc64le", arches)
+	}
+}
+
+func TestParseArchitectures(t *testing.T) {
+	tests := []struct {
+		arch   string
+		arches []string
+		err    string
+	}{
+		{"amd64", []string{"amd64"}, ""},
+		{" arm64 , amd64 ", []string{"arm64", "amd64"}, ""},
+		{"amd64,,arm64,", []string{"amd64", "arm64"}, ""},
+		{"arm64,arm64,386", []string{"arm64", "386"}, ""},
+		{"s390x,riscv64", []string{"s390x", "riscv64"}, ""},
+		{"x86_64", nil, `invalid --arch "x86_64"`},
+		{"amd64,loong64", nil, `invalid --arch "loong64"`},
+		{"AMD64", nil, `invalid --arch "AMD64"`},
+		{" , ", nil, "expected architectures"},
+	}
+	for _, test := range tests {
+		arches, err := parseArchitectures(test.arch)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want one containing %q", test.arch, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.arch, err)
+			continue
+		}
+		if !reflect.DeepEqual(arches, test.arches) {
+			t.Errorf("%q: got %v, want %v", test.arch, arches, test.arches)
+		}
+	}
+}
+
+func TestArchAffinity(t *testing.T) {
+	binaries := []Artifact{{Arch: "amd64"}, {Arch: "arm64"}}
+	arch := NodeSelectorRequirement{Key: ArchLabel, Operator: "In", Values: []string{"amd64", "arm64"}}
+	legacy := NodeSelectorRequirement{Key: legacyArchLabel, Operator: "In", Values: []string{"amd64", "arm64"}}
+
+	affinity := archAffinity(NodeAntiAffinity(false), binaries)
+	if affinity.PodAntiAffinity == nil {
+		t.Error("pod anti-affinity was dropped")
+	}
+	want := []NodeSelectorTerm{
+		{MatchExpressions: []NodeSelectorRequirement{arch}},
+		{MatchExpressions: []NodeSelectorRequirement{legacy}},
+	}
+	if got := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms; !reflect.DeepEqual(got, want) {
+		t.Errorf("node selector terms are %+v, want %+v", got, want)
+	}
+
+	ssd := NodeSelectorRequirement{Key: "disk", Operator: "In", Values: []string{"ssd"}}
+	gpu := NodeSelectorRequirement{Key: "gpu", Operator: "Exists"}
+	existing := &Affinity{NodeAffinity: &NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &NodeSelector{NodeSelectorTerms: []NodeSelectorTerm{
+			{MatchExpressions: []NodeSelectorRequirement{ssd}},
+			{MatchExpressions: []NodeSelectorRequirement{gpu}},
+		}},
+	}}
+	affinity = archAffinity(existing, binaries)
+	want = []NodeSelectorTerm{
+		{MatchExpressions: []NodeSelectorRequirement{ssd, arch}},
+		{MatchExpressions: []NodeSelectorRequirement{ssd, legacy}},
+		{MatchExpressions: []NodeSelectorRequirement{gpu, arch}},
+		{MatchExpressions: []NodeSelectorRequirement{gpu, legacy}},
+	}
+	if got := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms; !reflect.DeepEqual(got, want) {
+		t.Errorf("node selector terms are %+v, want %+v", got, want)
+	}
+	if terms := existing.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms; len(terms[0].MatchExpressions) != 1 {
+		t.Errorf("the config's affinity was changed: %+v", terms)
+	}
+}
+
+func TestCreateWithBinaries(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	config := testConfig(1)
+	config.Binaries = []Artifact{
+		{Arch: "amd64", URL: "https://example.com/amd64/loadtest", SHA256: "amd64-sum", Signature: "c2ln", PublicKey: "key"},
+		{Arch: "arm64", URL: "https://example.com/arm64/loadtest", SHA256: "arm64-sum", Signature: "c2ln", PublicKey: "key"},
+	}
+	config.ArchAffinity = true
+	putVerifyKey(server, "key")
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d Deployment
+	err = server.Decode("deployments", "default", "loadtest", &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := d.Spec.Template.Spec
+	names := make([]string, 0)
+	for _, c := range spec.InitContainers {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "install,verify,configure" {
+		t.Errorf("init containers are %v, want install, verify and configure", names)
+	}
+	env := make(map[string]string)
+	for _, e := range spec.InitContainers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env[binaryArchesEnv] != "amd64,arm64" || env[binaryURLEnv+"_arm64"] != "https://example.com/arm64/loadtest" || env[binarySHA256Env+"_arm64"] != "arm64-sum" {
+		t.Errorf("install env is %v", env)
+	}
+	if command := spec.InitContainers[0].Command; len(command) != 4 || !strings.Contains(command[2], "uname -m") {
+		t.Errorf("install command %q does not pick the binary for the node", command)
+	}
+
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil || spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		t.Fatalf("pods have no node affinity: %+v", spec.Affinity)
+	}
+	terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 2 || terms[1].MatchExpressions[0].Key != legacyArchLabel || !reflect.DeepEqual(terms[0].MatchExpressions[0].Values, []string{"amd64", "arm64"}) {
+		t.Errorf("node selector terms are %+v, want %s or %s in amd64 and arm64", terms, ArchLabel, legacyArchLabel)
+	}
+}
+
+// TestCreateOnUnlabelledNodes checks that pods on a cluster whose nodes
+// carry no architecture label are not given an affinity no node matches.
+func TestCreateOnUnlabelledNodes(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	arches, labelled, err := dm.Architectures(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(1)
+	for _, arch := range arches {
+		config.Binaries = append(config.Binaries, Artifact{Arch: arch, URL: "https://example.com/" + arch + "/loadtest", SHA256: arch + "-sum", Signature: "c2ln", PublicKey: "key"})
+	}
+	config.ArchAffinity = labelled
+	putVerifyKey(server, "key")
+	err = dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d Deployment
+	err = server.Decode("deployments", "default", "loadtest", &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affinity := d.Spec.Template.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+		t.Errorf("pods on unlabelled nodes have node affinity %+v", affinity.NodeAffinity)
+	}
+	if len(d.Spec.Template.Spec.InitContainers) == 0 || d.Spec.Template.Spec.InitContainers[0].Name != "install" {
+		t.Error("pods do not install the binary")
+	}
+}
+
+// TestSelectBinaryScript runs the install script with a binary for the
+// architecture of this machine and one for another.
+func TestSelectBinaryScript(t *testing.T) {
+	for _, tool := range []string{"wget", "sha256sum", "uname"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skipf("uname names %s differently", runtime.GOARCH)
+	}
+	dir, err := ioutil.TempDir("", "kargo-arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newBinaryServer(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	server := httptest.NewServer(s)
+	defer server.Close()
+	s.baseURL = server.URL
+	err = s.Put(testChecksum+"/loadtest", strings.NewReader("binary"), 6, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenPath := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenPath, []byte(s.Token()), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacer := strings.NewReplacer(filepath.Join(binaryTokenMountPath, binaryTokenKey), tokenPath)
+
+	binaryPath := filepath.Join(dir, "loadtest")
+	install := func(binaries ...Artifact) (string, error) {
+		config := DeploymentConfig{Binaries: binaries, BinaryToken: s.Token()}
+		return runInitScript(t, Container{Name: "install", Command: installCommand(config, binaryPath), Env: installEnv(config)}, replacer)
+	}
+
+	other := Artifact{Arch: "s390x", URL: s.URL("missing/loadtest"), SHA256: strings.Repeat("0", 64)}
+	out, err := install(other, Artifact{Arch: runtime.GOARCH, URL: s.URL(testChecksum + "/loadtest"), SHA256: testChecksum})
+	if err != nil {
+		t.Fatalf("install failed: %s\n%s", err, out)
+	}
+	data, err := ioutil.ReadFile(binaryPath)
+	if err != nil || string(data) != "binary" {
+		t.Errorf("installed %q, %v, want %q", data, err, "binary")
+	}
+
+	out, err = install(other)
+	if err == nil || !strings.Contains(out, "no binary for "+runtime.GOARCH+" nodes, only for s390x") {
+		t.Errorf("install without a binary for this machine returned %v:\n%s", err, out)
+	}
+}
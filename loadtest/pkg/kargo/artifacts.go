@@ -0,0 +1,196 @@
+package kargo
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArtifactStore keeps the binaries that workers download when they start.
+// Objects are named by the checksum of their contents, so an object that
+// exists never needs to be stored again.
+type ArtifactStore interface {
+	// URL is where workers download the object called name.
+	URL(name string) string
+	// Exists reports whether an object called name is already stored.
+	Exists(name string) (bool, error)
+	// Put stores the size bytes of r as name, with metadata such as their
+	// checksum. Stores may read parts of r more than once to retry them.
+	Put(name string, r io.ReaderAt, size int64, metadata map[string]string) error
+}
+
+// urlSigner is an ArtifactStore that can let workers download private
+// objects.
+type urlSigner interface {
+	// SignedURL is a URL of the object called name that anyone holding it
+	// can download for ttl.
+	SignedURL(name string, ttl time.Duration) (string, error)
+	// Public reports whether objects are made publicly readable instead, so
+	// workers need no signed URL.
+	Public() bool
+}
+
+// defaultSignedURLTTL is how long signed URLs are valid without
+// --signed-url-ttl.
+const defaultSignedURLTTL = 24 * time.Hour
+
+// ParseArtifactStore picks the store described by spec:
+//
+//	gs://bucket?project=id&public=true        Google Cloud Storage
+//	s3://bucket?endpoint=url&region=r         S3 or an S3 compatible store such as MinIO
+//	file:///dir?url=http://host/prefix        a directory served at url
+//	http://host/prefix                        an HTTP server that accepts PUT
+//
+// GCS and S3 objects are private, and workers download them with signed URLs
+// valid for --signed-url-ttl, unless public=true makes them publicly readable.
+// S3 credentials are read from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+// $AWS_SESSION_TOKEN.
+func ParseArtifactStore(spec string) (ArtifactStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	public := query.Get("public") == "true"
+	if public && signedURLTTL > 0 {
+		return nil, fmt.Errorf("artifact store %q makes objects public, which need no --signed-url-ttl", spec)
+	}
+
+	switch u.Scheme {
+	case "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("artifact store %q has no bucket", spec)
+		}
+		return &gcsStore{projectID: query.Get("project"), bucket: u.Host, public: public}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("artifact store %q has no bucket", spec)
+		}
+		return newS3Store(u.Host, query.Get("endpoint"), query.Get("region"), public)
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("artifact store %q has no directory", spec)
+		}
+		baseURL := query.Get("url")
+		if baseURL == "" {
+			baseURL = "file://" + u.Path
+		}
+		return &fileStore{dir: u.Path, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+	case "http", "https":
+		u.RawQuery = ""
+		return &httpStore{baseURL: strings.TrimSuffix(u.String(), "/"), client: http.DefaultClient}, nil
+	}
+	return nil, fmt.Errorf("unsupported artifact store %q, expected gs://, s3://, file:// or http://", spec)
+}
+
+// fileStore keeps objects in a directory, for a web server that serves it at
+// baseURL, or for workers on the same machine when there is none.
+type fileStore struct {
+	dir     string
+	baseURL string
+}
+
+func (s *fileStore) URL(name string) string {
+	return s.baseURL + "/" + name
+}
+
+func (s *fileStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put writes the object next to its final path and renames it into place, so
+// that a web server never serves part of it. Metadata is not kept.
+func (s *fileStore) Put(name string, r io.ReaderAt, size int64, metadata map[string]string) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, io.NewSectionReader(r, 0, size))
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// httpStore keeps objects on an HTTP server that accepts PUT and serves what
+// was put, such as nginx with WebDAV enabled.
+type httpStore struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (s *httpStore) URL(name string) string {
+	return s.baseURL + "/" + name
+}
+
+func (s *httpStore) Exists(name string) (bool, error) {
+	resp, err := s.client.Head(s.URL(name))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, &statusError{resp.StatusCode, "Head artifact error non 200 reponse: " + resp.Status}
+}
+
+// Put sends the object with its metadata as X-Meta- headers, sending it
+// again if the request fails on the way.
+func (s *httpStore) Put(name string, r io.ReaderAt, size int64, metadata map[string]string) error {
+	return withRetries("Upload of "+name, func() error {
+		return s.put(name, io.NewSectionReader(r, 0, size), size, metadata)
+	})
+}
+
+func (s *httpStore) put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	request, err := http.NewRequest(http.MethodPut, s.URL(name), r)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "application/octet-stream")
+	for key, value := range metadata {
+		request.Header.Set("X-Meta-"+key, value)
+	}
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 201 && resp.StatusCode != 204 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{resp.StatusCode, fmt.Sprintf("Put artifact error non 201 reponse: %s: %s", resp.Status, strings.TrimSpace(string(data)))}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package kargo
+
+import (
+	"io"
+	"sort"
+)
+
+// Backend runs the workers of a loadtest. DeploymentManager runs them on
+// Kubernetes and LocalBackend runs them as processes on this machine.
+type Backend interface {
+	// Create starts config.Replicas workers, or the replicas of the first
+	// step of config.ScalingPlan.
+	Create(config DeploymentConfig) error
+	// Scale changes the number of running workers.
+	Scale(config DeploymentConfig, n int) error
+	// WaitReady blocks until n workers are running, printing progress, or
+	// returns an error saying why they are not after --ready-timeout.
+	WaitReady(n int) error
+	// Logs writes every line the workers log to w, prefixed with the name of
+	// the worker, including workers added later by Scale. It returns
+	// immediately.
+	Logs(w io.Writer) error
+	// Status reports the state of each worker.
+	Status() (*RunStatus, error)
+	// Delete stops the workers and removes everything Create made.
+	Delete() error
+}
+
+// RunStatus is the state of the workers of a run.
+type RunStatus struct {
+	// Replicas is the number of workers the run should have.
+	Replicas int
+	// Ready is the number of workers that are running.
+	Ready   int
+	Workers []WorkerStatus
+}
+
+// WorkerStatus is the state of one worker.
+type WorkerStatus struct {
+	Name  string
+	Node  string
+	Ready bool
+	// State says what the worker is doing, such as Running, or why it is not
+	// running.
+	State string
+}
+
+// Status lists the run's pods, with the reason for any that are failing to
+// start, and the number of workers it should have.
+func (dm *DeploymentManager) Status() (*RunStatus, error) {
+	status := &RunStatus{}
+	if dm.config.Job != nil {
+		job, err := getJob(dm.versions.Jobs, dm.config.Namespace, dm.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		if job.Spec.Parallelism != nil {
+			status.Replicas = int(*job.Spec.Parallelism)
+		}
+	} else {
+		scale, err := getScale(dm.versions.Workloads, dm.config.Namespace, dm.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		status.Replicas = int(scale.Spec.Replicas)
+	}
+
+	podList, err := getPods(dm.config.Namespace, podSelector(dm.config))
+	if err != nil && err != ErrNotExist {
+		return nil, err
+	}
+	if podList != nil {
+		for i := range podList.Items {
+			pod := &podList.Items[i]
+			worker := WorkerStatus{
+				Name:  pod.Metadata.Name,
+				Node:  pod.Spec.NodeName,
+				Ready: podReady(pod),
+				State: pod.Status.Phase,
+			}
+			if problem := podProblem(pod); problem != "" {
+				worker.State = problem
+			}
+			if worker.Ready {
+				status.Ready++
+			}
+			status.Workers = append(status.Workers, worker)
+		}
+	}
+	sort.Slice(status.Workers, func(i, j int) bool {
+		return status.Workers[i].Name < status.Workers[j].Name
+	})
+	return status, nil
+}
@@ -0,0 +1,358 @@
+package kargo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The install init container reads the token the binary server expects from
+// a Secret mounted here.
+const (
+	binaryTokenVolume    = "binary-token"
+	binaryTokenMountPath = "/etc/kargo/binary-token"
+	binaryTokenKey       = "token"
+)
+
+// binaryHealthPath is served without the token, so that a pod can check
+// that the server is reachable before any worker needs it.
+const binaryHealthPath = "/healthz"
+
+// How long CheckBinaryServer waits for its pod, and how often it looks.
+var (
+	binaryProbeTimeout  = 2 * time.Minute
+	binaryProbeInterval = time.Second
+)
+
+// BinaryServer is an ArtifactStore that keeps the binaries in a temporary
+// directory and serves them from the coordinator itself, for teams that
+// cannot publish them to a public bucket. Binaries are served at
+// <url>/<sha256>/<name> to requests with the server's bearer token, which
+// kargo hands to the workers in a Secret when DeploymentConfig.BinaryToken is
+// set.
+//
+// The workers must be able to reach the server at its URL, such as when the
+// coordinator runs in the cluster, or over a tunnel from the coordinator's
+// machine into the cluster network. CheckBinaryServer makes sure they can
+// before a run starts.
+type BinaryServer struct {
+	baseURL  string
+	token    string
+	server   *http.Server
+	listener net.Listener
+
+	dir      string
+	mu       sync.Mutex
+	binaries map[string]bool
+}
+
+// NewBinaryServer listens on --serve-binary and serves binaries at
+// --binary-server-url. That defaults to $POD_IP and the port listened on in
+// the cluster, and must be set anywhere else. With --dry-run it does not
+// listen.
+func NewBinaryServer() (*BinaryServer, error) {
+	var listener net.Listener
+	addr := ServeBinary
+	if !DryRun {
+		var err error
+		listener, err = net.Listen("tcp", ServeBinary)
+		if err != nil {
+			return nil, err
+		}
+		addr = listener.Addr().String()
+	}
+
+	baseURL := binaryServerURL
+	if baseURL != "" {
+		err := checkAdvertisedURL(baseURL)
+		if err != nil {
+			if listener != nil {
+				listener.Close()
+			}
+			return nil, err
+		}
+	} else {
+		podIP := os.Getenv(PodIPEnv)
+		_, port, err := net.SplitHostPort(addr)
+		if err == nil && podIP == "" {
+			err = errors.New("--serve-binary needs --binary-server-url unless the coordinator runs in the cluster with $" + PodIPEnv + " set, as pods cannot reach this machine by its host name")
+		}
+		baseURL = "http://" + net.JoinHostPort(podIP, port)
+		if err != nil {
+			if listener != nil {
+				listener.Close()
+			}
+			return nil, err
+		}
+	}
+
+	s, err := newBinaryServer(listener, baseURL)
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, err
+	}
+	if listener != nil {
+		fmt.Printf("Serving binaries on %s at %s\n", addr, s.baseURL)
+	}
+	return s, nil
+}
+
+// checkAdvertisedURL rejects a --binary-server-url that pods cannot reach
+// whatever the network, such as a loopback address.
+func checkAdvertisedURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("--binary-server-url %s is not an http:// or https:// URL", baseURL)
+	}
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+		return fmt.Errorf("--binary-server-url %s is this machine's loopback address, which pods cannot reach; give the address the cluster reaches the coordinator at, such as the far end of a tunnel", baseURL)
+	}
+	return nil
+}
+
+// newBinaryServer serves binaries on listener, unless it is nil, with a new
+// random token.
+func newBinaryServer(listener net.Listener, baseURL string) (*BinaryServer, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "kargo-binaries")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BinaryServer{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		token:    hex.EncodeToString(token),
+		listener: listener,
+		dir:      dir,
+		binaries: make(map[string]bool),
+	}
+	if listener != nil {
+		s.server = &http.Server{Handler: s}
+		go s.server.Serve(listener)
+	}
+	return s, nil
+}
+
+// Token is the bearer token requests for binaries need.
+func (s *BinaryServer) Token() string {
+	return s.token
+}
+
+func (s *BinaryServer) URL(name string) string {
+	return s.baseURL + "/" + name
+}
+
+func (s *BinaryServer) Exists(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.binaries[name], nil
+}
+
+// Put copies the binary into the server's directory. name must start with
+// the sha256 of the binary, so that a path is never served with different
+// contents.
+func (s *BinaryServer) Put(name string, r io.ReaderAt, size int64, metadata map[string]string) error {
+	p := filepath.Join(s.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), io.NewSectionReader(r, 0, size))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(p)
+		return err
+	}
+
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if !strings.HasPrefix(name, checksum+"/") {
+		os.Remove(p)
+		return fmt.Errorf("binary %s has sha256 %s, which its name does not start with", name, checksum)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.binaries[name] = true
+	return nil
+}
+
+// ServeHTTP serves GET and HEAD requests with the bearer token, including
+// range requests so that interrupted downloads can be resumed, and the
+// health check without it.
+func (s *BinaryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == binaryHealthPath {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	s.mu.Lock()
+	ok := s.binaries[name]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+path.Dir(name)+`"`)
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), f)
+}
+
+// Close stops serving binaries and deletes them.
+func (s *BinaryServer) Close() error {
+	var err error
+	if s.server != nil {
+		err = s.server.Close()
+	}
+	os.RemoveAll(s.dir)
+	return err
+}
+
+// CheckBinaryServer runs a pod that fetches the health check of s at its
+// URL, so that a run whose pods cannot reach the coordinator fails before
+// anything is created rather than with every pod stuck installing the
+// binary. With --dry-run it does nothing.
+func (dm *DeploymentManager) CheckBinaryServer(s *BinaryServer) error {
+	if DryRun {
+		return nil
+	}
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	ns := dm.namespace()
+	name := "kargo-probe-" + hex.EncodeToString(suffix)
+	pod := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": Metadata{
+			Name:      name,
+			Namespace: ns,
+			Labels:    map[string]string{managedByLabel: managedByKargo},
+		},
+		"spec": PodSpec{
+			RestartPolicy: "Never",
+			Containers: []Container{{
+				Name:            "probe",
+				Image:           "alpine",
+				ImagePullPolicy: "IfNotPresent",
+				Command:         []string{"wget", "-q", "-T", "10", "-O", "/dev/null", s.baseURL + binaryHealthPath},
+			}},
+		},
+	}
+
+	fmt.Printf("Checking that pods reach the binary server at %s...\n", s.baseURL)
+	status, data, err := sendObject(http.MethodPost, fmt.Sprintf(podsEndpoint, ns), pod)
+	if err != nil {
+		return err
+	}
+	if status != 201 {
+		fmt.Println(string(data))
+		return fmt.Errorf("Pod: Unexpected HTTP status code %d", status)
+	}
+	defer deleteInBackground(fmt.Sprintf(podsEndpoint, ns) + "/" + name)
+
+	deadline := time.Now().Add(binaryProbeTimeout)
+	for time.Now().Before(deadline) {
+		p, err := getPod(ns, name)
+		if err != nil {
+			return err
+		}
+		switch p.Status.Phase {
+		case "Succeeded":
+			return nil
+		case "Failed":
+			message := containerLogTail(p, "probe", false)
+			if message == "" {
+				message = "wget failed"
+			}
+			return fmt.Errorf("pods cannot reach the binary server at %s (%s); set --binary-server-url to an address the cluster reaches the coordinator at", s.baseURL, message)
+		}
+		time.Sleep(binaryProbeInterval)
+	}
+	return fmt.Errorf("the pod checking the binary server at %s did not finish within %s", s.baseURL, binaryProbeTimeout)
+}
+
+func binaryTokenSecretName(config DeploymentConfig) string {
+	return config.Name + "-binary-token"
+}
+
+func binaryTokenManifest(config DeploymentConfig) manifest {
+	secret := Secret{
+		ApiVersion: "v1",
+		Kind:       "Secret",
+		Metadata: Metadata{
+			Name:        binaryTokenSecretName(config),
+			Namespace:   config.Namespace,
+			Labels:      objectLabels(config, nil),
+			Annotations: objectAnnotations(config, nil),
+		},
+		Type: "Opaque",
+		StringData: map[string]string{
+			binaryTokenKey: config.BinaryToken,
+		},
+	}
+	path := fmt.Sprintf(secretsEndpoint, config.Namespace)
+	return manifest{"Secret", path, secret.Metadata.Name, secret}
+}
+
+func deleteBinaryToken(config DeploymentConfig) error {
+	path := fmt.Sprintf(secretEndpoint, config.Namespace, binaryTokenSecretName(config))
+	return deleteInBackground(path)
+}
@@ -0,0 +1,231 @@
+package kargo
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinaryServer(t *testing.T) {
+	s, err := newBinaryServer(nil, "http://coordinator:8090/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	link := testUpload(t, s)
+	if want := "http://coordinator:8090/" + testChecksum + "/loadtest"; link != want {
+		t.Errorf("link is %s, want %s", link, want)
+	}
+
+	get := func(path, token, byteRange string) (int, string) {
+		request, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		if byteRange != "" {
+			request.Header.Set("Range", byteRange)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	path := "/" + testChecksum + "/loadtest"
+	if status, _ := get(path, "", ""); status != 401 {
+		t.Errorf("GET without a token returned %d, want 401", status)
+	}
+	if status, _ := get(path, "wrong", ""); status != 401 {
+		t.Errorf("GET with the wrong token returned %d, want 401", status)
+	}
+	if status, data := get(path, s.Token(), ""); status != 200 || data != "binary" {
+		t.Errorf("GET returned %d %q, want 200 %q", status, data, "binary")
+	}
+	if status, data := get(path, s.Token(), "bytes=3-"); status != 206 || data != "ary" {
+		t.Errorf("GET of bytes=3- returned %d %q, want 206 %q", status, data, "ary")
+	}
+	if status, _ := get("/"+testChecksum+"/other", s.Token(), ""); status != 404 {
+		t.Errorf("GET of an unknown binary returned %d, want 404", status)
+	}
+	if status, _ := get(binaryHealthPath, "", ""); status != 200 {
+		t.Errorf("GET of the health check without a token returned %d, want 200", status)
+	}
+
+	err = s.Put("0000/loadtest", strings.NewReader("binary"), 6, nil)
+	if err == nil {
+		t.Error("Put under the wrong checksum succeeded")
+	}
+}
+
+// TestBinaryServerURL checks that the binary server is reached at the pod
+// IP in the cluster, and needs --binary-server-url anywhere else.
+func TestBinaryServerURL(t *testing.T) {
+	saveFlags(t)
+	podIP, set := os.LookupEnv(PodIPEnv)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(PodIPEnv, podIP)
+		} else {
+			os.Unsetenv(PodIPEnv)
+		}
+	})
+	DryRun = true
+	ServeBinary = ":8090"
+
+	os.Unsetenv(PodIPEnv)
+	_, err := NewBinaryServer()
+	if err == nil || !strings.Contains(err.Error(), "--binary-server-url") {
+		t.Errorf("outside the cluster NewBinaryServer returned %v, want an error asking for --binary-server-url", err)
+	}
+
+	for _, u := range []string{"http://localhost:9000", "http://127.0.0.1:9000/", "http://[::1]:9000", "tunnel:9000"} {
+		binaryServerURL = u
+		_, err = NewBinaryServer()
+		if err == nil {
+			t.Errorf("NewBinaryServer accepted --binary-server-url %s, which pods cannot reach", u)
+		}
+	}
+
+	binaryServerURL = "http://tunnel.example:9000"
+	s, err := NewBinaryServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if s.baseURL != binaryServerURL {
+		t.Errorf("URL is %s, want %s", s.baseURL, binaryServerURL)
+	}
+
+	binaryServerURL = ""
+	os.Setenv(PodIPEnv, "10.0.0.7")
+	s, err = NewBinaryServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if want := "http://10.0.0.7:8090"; s.baseURL != want {
+		t.Errorf("URL in the cluster is %s, want %s", s.baseURL, want)
+	}
+	if _, err := os.Stat(s.dir); !os.IsNotExist(err) {
+		t.Errorf("Close left %s behind", s.dir)
+	}
+}
+
+// TestCheckBinaryServer has the probe pod succeed, then fail as it would
+// when the cluster cannot reach the coordinator.
+func TestCheckBinaryServer(t *testing.T) {
+	dm, server := newTestManager(t)
+	interval := binaryProbeInterval
+	t.Cleanup(func() { binaryProbeInterval = interval })
+	binaryProbeInterval = 10 * time.Millisecond
+
+	s, err := newBinaryServer(nil, "http://10.0.0.7:8090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, exitCode := range []int{0, 1} {
+		done := make(chan error)
+		go func() { done <- dm.CheckBinaryServer(s) }()
+
+		var probe string
+		waitFor(t, 5*time.Second, "the probe pod", func() bool {
+			pods := server.Names("pods", "default", managedByLabel+"="+managedByKargo)
+			if len(pods) == 1 {
+				probe = pods[0]
+			}
+			return probe != ""
+		})
+		var pod Pod
+		err = server.Decode("pods", "default", probe, &pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command := strings.Join(pod.Spec.Containers[0].Command, " "); !strings.HasSuffix(command, " http://10.0.0.7:8090"+binaryHealthPath) {
+			t.Errorf("probe command is %q, want a fetch of the health check", command)
+		}
+		if exitCode != 0 {
+			server.AppendLog("default", probe, "probe", "wget: can't connect to remote host (10.0.0.7): Connection refused")
+		}
+		server.FinishPod("default", probe, exitCode)
+
+		err = <-done
+		switch {
+		case exitCode == 0 && err != nil:
+			t.Errorf("CheckBinaryServer failed with a reachable server: %s", err)
+		case exitCode != 0 && (err == nil || !strings.Contains(err.Error(), "Connection refused")):
+			t.Errorf("CheckBinaryServer returned %v, want the probe's error", err)
+		}
+		waitFor(t, 5*time.Second, "the probe pod to be deleted", func() bool {
+			return server.Get("pods", "default", probe) == nil
+		})
+	}
+}
+
+func TestCreateWithBinaryToken(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	config := testConfig(1)
+	config.BinaryToken = "secret-token"
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var secret Secret
+	err = server.Decode("secrets", "default", "loadtest-binary-token", &secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.StringData[binaryTokenKey] != "secret-token" {
+		t.Errorf("Secret data = %v, want %s=secret-token", secret.StringData, binaryTokenKey)
+	}
+
+	var d Deployment
+	err = server.Decode("deployments", "default", "loadtest", &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var install *Container
+	for i, c := range d.Spec.Template.Spec.InitContainers {
+		if c.Name == "install" {
+			install = &d.Spec.Template.Spec.InitContainers[i]
+		}
+	}
+	if install == nil {
+		t.Fatal("no install init container")
+	}
+	command := strings.Join(install.Command, " ")
+	if !strings.Contains(command, "Authorization: Bearer") || strings.Contains(command, "secret-token") {
+		t.Errorf("install command %q should send the token without containing it", command)
+	}
+	mounted := false
+	for _, m := range install.VolumeMounts {
+		mounted = mounted || m.Name == binaryTokenVolume
+	}
+	if !mounted {
+		t.Errorf("install init container does not mount the token: %+v", install.VolumeMounts)
+	}
+
+	err = dm.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := server.Names("secrets", "default", ""); len(names) != 0 {
+		t.Errorf("secrets left after Delete: %v", names)
+	}
+}
@@ -0,0 +1,243 @@
+package kargo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// buildFlags build a static binary that does not depend on where the source
+// was checked out, so that the same source always has the same checksum and
+// is only uploaded once. -trimpath needs Go 1.13, which go.mod's 1.14
+// covers.
+var buildFlags = []string{"-trimpath", "-ldflags", `-extldflags "-static"`, "-tags", "netgo"}
+
+// The go env settings that change what go build produces, besides the
+// source. Paths such as GOCACHE and GOPATH, and where modules are downloaded
+// from, do not.
+var buildSettings = []string{
+	"CGO_ENABLED", "GO386", "GOAMD64", "GOARCH", "GOARM", "GOARM64", "GOEXPERIMENT",
+	"GOFLAGS", "GOMIPS", "GOMIPS64", "GOOS", "GOPPC64", "GORISCV64", "GOWASM", "GOWORK",
+}
+
+// Cached builds not used for this long are deleted.
+var buildCacheTTL = 14 * 24 * time.Hour
+
+// buildEnv is the environment of this process, so that the user's GOFLAGS,
+// GOPROXY, GOCACHE and the like apply, with the target set to a static
+// binary for linux/goarch.
+func buildEnv(goarch string) []string {
+	env := make([]string, 0)
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "GOOS", "GOARCH", "CGO_ENABLED":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env, "GOOS=linux", "GOARCH="+goarch, "CGO_ENABLED=0")
+}
+
+// buildCacheDir is the directory --build-cache names, kargo/builds in the
+// user's cache directory by default, or empty if builds are not cached.
+func buildCacheDir() string {
+	switch buildCache {
+	case "none":
+		return ""
+	case "":
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(dir, "kargo", "builds")
+	}
+	dir, err := filepath.Abs(buildCache)
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// goCommand runs the go command in dir and env and returns its output.
+func goCommand(env []string, dir string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go %s: %s\n%s", args[0], err, stderr.String())
+	}
+	return data, nil
+}
+
+type goPackage struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+	Module     *struct {
+		GoMod string
+	}
+	Error *struct {
+		Err string
+	}
+
+	GoFiles    []string
+	CgoFiles   []string
+	CFiles     []string
+	CXXFiles   []string
+	HFiles     []string
+	SFiles     []string
+	SysoFiles  []string
+	EmbedFiles []string
+}
+
+// buildKey hashes everything a build of the package in directory depends
+// on: the version of go, the go env settings that change its output,
+// buildFlags, and the files of every package the binary is built from other
+// than the standard library's, with the go.mod of their modules.
+func buildKey(env []string, directory string) (string, error) {
+	h := sha256.New()
+
+	version, err := goCommand(env, directory, "version")
+	if err != nil {
+		return "", err
+	}
+	h.Write(version)
+
+	data, err := goCommand(env, directory, "env", "-json")
+	if err != nil {
+		return "", err
+	}
+	settings := make(map[string]string)
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range buildSettings {
+		fmt.Fprintf(h, "%s=%s\n", key, settings[key])
+	}
+	fmt.Fprintf(h, "%q\n", buildFlags)
+
+	data, err = goCommand(env, directory, "list", "-deps", "-json", "-tags", "netgo", ".")
+	if err != nil {
+		return "", err
+	}
+	goMods := make(map[string]bool)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var p goPackage
+		err := decoder.Decode(&p)
+		if err != nil {
+			return "", err
+		}
+		if p.Error != nil {
+			return "", fmt.Errorf("%s: %s", p.ImportPath, p.Error.Err)
+		}
+		if p.Standard {
+			continue
+		}
+
+		files := make([]string, 0)
+		for _, names := range [][]string{p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.HFiles, p.SFiles, p.SysoFiles, p.EmbedFiles} {
+			files = append(files, names...)
+		}
+		sort.Strings(files)
+		fmt.Fprintf(h, "package %s\n", p.ImportPath)
+		for _, name := range files {
+			err := hashFile(h, name, filepath.Join(p.Dir, name))
+			if err != nil {
+				return "", err
+			}
+		}
+		if p.Module != nil && p.Module.GoMod != "" && !goMods[p.Module.GoMod] {
+			goMods[p.Module.GoMod] = true
+			err := hashFile(h, "go.mod", p.Module.GoMod)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes name and the sha256 of the file at path to h. Paths are
+// left out so that checkouts in different places hash the same.
+func hashFile(h io.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fileHash := sha256.New()
+	_, err = io.Copy(fileHash, f)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "%s %x\n", name, fileHash.Sum(nil))
+	return nil
+}
+
+// cachedBuild returns the binary called name built for key in cacheDir,
+// building it with goBuild the first time. A build is only added to the
+// cache once it has succeeded, so a failed or interrupted one is never used.
+func cachedBuild(out io.Writer, cacheDir, key, name string, goBuild func(output string) error) (string, error) {
+	entry := filepath.Join(cacheDir, key)
+	output := filepath.Join(entry, name)
+	if _, err := os.Stat(output); err == nil {
+		now := time.Now()
+		os.Chtimes(entry, now, now)
+		fmt.Fprintln(out, "Source unchanged, using cached build: "+output)
+		return output, nil
+	}
+
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	tmpDir, err := ioutil.TempDir(cacheDir, key+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	err = goBuild(filepath.Join(tmpDir, name))
+	if err != nil {
+		return "", err
+	}
+	// Another build of the same source may have finished first, and the
+	// binaries are the same, so either will do.
+	err = os.Rename(tmpDir, entry)
+	if err != nil {
+		if _, statErr := os.Stat(output); statErr != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintln(out, "Created: "+output)
+	pruneBuildCache(cacheDir)
+	return output, nil
+}
+
+// pruneBuildCache deletes the builds in cacheDir that have not been used for
+// buildCacheTTL.
+func pruneBuildCache(cacheDir string) {
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && time.Since(entry.ModTime()) > buildCacheTTL {
+			os.RemoveAll(filepath.Join(cacheDir, entry.Name()))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package kargo
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeModule writes a module with a main package to a new directory under
+// parent.
+func writeModule(t *testing.T, parent, name, source string) string {
+	dir := filepath.Join(parent, name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"go.mod":  "module example.com/worker\n\ngo 1.12\n",
+		"main.go": source,
+	}
+	for name, data := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestBuildKey(t *testing.T) {
+	parent, err := ioutil.TempDir("", "kargo-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	source := "package main\n\nfunc main() {}\n"
+	dir := writeModule(t, parent, "a", source)
+	key := func(env []string, dir string) string {
+		k, err := buildKey(env, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	amd64 := key(buildEnv("amd64"), dir)
+	if again := key(buildEnv("amd64"), dir); again != amd64 {
+		t.Errorf("key changed from %s to %s without any change", amd64, again)
+	}
+	if other := key(buildEnv("amd64"), writeModule(t, parent, "b", source)); other != amd64 {
+		t.Errorf("a checkout elsewhere has key %s, want %s", other, amd64)
+	}
+	if arm64 := key(buildEnv("arm64"), dir); arm64 == amd64 {
+		t.Error("arm64 and amd64 builds have the same key")
+	}
+	if flags := key(append(buildEnv("amd64"), "GOFLAGS=-tags=extra"), dir); flags == amd64 {
+		t.Error("GOFLAGS does not change the key")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() { println() }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited := key(buildEnv("amd64"), dir); edited == amd64 {
+		t.Error("editing the source does not change the key")
+	}
+
+	_, err = buildKey(buildEnv("amd64"), filepath.Join(parent, "missing"))
+	if err == nil {
+		t.Error("the key of a missing package has no error")
+	}
+}
+
+func TestCachedBuild(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "kargo-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	builds := 0
+	goBuild := func(output string) error {
+		builds++
+		return ioutil.WriteFile(output, []byte("binary"), 0755)
+	}
+	var out syncBuffer
+	first, err := cachedBuild(&out, cacheDir, "key1", "loadtest", goBuild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cachedBuild(&out, cacheDir, "key1", "loadtest", goBuild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builds != 1 || first != second {
+		t.Errorf("built %d times to %s and %s, want once", builds, first, second)
+	}
+
+	_, err = cachedBuild(&out, cacheDir, "key2", "loadtest", func(output string) error {
+		ioutil.WriteFile(output, []byte("partial"), 0755)
+		return errors.New("build failed")
+	})
+	if err == nil {
+		t.Error("a failed build has no error")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "key2")); !os.IsNotExist(err) {
+		t.Error("a failed build was cached")
+	}
+
+	old := time.Now().Add(-buildCacheTTL - time.Hour)
+	err = os.Chtimes(filepath.Join(cacheDir, "key1"), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cachedBuild(&out, cacheDir, "key3", "loadtest", goBuild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "key3" {
+		t.Errorf("cache holds %d entries after pruning, want key3 alone", len(entries))
+	}
+}
@@ -0,0 +1,163 @@
+package kargo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const tokenFileTTL = time.Minute
+
+// serviceAccountDir holds the token, certificate authority and namespace of
+// the pod's service account.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// apiClient sends requests to the Kubernetes API server. Requests are built
+// with only a path and query; Do fills in the server address and credentials.
+type apiClient struct {
+	server     *url.URL
+	httpClient *http.Client
+	namespace  string
+	// err, if set, is why there is no API server to talk to, and every
+	// request fails with it.
+	err error
+}
+
+// kubeClient is the client used by every request kargo makes. It is set up by
+// New.
+var kubeClient *apiClient
+
+func (c *apiClient) Do(request *http.Request) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	u := *request.URL
+	u.Scheme = c.server.Scheme
+	u.Host = c.server.Host
+	u.Path = strings.TrimSuffix(c.server.Path, "/") + request.URL.Path
+
+	r := request.WithContext(request.Context())
+	r.URL = &u
+	return c.httpClient.Do(r)
+}
+
+// newAPIClient picks how to reach the API server: through a kubectl proxy when
+// --api-host is set, with the pod's service account when running in a cluster,
+// and from the kubeconfig otherwise.
+func newAPIClient() (*apiClient, error) {
+	if apiHost != "" {
+		return &apiClient{
+			server:     &url.URL{Scheme: "http", Host: apiHost},
+			httpClient: http.DefaultClient,
+		}, nil
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" && kubeconfigPath == "" {
+		return newInClusterClient()
+	}
+	return newKubeconfigClient(kubeconfigPaths(), kubeconfigContext)
+}
+
+func newInClusterClient() (*apiClient, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside a Kubernetes cluster")
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(ca, false)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := oauth2.ReuseTokenSource(nil, &tokenFileSource{path: serviceAccountDir + "/token"})
+	return &apiClient{
+		server:     &url.URL{Scheme: "https", Host: net.JoinHostPort(host, port)},
+		httpClient: newHTTPClient(tlsConfig, tokens),
+		namespace:  strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+func newTLSConfig(ca []byte, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in certificate authority data")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func newHTTPClient(tlsConfig *tls.Config, tokens oauth2.TokenSource) *http.Client {
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if tokens != nil {
+		transport = &bearerAuthTransport{source: tokens, base: transport}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// bearerAuthTransport adds the current token from source to every request.
+// Sources that only provide client certificates return an empty token and
+// leave the request untouched.
+type bearerAuthTransport struct {
+	source oauth2.TokenSource
+	base   http.RoundTripper
+}
+
+func (t *bearerAuthTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	token, err := t.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return t.base.RoundTrip(request)
+	}
+
+	r := request.WithContext(request.Context())
+	r.Header = make(http.Header)
+	for key, values := range request.Header {
+		r.Header[key] = values
+	}
+	r.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	return t.base.RoundTrip(r)
+}
+
+// tokenFileSource reads a token from a file. Projected service account tokens
+// are rotated by the kubelet, so the file is read again once the TTL expires.
+type tokenFileSource struct {
+	path string
+}
+
+func (s *tokenFileSource) Token() (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: strings.TrimSpace(string(data)),
+		Expiry:      time.Now().Add(tokenFileTTL),
+	}, nil
+}
@@ -0,0 +1,360 @@
+package kargo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var eventsEndpoint = "/api/v1/namespaces/%s/events"
+
+// runObjectResources are the kinds of object whose warnings are reported,
+// with the resource each is found under.
+var runObjectResources = map[string]string{
+	"Pod":        "pods",
+	"ReplicaSet": "replicasets",
+	"Deployment": "deployments",
+	"Job":        "jobs",
+	"DaemonSet":  "daemonsets",
+}
+
+// How many lines of a failed init container's log to show when it left no
+// termination message.
+var initLogTailLines = 20
+
+// Diagnostic is a problem seen with one of the run's objects, either reported
+// by Kubernetes as a Warning event or read from a pod's status.
+type Diagnostic struct {
+	Object  string
+	Reason  string
+	Message string
+	Count   int
+	First   time.Time
+	Last    time.Time
+}
+
+// diagnostics watches the run's pods and Warning events, prints every new
+// problem as it is seen, and keeps them for the final report until the pod
+// they are about is deleted.
+type diagnostics struct {
+	config DeploymentConfig
+	since  time.Time
+
+	mu       sync.Mutex
+	seen     map[string]*Diagnostic
+	order    []string
+	logTails map[string]string
+	// runObjects records by uid whether an object is the run's: pods as the
+	// pod watch sees them, and anything else the first time a warning is
+	// about it.
+	runObjects map[string]bool
+}
+
+func newDiagnostics(config DeploymentConfig, since time.Time) *diagnostics {
+	return &diagnostics{
+		config:     config,
+		since:      since,
+		seen:       make(map[string]*Diagnostic),
+		logTails:   make(map[string]string),
+		runObjects: make(map[string]bool),
+	}
+}
+
+func (d *diagnostics) run(ctx context.Context) {
+	go func() {
+		path := fmt.Sprintf(eventsEndpoint, d.config.Namespace)
+		err := watchCollection(ctx, path, "", "type=Warning", d.handleEvent)
+		if err != nil {
+			fmt.Println("Watch events error: ", err)
+		}
+	}()
+
+	err := watchPods(ctx, d.config.Namespace, podSelector(d.config), d.handlePod)
+	if err != nil {
+		fmt.Println("Watch pods error: ", err)
+	}
+}
+
+// owns reports whether the object ref refers to was created for the run,
+// either directly or by one of its controllers, all of which carry its run
+// id label. Objects the pod watch has not seen are looked up once.
+func (d *diagnostics) owns(ref ObjectReference) bool {
+	d.mu.Lock()
+	owned, ok := d.runObjects[ref.Uid]
+	d.mu.Unlock()
+	if ok {
+		return owned
+	}
+	resource, ok := runObjectResources[ref.Kind]
+	if ref.Uid == "" || !ok {
+		return false
+	}
+
+	prefix := "/apis/" + ref.ApiVersion
+	if ref.ApiVersion == "v1" {
+		prefix = "/api/v1"
+	}
+	metadata, err := getObjectMetadata(fmt.Sprintf("%s/namespaces/%s/%s/%s", prefix, ref.Namespace, resource, ref.Name))
+	if err != nil && err != ErrNotExist {
+		return false
+	}
+	owned = err == nil && metadata.Uid == ref.Uid && metadata.Labels[runIDLabel] == d.config.runID
+
+	d.mu.Lock()
+	d.runObjects[ref.Uid] = owned
+	d.mu.Unlock()
+	return owned
+}
+
+func (d *diagnostics) handleEvent(eventType string, object json.RawMessage) error {
+	if eventType == "DELETED" {
+		return nil
+	}
+	var event Event
+	err := json.Unmarshal(object, &event)
+	if err != nil {
+		return err
+	}
+	if event.Type != "Warning" || !d.owns(event.InvolvedObject) {
+		return nil
+	}
+	last := event.LastTimestamp
+	if last.IsZero() {
+		last = event.FirstTimestamp
+	}
+	// Event timestamps only have whole seconds.
+	if !last.IsZero() && last.Before(d.since.Truncate(time.Second)) {
+		return nil
+	}
+
+	count := int(event.Count)
+	if count == 0 {
+		count = 1
+	}
+	name := event.InvolvedObject.Kind + " " + event.InvolvedObject.Name
+	d.report(name, event.Reason, event.Message, count, last)
+	return nil
+}
+
+func (d *diagnostics) handlePod(eventType string, pod *Pod) error {
+	name := "Pod " + pod.Metadata.Name
+	if eventType == "DELETED" {
+		d.forget(pod, name)
+		return nil
+	}
+
+	d.mu.Lock()
+	d.runObjects[pod.Metadata.Uid] = true
+	d.mu.Unlock()
+	for _, problem := range podDiagnoses(pod, d.logTail) {
+		d.report(name, problem[0], problem[1], 1, time.Now())
+	}
+	return nil
+}
+
+// forget drops what was recorded about a deleted pod.
+func (d *diagnostics) forget(pod *Pod, name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.runObjects, pod.Metadata.Uid)
+	for key := range d.logTails {
+		if strings.HasPrefix(key, pod.Metadata.Name+"/") {
+			delete(d.logTails, key)
+		}
+	}
+	order := d.order[:0]
+	for _, key := range d.order {
+		if d.seen[key].Object == name {
+			delete(d.seen, key)
+		} else {
+			order = append(order, key)
+		}
+	}
+	d.order = order
+}
+
+// logTail returns the end of the log of a terminated container, fetching it
+// only once per attempt.
+func (d *diagnostics) logTail(pod *Pod, container string, attempt int32, previous bool) string {
+	key := fmt.Sprintf("%s/%s/%d", pod.Metadata.Name, container, attempt)
+
+	d.mu.Lock()
+	tail, ok := d.logTails[key]
+	d.mu.Unlock()
+	if ok {
+		return tail
+	}
+
+	tail = containerLogTail(pod, container, previous)
+	d.mu.Lock()
+	d.logTails[key] = tail
+	d.mu.Unlock()
+	return tail
+}
+
+// report records a problem that has happened count times and prints it the
+// first time it is seen.
+func (d *diagnostics) report(object, reason, message string, count int, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := object + "\x00" + reason + "\x00" + message
+	if diagnostic, ok := d.seen[key]; ok {
+		if count > diagnostic.Count {
+			diagnostic.Count = count
+		}
+		if at.After(diagnostic.Last) {
+			diagnostic.Last = at
+		}
+		return
+	}
+
+	d.seen[key] = &Diagnostic{
+		Object:  object,
+		Reason:  reason,
+		Message: message,
+		Count:   count,
+		First:   at,
+		Last:    at,
+	}
+	d.order = append(d.order, key)
+	fmt.Printf("%s: %s: %s\n", object, reason, message)
+}
+
+func (d *diagnostics) list() []Diagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]Diagnostic, 0, len(d.order))
+	for _, key := range d.order {
+		list = append(list, *d.seen[key])
+	}
+	return list
+}
+
+// terminations returns the current and previous termination of a container,
+// each with the attempt it ended, so the same termination is recognised
+// after the container has restarted.
+func terminations(status ContainerStatus) []termination {
+	list := make([]termination, 0, 2)
+	if t := status.State.Terminated; t != nil {
+		list = append(list, termination{t, status.RestartCount + 1, false})
+	}
+	if t := status.LastTerminationState.Terminated; t != nil {
+		list = append(list, termination{t, status.RestartCount, true})
+	}
+	return list
+}
+
+type termination struct {
+	*ContainerStateTerminated
+	attempt  int32
+	previous bool
+}
+
+// podDiagnoses returns the reason and message of each problem in the status
+// of pod: eviction, containers killed for running out of memory, images that
+// cannot be pulled, and failed init containers with their output.
+func podDiagnoses(pod *Pod, logTail func(pod *Pod, container string, attempt int32, previous bool) string) [][2]string {
+	problems := make([][2]string, 0)
+	if pod.Status.Reason == "Evicted" {
+		problems = append(problems, [2]string{"Evicted", pod.Status.Message})
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && failedWaitingReasons[waiting.Reason] && waiting.Reason != "CrashLoopBackOff" {
+			problems = append(problems, [2]string{waiting.Reason, fmt.Sprintf("init container %s: %s", status.Name, waiting.Message)})
+		}
+		for _, t := range terminations(status) {
+			if t.ExitCode == 0 {
+				continue
+			}
+			output := strings.TrimSpace(t.Message)
+			if output == "" {
+				output = logTail(pod, status.Name, t.attempt, t.previous)
+			}
+			message := fmt.Sprintf("init container %s exited with code %d (attempt %d)", status.Name, t.ExitCode, t.attempt)
+			if output != "" {
+				message += ":\n" + indent(output)
+			}
+			problems = append(problems, [2]string{"InitContainerFailed", message})
+		}
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && failedWaitingReasons[waiting.Reason] && waiting.Reason != "CrashLoopBackOff" {
+			problems = append(problems, [2]string{waiting.Reason, fmt.Sprintf("container %s: %s", status.Name, waiting.Message)})
+		}
+		for _, t := range terminations(status) {
+			switch {
+			case t.Reason == "OOMKilled":
+				problems = append(problems, [2]string{"OOMKilled", fmt.Sprintf("container %s ran out of memory (attempt %d)", status.Name, t.attempt)})
+			case t.ExitCode != 0:
+				message := fmt.Sprintf("container %s exited with code %d (attempt %d)", status.Name, t.ExitCode, t.attempt)
+				if output := strings.TrimSpace(t.Message); output != "" {
+					message += ":\n" + indent(output)
+				}
+				problems = append(problems, [2]string{"ContainerFailed", message})
+			}
+		}
+	}
+	return problems
+}
+
+func indent(s string) string {
+	return "    " + strings.Replace(s, "\n", "\n    ", -1)
+}
+
+// containerLogTail returns the last lines logged by a container that has
+// terminated, or "" if they cannot be read.
+func containerLogTail(pod *Pod, container string, previous bool) string {
+	v := url.Values{}
+	v.Set("container", container)
+	if previous {
+		v.Set("previous", "true")
+	}
+	v.Set("tailLines", fmt.Sprint(initLogTailLines))
+
+	path := fmt.Sprintf(logsEndpoint, pod.Metadata.Namespace, pod.Metadata.Name)
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return ""
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Diagnostics returns the problems seen with the run's objects since Create,
+// in the order they were first seen. Those of pods that have since been
+// deleted, such as by scaling down, are left out.
+func (dm *DeploymentManager) Diagnostics() ([]Diagnostic, error) {
+	if dm.diagnostics == nil {
+		return nil, errors.New("no run has been created")
+	}
+	return dm.diagnostics.list(), nil
+}
@@ -0,0 +1,85 @@
+package kargo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var apiGroupsEndpoint = "/apis"
+
+// Group versions kargo knows how to talk to, in order of preference. Older
+// clusters only serve Deployments and DaemonSets from extensions/v1beta1,
+// current clusters only from apps/v1.
+var (
+	workloadGroupVersions = []string{"apps/v1", "apps/v1beta2", "extensions/v1beta1"}
+	jobGroupVersions      = []string{"batch/v1"}
+)
+
+// apiVersions holds the group versions picked for each kind of object kargo
+// creates.
+type apiVersions struct {
+	Workloads string
+	Jobs      string
+}
+
+// defaultAPIVersions are used without an API server to ask, when --dry-run
+// only renders manifests.
+var defaultAPIVersions = apiVersions{Workloads: "apps/v1", Jobs: "batch/v1"}
+
+func discoverAPIVersions() (apiVersions, error) {
+	var versions apiVersions
+
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path: apiGroupsEndpoint,
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return versions, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return versions, errors.New("Get API groups error non 200 reponse: " + resp.Status)
+	}
+
+	var groupList APIGroupList
+	err = json.NewDecoder(resp.Body).Decode(&groupList)
+	if err != nil {
+		return versions, err
+	}
+
+	served := make(map[string]bool)
+	for _, group := range groupList.Groups {
+		for _, version := range group.Versions {
+			served[version.GroupVersion] = true
+		}
+	}
+
+	versions.Workloads = pickGroupVersion(served, workloadGroupVersions)
+	if versions.Workloads == "" {
+		return versions, fmt.Errorf("API server serves none of %v", workloadGroupVersions)
+	}
+	versions.Jobs = pickGroupVersion(served, jobGroupVersions)
+	if versions.Jobs == "" {
+		return versions, fmt.Errorf("API server serves none of %v", jobGroupVersions)
+	}
+	return versions, nil
+}
+
+func pickGroupVersion(served map[string]bool, candidates []string) string {
+	for _, groupVersion := range candidates {
+		if served[groupVersion] {
+			return groupVersion
+		}
+	}
+	return ""
+}
@@ -0,0 +1,746 @@
+package kargo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Docker Engine API version kargo speaks. 1.25 added CPU limits.
+const dockerAPIVersion = "v1.25"
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// How long a container is given to stop before Docker kills it.
+const dockerStopTimeout = 10 * time.Second
+
+var dockerPollInterval = time.Second
+
+// dockerClient sends requests to the Docker Engine API. Like apiClient,
+// requests are built with only a path and query.
+type dockerClient struct {
+	host       string
+	httpClient *http.Client
+}
+
+// newDockerClient reaches the daemon at host, a unix:// socket or a tcp://
+// address as in $DOCKER_HOST.
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &dockerClient{host: "docker", httpClient: &http.Client{Transport: transport}}, nil
+	case "tcp", "http":
+		return &dockerClient{host: u.Host, httpClient: http.DefaultClient}, nil
+	}
+	return nil, fmt.Errorf("unsupported Docker host %q, expected unix:// or tcp://", host)
+}
+
+func (c *dockerClient) Do(request *http.Request) (*http.Response, error) {
+	u := *request.URL
+	u.Scheme = "http"
+	u.Host = c.host
+	u.Path = "/" + dockerAPIVersion + request.URL.Path
+
+	r := request.WithContext(request.Context())
+	r.URL = &u
+	return c.httpClient.Do(r)
+}
+
+// send makes a Docker API request with body, if any, encoded as JSON. Any
+// status other than those in ok is returned as an error with the daemon's
+// message, and the response body is closed.
+func (c *dockerClient) send(ctx context.Context, what, method, p string, query url.Values, body interface{}, ok ...int) (*http.Response, error) {
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: method,
+		URL: &url.URL{
+			Path:     p,
+			RawQuery: query.Encode(),
+		},
+	}
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(data))
+		request.ContentLength = int64(len(data))
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	var message struct {
+		Message string `json:"message"`
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(data, &message) != nil || message.Message == "" {
+		message.Message = strings.TrimSpace(string(data))
+	}
+	return nil, fmt.Errorf("%s error non %d reponse: %s: %s", what, ok[0], resp.Status, message.Message)
+}
+
+// The parts of the Docker API objects kargo uses.
+type dockerContainerConfig struct {
+	Image      string
+	Cmd        []string
+	Env        []string          `json:",omitempty"`
+	Labels     map[string]string `json:",omitempty"`
+	HostConfig dockerHostConfig
+}
+
+type dockerHostConfig struct {
+	Binds             []string `json:",omitempty"`
+	NanoCPUs          int64    `json:"NanoCpus,omitempty"`
+	CPUShares         int64    `json:"CpuShares,omitempty"`
+	Memory            int64    `json:",omitempty"`
+	MemoryReservation int64    `json:",omitempty"`
+}
+
+type dockerContainer struct {
+	ID    string `json:"Id"`
+	Name  string
+	State dockerContainerState
+}
+
+type dockerContainerState struct {
+	Status    string
+	Running   bool
+	ExitCode  int
+	Error     string
+	StartedAt time.Time
+}
+
+// DockerBackend runs the workers as containers on a single Docker host, with
+// the CPU and memory limits of --cpu-limit, --cpu-request, --memory-limit and
+// --memory-request. config.BinaryURL is the path of a linux binary on the
+// Docker host, which is mounted into a --docker-image container. Settings that
+// only mean something on Kubernetes, such as ConfigMaps, sidecars and
+// scheduling, are ignored.
+//
+// As with LocalBackend, a worker is ready once its container has been running
+// for a second, and containers that exit are not restarted.
+type DockerBackend struct {
+	client         *dockerClient
+	config         DeploymentConfig
+	node           string
+	dir            string
+	stopHeartbeats context.CancelFunc
+	ctx            context.Context
+	cancel         context.CancelFunc
+
+	scaleMu sync.Mutex
+
+	mu       sync.Mutex
+	workers  []*dockerWorker
+	replicas int
+	nextID   int
+	logs     io.Writer
+
+	writeMu sync.Mutex
+}
+
+type dockerWorker struct {
+	name      string
+	id        string
+	stopping  bool
+	following bool
+	removed   chan struct{}
+}
+
+// NewDocker connects to the Docker daemon at --docker-host, or $DOCKER_HOST.
+func NewDocker() (*DockerBackend, error) {
+	host := dockerHost
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+	client, err := newDockerClient(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DockerBackend{client: client, ctx: ctx, cancel: cancel}, nil
+}
+
+// Create pulls --docker-image if the host does not have it, and starts the
+// workers. With --dry-run the container configuration is printed instead. A
+// heartbeat file mounted into the containers stops the workers if this
+// process dies without deleting them, as does config.MaxRunTime.
+func (b *DockerBackend) Create(config DeploymentConfig) error {
+	if b.config.Name != "" {
+		return errors.New("the Docker workers have already been created")
+	}
+	if config.BinaryURL == "" {
+		return errors.New("Docker workers need the path of a binary to mount")
+	}
+	config.cpuRequest = cpuRequest
+	config.cpuLimit = cpuLimit
+	config.memoryRequest = memoryRequest
+	config.memoryLimit = memoryLimit
+	if config.Env == nil {
+		config.Env = make(map[string]string)
+	}
+	if config.Labels == nil {
+		config.Labels = make(map[string]string)
+	}
+	config.Labels["run"] = config.Name
+	if len(config.ScalingPlan) > 0 {
+		config.Replicas = config.ScalingPlan[0].Replicas
+	}
+	config.runID = newRunID()
+	config.owner = runOwner()
+	if config.MaxRunTime > 0 {
+		config.deadline = time.Now().Add(config.MaxRunTime)
+	}
+	b.config = config
+
+	if DryRun {
+		spec, err := b.containerConfig(config.Name + "-1")
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(spec, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d containers like:\n%s\n", config.Replicas, data)
+		return nil
+	}
+
+	var info struct {
+		Name string
+	}
+	resp, err := b.client.send(b.ctx, "Docker info", http.MethodGet, "/info", nil, nil, 200)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	b.node = info.Name
+
+	err = b.pullImage()
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "kargo-"+config.Name)
+	if err != nil {
+		return err
+	}
+	b.dir = dir
+	b.config.heartbeat = filepath.Join(dir, heartbeatKey)
+	err = writeLocalHeartbeat(b.config.heartbeat)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopHeartbeats = cancel
+	go sendLocalHeartbeats(ctx, b.config.heartbeat)
+
+	fmt.Printf("Starting %d %s containers on %s...\n", config.Replicas, config.Name, b.node)
+	return b.Scale(b.config, config.Replicas)
+}
+
+// pullImage pulls --docker-image unless the host already has it.
+func (b *DockerBackend) pullImage() error {
+	resp, err := b.client.send(b.ctx, "Inspect image", http.MethodGet, "/images/"+dockerImage+"/json", nil, nil, 200, 404)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return nil
+	}
+
+	fmt.Printf("Pulling %s...\n", dockerImage)
+	query := url.Values{}
+	query.Set("fromImage", dockerImage)
+	resp, err = b.client.send(b.ctx, "Pull image", http.MethodPost, "/images/create", query, nil, 200)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Progress is streamed as JSON messages, and so are errors once the pull
+	// has started.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return fmt.Errorf("Pull image %s error: %s", dockerImage, message.Error)
+		}
+	}
+}
+
+// containerConfig is the container of one worker, with the kargo environment
+// a pod would get.
+func (b *DockerBackend) containerConfig(name string) (*dockerContainerConfig, error) {
+	config := b.config
+	env := make([]string, 0, len(config.Env)+6)
+	for key, value := range config.Env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	env = append(env, PodNameEnv+"="+name, NodeNameEnv+"="+b.node)
+	binds := []string{config.BinaryURL + ":" + path.Join("/opt/bin", config.Name) + ":ro"}
+	if config.heartbeat != "" {
+		env = append(env,
+			heartbeatFileEnv+"="+path.Join(heartbeatMountPath, heartbeatKey),
+			heartbeatTimeoutEnv+"="+localHeartbeatTimeout.String(),
+		)
+		binds = append(binds, filepath.Dir(config.heartbeat)+":"+heartbeatMountPath+":ro")
+	}
+	if !config.deadline.IsZero() {
+		env = append(env, deadlineEnv+"="+config.deadline.UTC().Format(time.RFC3339))
+	}
+
+	hostConfig := dockerHostConfig{Binds: binds}
+	for _, limit := range []struct {
+		value string
+		scale float64
+		field *int64
+	}{
+		// The same conversions the kubelet makes.
+		{config.cpuLimit, 1e9, &hostConfig.NanoCPUs},
+		{config.cpuRequest, 1024, &hostConfig.CPUShares},
+		{config.memoryLimit, 1, &hostConfig.Memory},
+		{config.memoryRequest, 1, &hostConfig.MemoryReservation},
+	} {
+		if limit.value == "" {
+			continue
+		}
+		quantity, err := parseQuantity(limit.value)
+		if err != nil {
+			return nil, err
+		}
+		*limit.field = int64(quantity * limit.scale)
+	}
+
+	return &dockerContainerConfig{
+		Image:      dockerImage,
+		Cmd:        append([]string{path.Join("/opt/bin", config.Name)}, config.Args...),
+		Env:        env,
+		Labels:     objectLabels(config, config.Labels),
+		HostConfig: hostConfig,
+	}, nil
+}
+
+// parseQuantity reads a Kubernetes resource quantity such as 100m, 0.5, 64M
+// or 1Gi.
+func parseQuantity(s string) (float64, error) {
+	suffixes := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"m", 1e-3}, {"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+	number, multiplier := s, 1.0
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix.suffix) {
+			number, multiplier = strings.TrimSuffix(s, suffix.suffix), suffix.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return value * multiplier, nil
+}
+
+// RunID identifies the run, as the kargo.io/run-id label of its containers.
+func (b *DockerBackend) RunID() string {
+	return b.config.runID
+}
+
+// Scale creates and starts containers, or stops and removes the newest ones,
+// until n are running.
+func (b *DockerBackend) Scale(config DeploymentConfig, n int) error {
+	b.scaleMu.Lock()
+	defer b.scaleMu.Unlock()
+
+	b.mu.Lock()
+	b.replicas = n
+	running := b.running()
+	for i, w := range running {
+		if i >= n {
+			w.stopping = true
+			go b.remove(w)
+		}
+	}
+	b.mu.Unlock()
+
+	for i := len(running); i < n; i++ {
+		err := b.start()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// running returns the workers that are not being stopped, oldest first.
+func (b *DockerBackend) running() []*dockerWorker {
+	running := make([]*dockerWorker, 0, len(b.workers))
+	for _, w := range b.workers {
+		if !w.stopping {
+			running = append(running, w)
+		}
+	}
+	return running
+}
+
+func (b *DockerBackend) start() error {
+	b.mu.Lock()
+	b.nextID++
+	suffix := b.config.runID[len(b.config.runID)-8:]
+	w := &dockerWorker{
+		name:    fmt.Sprintf("%s-%s-%d", b.config.Name, suffix, b.nextID),
+		removed: make(chan struct{}),
+	}
+	b.mu.Unlock()
+
+	spec, err := b.containerConfig(w.name)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("name", w.name)
+	resp, err := b.client.send(b.ctx, "Create container", http.MethodPost, "/containers/create", query, spec, 201)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		ID       string `json:"Id"`
+		Warnings []string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, warning := range created.Warnings {
+		fmt.Printf("Container %s: %s\n", w.name, warning)
+	}
+	w.id = created.ID
+
+	b.mu.Lock()
+	b.workers = append(b.workers, w)
+	b.mu.Unlock()
+
+	resp, err = b.client.send(b.ctx, "Start container", http.MethodPost, "/containers/"+w.id+"/start", nil, nil, 204, 304)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.logs != nil {
+		b.follow(w)
+	}
+	return nil
+}
+
+// remove stops w, giving it dockerStopTimeout to shut down, and removes its
+// container.
+func (b *DockerBackend) remove(w *dockerWorker) {
+	defer close(w.removed)
+
+	query := url.Values{}
+	query.Set("t", strconv.Itoa(int(dockerStopTimeout/time.Second)))
+	resp, err := b.client.send(context.Background(), "Stop container", http.MethodPost, "/containers/"+w.id+"/stop", query, nil, 204, 304)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		resp.Body.Close()
+	}
+
+	query = url.Values{}
+	query.Set("force", "1")
+	resp, err = b.client.send(context.Background(), "Remove container", http.MethodDelete, "/containers/"+w.id, query, nil, 204, 404)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (b *DockerBackend) inspect(w *dockerWorker) (*dockerContainer, error) {
+	resp, err := b.client.send(b.ctx, "Inspect container", http.MethodGet, "/containers/"+w.id+"/json", nil, nil, 200)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var container dockerContainer
+	err = json.NewDecoder(resp.Body).Decode(&container)
+	if err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
+
+func (s dockerContainerState) ready() bool {
+	return s.Running && time.Since(s.StartedAt) >= localReadyDelay
+}
+
+func (s dockerContainerState) String() string {
+	switch {
+	case s.Running && time.Since(s.StartedAt) < localReadyDelay:
+		return "Starting"
+	case s.Running:
+		return "Running"
+	case s.Status == "exited" && s.ExitCode == 0:
+		return "Completed"
+	case s.Status == "exited":
+		state := fmt.Sprintf("Exited: exit code %d", s.ExitCode)
+		if s.Error != "" {
+			state += ": " + s.Error
+		}
+		return state
+	}
+	return s.Status
+}
+
+// WaitReady polls the containers until n are ready, printing progress, or
+// returns an error listing the containers that are not running after
+// --ready-timeout.
+func (b *DockerBackend) WaitReady(n int) error {
+	deadline := time.Now().Add(readyTimeout)
+	lastReady := -1
+	for {
+		b.mu.Lock()
+		workers := b.running()
+		b.mu.Unlock()
+
+		count := 0
+		failing := make([]string, 0)
+		for _, w := range workers {
+			container, err := b.inspect(w)
+			if err != nil {
+				failing = append(failing, w.name+": "+err.Error())
+				continue
+			}
+			if container.State.ready() {
+				count++
+			} else if !container.State.Running {
+				failing = append(failing, w.name+": "+container.State.String())
+			}
+		}
+
+		if count != lastReady {
+			fmt.Printf("%d/%d %s containers ready\n", count, n, b.config.Name)
+			lastReady = count
+		}
+		if count >= n {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if len(failing) > 0 {
+				return fmt.Errorf("timed out after %s waiting for %d ready containers; failing containers:\n%s", readyTimeout, n, strings.Join(failing, "\n"))
+			}
+			return fmt.Errorf("timed out after %s waiting for %d ready containers", readyTimeout, n)
+		}
+		time.Sleep(dockerPollInterval)
+	}
+}
+
+// Logs follows the logs of every container, including containers added later
+// by Scale, and writes them to w with each line prefixed by its container
+// name. It returns immediately.
+func (b *DockerBackend) Logs(w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.logs != nil {
+		return errors.New("already following logs")
+	}
+	b.logs = w
+	for _, worker := range b.running() {
+		b.follow(worker)
+	}
+	return nil
+}
+
+// follow streams the log of w from the start until its container stops.
+func (b *DockerBackend) follow(w *dockerWorker) {
+	if w.following {
+		return
+	}
+	w.following = true
+
+	go func() {
+		query := url.Values{}
+		query.Set("follow", "1")
+		query.Set("stdout", "1")
+		query.Set("stderr", "1")
+		resp, err := b.client.send(b.ctx, "Get container logs", http.MethodGet, "/containers/"+w.id+"/logs", query, nil, 200)
+		if err != nil {
+			if b.ctx.Err() == nil {
+				fmt.Println(err)
+			}
+			return
+		}
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(&dockerLogReader{r: bufio.NewReader(resp.Body)})
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			b.writeLine(w.name, scanner.Text())
+		}
+	}()
+}
+
+func (b *DockerBackend) writeLine(worker, line string) {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	fmt.Fprintf(b.logs, "[%s] %s\n", worker, line)
+}
+
+// dockerLogReader reads the output of a container without a TTY, which Docker
+// sends as frames of stdout and stderr, each with an 8 byte header that ends
+// in the frame's length.
+type dockerLogReader struct {
+	r         *bufio.Reader
+	remaining uint32
+}
+
+func (d *dockerLogReader) Read(p []byte) (int, error) {
+	for d.remaining == 0 {
+		var header [8]byte
+		_, err := io.ReadFull(d.r, header[:])
+		if err != nil {
+			return 0, err
+		}
+		d.remaining = binary.BigEndian.Uint32(header[4:])
+	}
+
+	if uint32(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.r.Read(p)
+	d.remaining -= uint32(n)
+	return n, err
+}
+
+// Status inspects the containers that are running or being stopped.
+func (b *DockerBackend) Status() (*RunStatus, error) {
+	b.mu.Lock()
+	status := &RunStatus{Replicas: b.replicas}
+	workers := append([]*dockerWorker{}, b.workers...)
+	b.mu.Unlock()
+
+	for _, w := range workers {
+		worker := WorkerStatus{Name: w.name, Node: b.node}
+		select {
+		case <-w.removed:
+			continue
+		default:
+		}
+
+		container, err := b.inspect(w)
+		switch {
+		case err != nil:
+			worker.State = err.Error()
+		case w.stopping:
+			worker.State = "Stopping"
+		default:
+			worker.Ready = container.State.ready()
+			worker.State = container.State.String()
+		}
+		if worker.Ready {
+			status.Ready++
+		}
+		status.Workers = append(status.Workers, worker)
+	}
+	sort.Slice(status.Workers, func(i, j int) bool {
+		return status.Workers[i].Name < status.Workers[j].Name
+	})
+	return status, nil
+}
+
+// Delete stops and removes every container of the run.
+func (b *DockerBackend) Delete() error {
+	b.scaleMu.Lock()
+	defer b.scaleMu.Unlock()
+
+	b.mu.Lock()
+	running := b.running()
+	fmt.Printf("Removing %d %s containers...\n", len(running), b.config.Name)
+	for _, w := range running {
+		w.stopping = true
+		go b.remove(w)
+	}
+	b.replicas = 0
+	workers := append([]*dockerWorker{}, b.workers...)
+	b.mu.Unlock()
+
+	for _, w := range workers {
+		<-w.removed
+	}
+	b.cancel()
+	if b.stopHeartbeats != nil {
+		b.stopHeartbeats()
+	}
+	if b.dir != "" {
+		return os.RemoveAll(b.dir)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package kargo
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.sc-corp.net/scaddlive/women-who-go.git/loadtest/pkg/kargo/kargotest"
+)
+
+// newDockerTest points a Docker backend at a fresh stub daemon, which is
+// stopped and the flags restored when the test finishes.
+func newDockerTest(t *testing.T, images ...string) (*DockerBackend, *kargotest.DockerServer) {
+	saveFlags(t)
+	server := kargotest.NewDockerServer(images...)
+	t.Cleanup(server.Close)
+	dockerHost = server.Host()
+	readyTimeout = 10 * time.Second
+	dockerPollInterval = 10 * time.Millisecond
+	localReadyDelay = 50 * time.Millisecond
+
+	b, err := NewDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, server
+}
+
+// dockerTestConfig is testConfig with a binary on the Docker host, whose
+// Kubernetes-only settings the backend ignores.
+func dockerTestConfig(replicas int) DeploymentConfig {
+	config := testConfig(replicas)
+	config.Env = map[string]string{"TARGET": "http://example.com"}
+	config.BinaryURL = "/tmp/loadtest"
+	return config
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDockerCreateScaleLogsDelete(t *testing.T) {
+	b, server := newDockerTest(t, "alpine")
+
+	config := dockerTestConfig(2)
+	err := b.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.WaitReady(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers := server.Containers()
+	if len(containers) != 2 {
+		t.Fatalf("got %d containers, want 2", len(containers))
+	}
+	c := containers[0]
+	if c.Image != "alpine" || strings.Join(c.Cmd, " ") != "/opt/bin/loadtest --duration=1m" {
+		t.Errorf("container runs %s %v, want /opt/bin/loadtest --duration=1m in alpine", c.Image, c.Cmd)
+	}
+	if !hasString(c.HostConfig.Binds, "/tmp/loadtest:/opt/bin/loadtest:ro") {
+		t.Errorf("binds = %v, want the binary mounted read only", c.HostConfig.Binds)
+	}
+	if c.HostConfig.NanoCpus != 1e8 || c.HostConfig.CpuShares != 102 || c.HostConfig.Memory != 64e6 || c.HostConfig.MemoryReservation != 64e6 {
+		t.Errorf("limits = %+v, want 0.1 CPUs and 64M of memory", c.HostConfig)
+	}
+	for _, env := range []string{"TARGET=http://example.com", PodNameEnv + "=" + c.Name, NodeNameEnv + "=docker-host"} {
+		if !hasString(c.Env, env) {
+			t.Errorf("env = %v, want %s", c.Env, env)
+		}
+	}
+	if c.Labels[runIDLabel] != b.RunID() || c.Labels["run"] != "loadtest" {
+		t.Errorf("labels = %v, want run-id %s and run=loadtest", c.Labels, b.RunID())
+	}
+
+	var out syncBuffer
+	err = b.Logs(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AppendContainerLog(c.Name, "hello")
+	waitFor(t, 5*time.Second, "hello", func() bool { return strings.Contains(out.String(), "["+c.Name+"] hello\n") })
+
+	// Containers added by Scale are followed too.
+	err = b.Scale(config, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers = server.Containers()
+	if len(containers) != 3 {
+		t.Fatalf("got %d containers, want 3", len(containers))
+	}
+	added := containers[2].Name
+	server.AppendContainerLog(added, "added")
+	waitFor(t, 5*time.Second, "added", func() bool { return strings.Contains(out.String(), "["+added+"] added\n") })
+
+	// Scaling down removes the newest containers.
+	err = b.Scale(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "one container", func() bool { return len(server.Containers()) == 1 })
+	if name := server.Containers()[0].Name; name != c.Name {
+		t.Errorf("%s is left, want the oldest container %s", name, c.Name)
+	}
+	var status *RunStatus
+	waitFor(t, 5*time.Second, "the status of one container", func() bool {
+		status, err = b.Status()
+		return err == nil && len(status.Workers) == 1
+	})
+	if status.Replicas != 1 || status.Ready != 1 || status.Workers[0].State != "Running" || status.Workers[0].Node != "docker-host" {
+		t.Errorf("Status = %+v, want one running container on docker-host", status)
+	}
+
+	heartbeat := b.config.heartbeat
+	err = b.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Containers()); n != 0 {
+		t.Errorf("%d containers left after Delete", n)
+	}
+	if _, err := os.Stat(heartbeat); !os.IsNotExist(err) {
+		t.Errorf("heartbeat file %s left after Delete", heartbeat)
+	}
+}
+
+func TestDockerPullsMissingImage(t *testing.T) {
+	b, server := newDockerTest(t)
+
+	err := b.Create(dockerTestConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete()
+	if !server.HasImage("alpine") {
+		t.Errorf("alpine was not pulled; requests: %v", server.Requests())
+	}
+}
+
+func TestDockerCreateFails(t *testing.T) {
+	b, server := newDockerTest(t, "alpine")
+	server.Fail("POST", "/containers/create", 500, 1)
+
+	err := b.Create(dockerTestConfig(1))
+	if err == nil || !strings.Contains(err.Error(), "injected failure") {
+		t.Fatalf("Create error = %v, want the daemon's message", err)
+	}
+	b.Delete()
+}
+
+func TestDockerWaitReadyReportsExitedContainers(t *testing.T) {
+	b, server := newDockerTest(t, "alpine")
+	readyTimeout = 200 * time.Millisecond
+
+	err := b.Create(dockerTestConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete()
+	name := server.Containers()[0].Name
+	server.Exit(name, 3)
+
+	err = b.WaitReady(1)
+	if err == nil || !strings.Contains(err.Error(), name+": Exited: exit code 3") {
+		t.Fatalf("WaitReady error = %v, want one saying %s exited with code 3", err, name)
+	}
+}
+
+func TestParseQuantity(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want float64
+	}{
+		{"100m", 0.1},
+		{"2", 2},
+		{"0.5", 0.5},
+		{"64M", 64e6},
+		{"64Mi", 64 << 20},
+		{"1Gi", 1 << 30},
+		{"1k", 1000},
+	} {
+		got, err := parseQuantity(test.in)
+		if err != nil || got != test.want {
+			t.Errorf("parseQuantity(%q) = %v, %v, want %v", test.in, got, err, test.want)
+		}
+	}
+	for _, in := range []string{"", "m", "-1", "ten"} {
+		if _, err := parseQuantity(in); err == nil {
+			t.Errorf("parseQuantity(%q) succeeded, want an error", in)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package kargo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// gcKind is a kind of object kargo creates, with the paths used to list it in
+// every namespace or in one.
+type gcKind struct {
+	kind            string
+	clusterPath     string
+	namespacedPath  string
+	ownsRun         bool
+	groupVersionFor func(apiVersions) string
+}
+
+var gcKinds = []gcKind{
+	{"Deployment", "/apis/%s/deployments", deploymentsEndpoint, true, func(v apiVersions) string { return v.Workloads }},
+	{"Job", "/apis/%s/jobs", jobsEndpoint, true, func(v apiVersions) string { return v.Jobs }},
+	{"DaemonSet", "/apis/%s/daemonsets", daemonSetsEndpoint, false, func(v apiVersions) string { return v.Workloads }},
+	{"ConfigMap", "/api/v1/configmaps", configMapsEndpoint, false, nil},
+	{"Secret", "/api/v1/secrets", secretsEndpoint, false, nil},
+}
+
+// Objects younger than gcGracePeriod are never orphaned, as Create makes a
+// run's ConfigMaps, Secrets and DaemonSets before its Deployment or Job.
+var gcGracePeriod = 10 * time.Minute
+
+type gcObject struct {
+	kind     string
+	path     string
+	metadata Metadata
+}
+
+// GC deletes the objects left behind by runs that did not clean up after
+// themselves: anything past its kargo.io/expires-at time, and ConfigMaps,
+// Secrets and DaemonSets older than gcGracePeriod whose run has no Deployment
+// or Job. It looks in every namespace unless --namespace is set. With dryRun
+// the objects are only printed.
+func (dm *DeploymentManager) GC(dryRun bool) error {
+	versions, err := discoverAPIVersions()
+	if err != nil {
+		return err
+	}
+
+	objects := make([]gcObject, 0)
+	liveRuns := make(map[string]bool)
+	now := time.Now()
+	for _, k := range gcKinds {
+		found, err := listManagedObjects(k, versions, namespace, managedByLabel+"="+managedByKargo)
+		if err != nil {
+			return err
+		}
+		for _, object := range found {
+			if k.ownsRun && !expired(object.metadata, now) {
+				liveRuns[object.metadata.Labels[runIDLabel]] = true
+			}
+		}
+		objects = append(objects, found...)
+	}
+
+	deleted := 0
+	var firstErr error
+	for _, object := range objects {
+		reason := gcReason(object, liveRuns, now)
+		if reason == "" {
+			continue
+		}
+
+		action := "Deleting"
+		if dryRun {
+			action = "Would delete"
+		}
+		fmt.Printf("%s %s %s/%s (run %s, owner %s): %s\n", action, object.kind, object.metadata.Namespace, object.metadata.Name,
+			object.metadata.Labels[runIDLabel], object.metadata.Labels[ownerLabel], reason)
+		if dryRun {
+			continue
+		}
+		err := deleteInBackground(object.path)
+		if err != nil && err != ErrNotExist {
+			fmt.Printf("Delete %s %s/%s error: %s\n", object.kind, object.metadata.Namespace, object.metadata.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		deleted++
+	}
+
+	if dryRun {
+		return nil
+	}
+	fmt.Printf("Deleted %d objects\n", deleted)
+	return firstErr
+}
+
+// gcReason returns why object should be deleted, or "" if it should be kept.
+func gcReason(object gcObject, liveRuns map[string]bool, now time.Time) string {
+	metadata := object.metadata
+	if expired(metadata, now) {
+		return "expired at " + metadata.Annotations[expiresAnnotation]
+	}
+	runID, ok := metadata.Labels[runIDLabel]
+	if !ok {
+		return ""
+	}
+	if object.kind != "Deployment" && object.kind != "Job" && !liveRuns[runID] && !young(metadata, now) {
+		return "orphaned"
+	}
+	return ""
+}
+
+// young reports whether the object was created less than gcGracePeriod ago,
+// or has no creation time to tell.
+func young(metadata Metadata, now time.Time) bool {
+	created, err := time.Parse(time.RFC3339, metadata.CreationTimestamp)
+	if err != nil {
+		return true
+	}
+	return now.Sub(created) < gcGracePeriod
+}
+
+func expired(metadata Metadata, now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339, metadata.Annotations[expiresAnnotation])
+	if err != nil {
+		return false
+	}
+	return now.After(expiresAt)
+}
+
+// DeleteRun deletes every object labelled with runID in --namespace. Jobs are
+// deleted last, so that a cleanup Job running DeleteRun gets to finish before
+// its own pod goes away.
+func (dm *DeploymentManager) DeleteRun(runID string, dryRun bool) error {
+	versions, err := discoverAPIVersions()
+	if err != nil {
+		return err
+	}
+	ns := namespace
+	if ns == "" {
+		ns = dm.client.namespace
+	}
+	if ns == "" {
+		ns = "default"
+	}
+
+	objects := make([]gcObject, 0)
+	jobs := make([]gcObject, 0)
+	for _, k := range gcKinds {
+		found, err := listManagedObjects(k, versions, ns, runIDLabel+"="+runID)
+		if err != nil {
+			return err
+		}
+		if k.kind == "Job" {
+			jobs = append(jobs, found...)
+		} else {
+			objects = append(objects, found...)
+		}
+	}
+	objects = append(objects, jobs...)
+
+	var firstErr error
+	for _, object := range objects {
+		if dryRun {
+			fmt.Printf("Would delete %s %s/%s\n", object.kind, object.metadata.Namespace, object.metadata.Name)
+			continue
+		}
+		fmt.Printf("Deleting %s %s/%s...\n", object.kind, object.metadata.Namespace, object.metadata.Name)
+		err := deleteInBackground(object.path)
+		if err != nil && err != ErrNotExist && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func listManagedObjects(k gcKind, versions apiVersions, namespace, labelSelector string) ([]gcObject, error) {
+	var list struct {
+		Items []struct {
+			Metadata Metadata `json:"metadata"`
+		} `json:"items"`
+	}
+
+	groupVersion := ""
+	if k.groupVersionFor != nil {
+		groupVersion = k.groupVersionFor(versions)
+	}
+
+	var path string
+	switch {
+	case namespace == "" && groupVersion == "":
+		path = k.clusterPath
+	case namespace == "":
+		path = fmt.Sprintf(k.clusterPath, groupVersion)
+	case groupVersion == "":
+		path = fmt.Sprintf(k.namespacedPath, namespace)
+	default:
+		path = fmt.Sprintf(k.namespacedPath, groupVersion, namespace)
+	}
+
+	v := url.Values{}
+	v.Set("labelSelector", labelSelector)
+
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("List " + k.kind + " error non 200 reponse: " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]gcObject, 0, len(list.Items))
+	for _, item := range list.Items {
+		objects = append(objects, gcObject{
+			kind:     k.kind,
+			path:     objectPath(k, groupVersion, item.Metadata),
+			metadata: item.Metadata,
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].metadata.Namespace != objects[j].metadata.Namespace {
+			return objects[i].metadata.Namespace < objects[j].metadata.Namespace
+		}
+		return objects[i].metadata.Name < objects[j].metadata.Name
+	})
+	return objects, nil
+}
+
+func objectPath(k gcKind, groupVersion string, metadata Metadata) string {
+	if groupVersion == "" {
+		return fmt.Sprintf(k.namespacedPath, metadata.Namespace) + "/" + metadata.Name
+	}
+	return fmt.Sprintf(k.namespacedPath, groupVersion, metadata.Namespace) + "/" + metadata.Name
+}
+
+// deleteInBackground deletes the object at path and lets the garbage
+// collector remove the pods it owns.
+func deleteInBackground(path string) error {
+	v := url.Values{}
+	v.Set("propagationPolicy", "Background")
+
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodDelete,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return ErrNotExist
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 202 {
+		return errors.New("Delete object error non 200 reponse: " + resp.Status)
+	}
+	return nil
+}
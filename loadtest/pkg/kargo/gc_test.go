@@ -0,0 +1,103 @@
+package kargo
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.sc-corp.net/scaddlive/women-who-go.git/loadtest/pkg/kargo/kargotest"
+)
+
+// putRunObject adds an object of another kargo run, as one left behind an
+// hour ago by a coordinator that died, with annotations such as its expiry.
+func putRunObject(server *kargotest.Server, resource, name, runID string, annotations map[string]string) {
+	anns := kargotest.Object{}
+	for key, value := range annotations {
+		anns[key] = value
+	}
+	obj := kargotest.Object{
+		"metadata": kargotest.Object{
+			"name":              name,
+			"creationTimestamp": time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			"labels": kargotest.Object{
+				managedByLabel: managedByKargo,
+				runIDLabel:     runID,
+				"run":          name,
+			},
+			"annotations": anns,
+		},
+	}
+	if resource == "jobs" || resource == "deployments" {
+		// Workloads without pods, so their controllers have nothing to do.
+		obj["spec"] = kargotest.Object{
+			"replicas":    0,
+			"parallelism": 0,
+			"template":    kargotest.Object{"metadata": kargotest.Object{}, "spec": kargotest.Object{}},
+		}
+	}
+	server.Put(resource, "default", obj)
+}
+
+func TestGC(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := map[string]string{expiresAnnotation: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)}
+	putRunObject(server, "configmaps", "orphan-settings", "orphan", nil)
+	putRunObject(server, "configmaps", "expired-settings", "expired", expired)
+	putRunObject(server, "jobs", "expired", "expired", expired)
+	server.Put("configmaps", "default", kargotest.Object{"metadata": kargotest.Object{"name": "unmanaged"}})
+	// A run that is still being created has no Deployment yet.
+	server.Put("configmaps", "default", kargotest.Object{"metadata": kargotest.Object{
+		"name":   "starting-settings",
+		"labels": kargotest.Object{managedByLabel: managedByKargo, runIDLabel: "starting"},
+	}})
+
+	err = dm.GC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := server.Names("configmaps", "default", ""); len(names) != 5 {
+		t.Errorf("GC with dry run left ConfigMaps %v, want all 5", names)
+	}
+
+	err = dm.GC(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(server.Names("configmaps", "default", ""), ","); names != "loadtest-settings,starting-settings,unmanaged" {
+		t.Errorf("GC left ConfigMaps %s, want loadtest-settings, starting-settings and unmanaged", names)
+	}
+	if names := server.Names("jobs", "default", ""); len(names) != 0 {
+		t.Errorf("GC left Jobs %v", names)
+	}
+	if names := server.Names("deployments", "default", ""); len(names) != 1 {
+		t.Errorf("GC left Deployments %v, want the live run's", names)
+	}
+}
+
+func TestDeleteRun(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRunObject(server, "configmaps", "other-settings", "other", nil)
+
+	err = dm.DeleteRun(dm.RunID(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(server.Names("configmaps", "default", ""), ","); names != "other-settings" {
+		t.Errorf("DeleteRun left ConfigMaps %s, want only the other run's", names)
+	}
+	for _, resource := range []string{"deployments", "daemonsets"} {
+		if names := server.Names(resource, "default", ""); len(names) != 0 {
+			t.Errorf("DeleteRun left %s %v", resource, names)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package kargo
+
+// Workers find out which pod and node they run on from these environment
+// variables, set through the downward API.
+const (
+	PodNameEnv      = "POD_NAME"
+	PodNamespaceEnv = "POD_NAMESPACE"
+	PodIPEnv        = "POD_IP"
+	NodeNameEnv     = "NODE_NAME"
+)
+
+var downwardAPIFields = []struct {
+	name      string
+	fieldPath string
+}{
+	{PodNameEnv, "metadata.name"},
+	{PodNamespaceEnv, "metadata.namespace"},
+	{PodIPEnv, "status.podIP"},
+	{NodeNameEnv, "spec.nodeName"},
+}
+
+func downwardAPIEnv() []EnvVar {
+	env := make([]EnvVar, 0, len(downwardAPIFields))
+	for _, field := range downwardAPIFields {
+		env = append(env, EnvVar{
+			Name: field.name,
+			ValueFrom: &EnvVarSource{
+				FieldRef: ObjectFieldSelector{FieldPath: field.fieldPath},
+			},
+		})
+	}
+	return env
+}
@@ -0,0 +1,244 @@
+package kargo
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// The install and verify init containers read what to check the binary
+// against from their environment.
+const (
+	binarySHA256Env    = "KARGO_BINARY_SHA256"
+	binarySignatureEnv = "KARGO_BINARY_SIGNATURE"
+
+	// With DeploymentConfig.Binaries, each binary's URL, sha256 and
+	// signature are in these suffixed with _ and its architecture, and
+	// KARGO_BINARY_ARCHES lists the architectures.
+	binaryURLEnv    = "KARGO_BINARY_URL"
+	binaryArchesEnv = "KARGO_BINARY_ARCHES"
+)
+
+// The verify init container reads the public key from the
+// --verify-key-configmap ConfigMap mounted here, which the cluster's admins
+// create, so that a run cannot supply the key its own signature is checked
+// with.
+const (
+	verifyKeyVolume    = "verify-key"
+	verifyKeyMountPath = "/etc/kargo/verify-key"
+	verifyKeyEntry     = "public-key"
+)
+
+// selectBinaryScript picks the binary built for the node from the
+// environment and passes its URL as $1 to the script that follows. uname
+// names architectures as the kernel does, not as Go and Kubernetes do.
+const selectBinaryScript = `case "$(uname -m)" in
+x86_64) arch=amd64 ;;
+aarch64 | arm64) arch=arm64 ;;
+armv*) arch=arm ;;
+i?86) arch=386 ;;
+*) arch=$(uname -m) ;;
+esac
+eval "url=\${KARGO_BINARY_URL_$arch:-}"
+if [ -z "$url" ]; then
+  echo "no binary for $arch nodes, only for $KARGO_BINARY_ARCHES" >&2
+  exit 1
+fi
+eval "KARGO_BINARY_SHA256=\${KARGO_BINARY_SHA256_$arch:-}"
+eval "KARGO_BINARY_SIGNATURE=\${KARGO_BINARY_SIGNATURE_$arch:-}"
+set -- "$url"
+`
+
+// binaryArches are the architectures selectBinaryScript can match to a node:
+// those it maps from uname -m, and those uname -m names as Go does.
+var binaryArches = []string{"386", "amd64", "arm", "arm64", "ppc64", "ppc64le", "riscv64", "s390x"}
+
+// installScript downloads $1 to $0, sending the token from the mounted Secret
+// if config.BinaryToken is set, and deletes the download and fails if its
+// sha256 is not $KARGO_BINARY_SHA256.
+const installScript = `set -e
+wget -O "$0" %s"$1"
+if [ -n "$KARGO_BINARY_SHA256" ]; then
+  actual=$(sha256sum "$0" | cut -d " " -f 1)
+  if [ "$actual" != "$KARGO_BINARY_SHA256" ]; then
+    rm -f "$0"
+    echo "checksum mismatch: the downloaded binary has sha256 $actual, expected $KARGO_BINARY_SHA256" >&2
+    exit 1
+  fi
+  echo "sha256 $actual verified"
+fi
+`
+
+// verifyScript deletes $0 and fails unless $KARGO_BINARY_SIGNATURE is the
+// ed25519 signature of its hex sha256 by the PEM public key in %s. Ed25519
+// needs OpenSSL 3.
+const verifyScript = `set -e
+command -v openssl >/dev/null || apk add --no-cache -q openssl
+echo "$KARGO_BINARY_SIGNATURE" | base64 -d > /tmp/binary.sig
+printf %%s "$(sha256sum "$0" | cut -d " " -f 1)" > /tmp/binary.sha256
+if ! openssl pkeyutl -verify -pubin -inkey %s -rawin -in /tmp/binary.sha256 -sigfile /tmp/binary.sig >/dev/null; then
+  rm -f "$0"
+  echo "signature mismatch: the downloaded binary is not signed by the cluster's ed25519 key" >&2
+  exit 1
+fi
+echo "ed25519 signature verified"
+`
+
+// installCommand downloads config.BinaryURL, or the one of config.Binaries
+// built for the node, to binaryPath. A plain wget does unless there is a
+// binary to pick, a token to send or a checksum to check.
+func installCommand(config DeploymentConfig, binaryPath string) []string {
+	if len(config.Binaries) == 0 && config.BinaryToken == "" && config.BinarySHA256 == "" {
+		return []string{"wget", "-O", binaryPath, config.BinaryURL}
+	}
+	header := ""
+	if config.BinaryToken != "" {
+		header = `--header "Authorization: Bearer $(cat ` + path.Join(binaryTokenMountPath, binaryTokenKey) + `)" `
+	}
+	script := fmt.Sprintf(installScript, header)
+	if len(config.Binaries) > 0 {
+		return []string{"sh", "-c", selectBinaryScript + script, binaryPath}
+	}
+	return []string{"sh", "-c", script, binaryPath, config.BinaryURL}
+}
+
+func installEnv(config DeploymentConfig) []EnvVar {
+	if len(config.Binaries) > 0 {
+		return binariesEnv(config.Binaries, binarySHA256Env, func(binary Artifact) string { return binary.SHA256 })
+	}
+	if config.BinarySHA256 == "" {
+		return nil
+	}
+	return []EnvVar{{Name: binarySHA256Env, Value: config.BinarySHA256}}
+}
+
+// binariesEnv lists the architectures of binaries and gives the URL and the
+// value of field of each, under name, for selectBinaryScript.
+func binariesEnv(binaries []Artifact, name string, field func(Artifact) string) []EnvVar {
+	arches := make([]string, 0, len(binaries))
+	for _, binary := range binaries {
+		arches = append(arches, binary.Arch)
+	}
+	env := []EnvVar{{Name: binaryArchesEnv, Value: strings.Join(arches, ",")}}
+	for _, binary := range binaries {
+		env = append(env, EnvVar{Name: binaryURLEnv + "_" + binary.Arch, Value: binary.URL})
+		if value := field(binary); value != "" {
+			env = append(env, EnvVar{Name: name + "_" + binary.Arch, Value: value})
+		}
+	}
+	return env
+}
+
+// signed reports whether the binary, or every one of config.Binaries, has a
+// signature for the verify init container to check.
+func signed(config DeploymentConfig) bool {
+	if len(config.Binaries) == 0 {
+		return config.BinarySignature != ""
+	}
+	for _, binary := range config.Binaries {
+		if binary.Signature == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyContainer checks the signature of the binary installed at
+// binaryPath before it is made executable.
+func verifyContainer(config DeploymentConfig, binaryPath string) Container {
+	keyPath := path.Join(verifyKeyMountPath, verifyKeyEntry)
+	script := fmt.Sprintf(verifyScript, keyPath)
+	env := []EnvVar{{Name: binarySignatureEnv, Value: config.BinarySignature}}
+	if len(config.Binaries) > 0 {
+		script = selectBinaryScript + script
+		env = binariesEnv(config.Binaries, binarySignatureEnv, func(binary Artifact) string { return binary.Signature })
+	}
+	return Container{
+		Name:            "verify",
+		Image:           verifyImage,
+		ImagePullPolicy: "IfNotPresent",
+		Command:         []string{"sh", "-c", script, binaryPath},
+		Env:             env,
+		VolumeMounts: []VolumeMount{
+			VolumeMount{
+				Name:      "bin",
+				MountPath: "/opt/bin",
+			},
+			VolumeMount{
+				Name:      verifyKeyVolume,
+				MountPath: verifyKeyMountPath,
+				ReadOnly:  true,
+			},
+		},
+
+		TerminationMessagePolicy: "FallbackToLogsOnError",
+	}
+}
+
+// checkVerifyKey makes sure that pods can check the signature of a signed
+// binary: --verify-key-configmap must name a ConfigMap that kargo did not
+// create, holding the public key of --signing-key. A --dry-run that only
+// renders manifests does not look it up.
+func checkVerifyKey(config DeploymentConfig) error {
+	if verifyKeyConfigMap == "" {
+		return errors.New("signed binaries need --verify-key-configmap, a ConfigMap with the public key that the run does not create itself")
+	}
+	if renderOnly() {
+		return nil
+	}
+
+	cm, err := getConfigMap(config.Namespace, verifyKeyConfigMap)
+	if err == ErrNotExist {
+		return fmt.Errorf("--verify-key-configmap %s does not exist in namespace %s", verifyKeyConfigMap, config.Namespace)
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Metadata.Labels[managedByLabel] == managedByKargo {
+		return fmt.Errorf("--verify-key-configmap %s was created by kargo, and must come from the cluster's admins", verifyKeyConfigMap)
+	}
+	publicKey := config.BinaryPublicKey
+	if len(config.Binaries) > 0 {
+		publicKey = config.Binaries[0].PublicKey
+	}
+	if strings.TrimSpace(cm.Data[verifyKeyEntry]) != strings.TrimSpace(publicKey) {
+		return fmt.Errorf("the %s entry of --verify-key-configmap %s is not the public key of --signing-key", verifyKeyEntry, verifyKeyConfigMap)
+	}
+	return nil
+}
+
+// signBinary signs the hex sha256 of a binary with the PEM ed25519 private
+// key at keyPath, and returns the base64 signature and the PEM public key.
+// Signing the checksum rather than the binary means the binary never has to
+// be read into memory.
+func signBinary(keyPath string, checksum string) (string, string, error) {
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return "", "", err
+	}
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return "", "", fmt.Errorf("%s has no PEM private key", keyPath)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %s", keyPath, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return "", "", errors.New(keyPath + " is not an ed25519 key")
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return "", "", err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(checksum)))
+	return signature, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})), nil
+}
@@ -0,0 +1,253 @@
+package kargo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	jobsEndpoint = "/apis/%s/namespaces/%s/jobs"
+	jobEndpoint  = "/apis/%s/namespaces/%s/jobs/%s"
+)
+
+var jobPollInterval = 5 * time.Second
+
+// JobConfig describes a finite run. Workers run as a batch/v1 Job whose pods
+// are expected to exit on their own, rather than a Deployment whose pods are
+// restarted until the coordinator deletes it.
+type JobConfig struct {
+	Parallelism           int
+	Completions           int
+	ActiveDeadlineSeconds int64
+	BackoffLimit          int
+}
+
+// PodExitStatus is the final state of the main container of one Job pod.
+type PodExitStatus struct {
+	Pod      string
+	ExitCode int32
+	Reason   string
+	Message  string
+}
+
+// JobResult is the outcome of a Job run once it has completed or failed.
+type JobResult struct {
+	Complete  bool
+	Reason    string
+	Message   string
+	Succeeded int32
+	Failed    int32
+	Pods      []PodExitStatus
+}
+
+func int32Ptr(i int) *int32 {
+	v := int32(i)
+	return &v
+}
+
+func jobManifest(versions apiVersions, config DeploymentConfig) manifest {
+	template := podTemplate(config)
+	template.Spec.RestartPolicy = "Never"
+
+	job := Job{
+		ApiVersion: versions.Jobs,
+		Kind:       "Job",
+		Metadata: Metadata{
+			Name:        config.Name,
+			Namespace:   config.Namespace,
+			Labels:      objectLabels(config, config.Labels),
+			Annotations: objectAnnotations(config, nil),
+		},
+		Spec: JobSpec{
+			Parallelism:  int32Ptr(config.Job.Parallelism),
+			Completions:  int32Ptr(config.Job.Completions),
+			BackoffLimit: int32Ptr(config.Job.BackoffLimit),
+			Template:     template,
+		},
+	}
+	if config.Job.ActiveDeadlineSeconds > 0 {
+		job.Spec.ActiveDeadlineSeconds = &config.Job.ActiveDeadlineSeconds
+	}
+
+	path := fmt.Sprintf(jobsEndpoint, versions.Jobs, config.Namespace)
+	return manifest{"Job", path, config.Name, job}
+}
+
+func getJob(groupVersion, namespace, name string) (*Job, error) {
+	var job Job
+
+	path := fmt.Sprintf(jobEndpoint, groupVersion, namespace, name)
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path: path,
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Get job error non 200 reponse: " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// scaleJob changes how many pods of the Job run at the same time. Jobs have
+// no scale subresource, so the Job itself is updated.
+func scaleJob(groupVersion, namespace, name string, parallelism int) error {
+	job, err := getJob(groupVersion, namespace, name)
+	if err != nil {
+		return err
+	}
+	job.Spec.Parallelism = int32Ptr(parallelism)
+
+	var b []byte
+	body := bytes.NewBuffer(b)
+	err = json.NewEncoder(body).Encode(job)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf(jobEndpoint, groupVersion, namespace, name)
+	request := &http.Request{
+		Body:          ioutil.NopCloser(body),
+		ContentLength: int64(body.Len()),
+		Header:        make(http.Header),
+		Method:        http.MethodPut,
+		URL: &url.URL{
+			Path: path,
+		},
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return errors.New("Scale Job error non 200 reponse: " + resp.Status)
+	}
+
+	return nil
+}
+
+func deleteJob(versions apiVersions, config DeploymentConfig) error {
+	// Without a propagation policy the Job's pods are orphaned and keep
+	// running after the Job is gone.
+	v := url.Values{}
+	v.Set("propagationPolicy", "Background")
+
+	path := fmt.Sprintf(jobEndpoint, versions.Jobs, config.Namespace, config.Name)
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodDelete,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		return errors.New("Delete Job error non 200 reponse: " + resp.Status)
+	}
+
+	return nil
+}
+
+// waitForJob polls the Job until it is Complete or Failed, then collects the
+// exit status of the main container of every pod it created.
+func waitForJob(versions apiVersions, config DeploymentConfig) (*JobResult, error) {
+	for {
+		job, err := getJob(versions.Jobs, config.Namespace, config.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, condition := range job.Status.Conditions {
+			if condition.Status != "True" {
+				continue
+			}
+			if condition.Type != "Complete" && condition.Type != "Failed" {
+				continue
+			}
+
+			result := &JobResult{
+				Complete:  condition.Type == "Complete",
+				Reason:    condition.Reason,
+				Message:   condition.Message,
+				Succeeded: job.Status.Succeeded,
+				Failed:    job.Status.Failed,
+			}
+			result.Pods, err = podExitStatuses(config)
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
+		}
+
+		time.Sleep(jobPollInterval)
+	}
+}
+
+func podExitStatuses(config DeploymentConfig) ([]PodExitStatus, error) {
+	podList, err := getPods(config.Namespace, podSelector(config))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]PodExitStatus, 0)
+	for _, pod := range podList.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != config.Name || status.State.Terminated == nil {
+				continue
+			}
+			statuses = append(statuses, PodExitStatus{
+				Pod:      pod.Metadata.Name,
+				ExitCode: status.State.Terminated.ExitCode,
+				Reason:   status.State.Terminated.Reason,
+				Message:  status.State.Terminated.Message,
+			})
+		}
+	}
+	return statuses, nil
+}
@@ -12,29 +12,76 @@
 package kargo
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"time"
 )
 
 var (
-	apiHost          string
-	cpuLimit         string
-	cpuRequest       string
-	memoryLimit      string
-	memoryRequest    string
-	namespace        string
-	EnableKubernetes bool
+	apiHost            string
+	kubeconfigPath     string
+	kubeconfigContext  string
+	cpuLimit           string
+	cpuRequest         string
+	memoryLimit        string
+	memoryRequest      string
+	namespace          string
+	readyTimeout       time.Duration
+	forceReplace       bool
+	runTTL             time.Duration
+	outputPath         string
+	outputFormat       string
+	serverDryRun       bool
+	DryRun             bool
+	EnableKubernetes   bool
+	EnableLocal        bool
+	EnableDocker       bool
+	dockerHost         string
+	dockerImage        string
+	artifactStore      string
+	ServeBinary        string
+	binaryServerURL    string
+	signedURLTTL       time.Duration
+	signingKey         string
+	verifyImage        string
+	verifyKeyConfigMap string
+	architectures      string
+	buildCache         string
 )
 
 func init() {
-	flag.StringVar(&apiHost, "api-host", "127.0.0.1:8001", "Kubernetes API server")
+	flag.StringVar(&apiHost, "api-host", "", "Kubernetes API server reached over plain HTTP, such as a kubectl proxy on 127.0.0.1:8001")
+	flag.StringVar(&kubeconfigPath, "kubeconfig", "", "Path to the kubeconfig file (defaults to $KUBECONFIG or ~/.kube/config)")
+	flag.StringVar(&kubeconfigContext, "context", "", "The kubeconfig context to use (defaults to the current context)")
 	flag.StringVar(&cpuLimit, "cpu-limit", "100m", "Max CPU in milicores")
 	flag.StringVar(&cpuRequest, "cpu-request", "100m", "Min CPU in milicores")
 	flag.StringVar(&memoryLimit, "memory-limit", "64M", "Max memory in MB")
 	flag.StringVar(&memoryRequest, "memory-request", "64M", "Min memory in MB")
-	flag.StringVar(&namespace, "namespace", "default", "The Kubernetes namespace.")
+	flag.StringVar(&namespace, "namespace", "", "The Kubernetes namespace (defaults to the context's namespace or default).")
+	flag.DurationVar(&readyTimeout, "ready-timeout", 5*time.Minute, "How long to wait for pods to become ready.")
+	flag.BoolVar(&forceReplace, "force-replace", false, "Delete and recreate objects left over from an earlier run instead of updating them.")
+	flag.DurationVar(&runTTL, "run-ttl", 12*time.Hour, "How long after it starts a run's objects may be deleted by kargo gc.")
+	flag.BoolVar(&DryRun, "dry-run", false, "Print the objects that would be created, or with gc deleted, without changing anything")
+	flag.StringVar(&outputPath, "output", "-", "Where --dry-run writes manifests: - for stdout, or a directory")
+	flag.StringVar(&outputFormat, "output-format", "yaml", "Format of --dry-run manifests: yaml or json")
+	flag.BoolVar(&serverDryRun, "server-dry-run", false, "With --dry-run, validate the manifests with the API server without creating them")
 	flag.BoolVar(&EnableKubernetes, "kubernetes", false, "Deploy to Kubernetes.")
+	flag.BoolVar(&EnableLocal, "local", false, "Run the workers as processes on this machine instead of on Kubernetes.")
+	flag.BoolVar(&EnableDocker, "docker", false, "Run the workers as containers on a Docker host instead of on Kubernetes.")
+	flag.StringVar(&dockerHost, "docker-host", "", "The Docker daemon to run --docker workers on (defaults to $DOCKER_HOST or "+defaultDockerHost+")")
+	flag.StringVar(&artifactStore, "artifact-store", "", "Where the worker binary is uploaded: gs://bucket, s3://bucket?endpoint=url&region=r, file:///dir?url=base-url or an http:// server that accepts PUT (defaults to the loadtest's GCS bucket); GCS and S3 objects are private behind signed URLs unless ?public=true")
+	flag.StringVar(&ServeBinary, "serve-binary", "", "Serve the worker binary from this address, such as :8090, instead of uploading it to --artifact-store; workers fetch it with a token")
+	flag.StringVar(&binaryServerURL, "binary-server-url", "", "The URL workers reach --serve-binary at, through a tunnel if need be (defaults to http://$POD_IP:<port> in the cluster, required elsewhere)")
+	flag.DurationVar(&signedURLTTL, "signed-url-ttl", 0, "How long workers' signed URLs of the private GCS or S3 worker binary are valid, which must cover every pod started during the run (defaults to 24h)")
+	flag.StringVar(&signingKey, "signing-key", "", "PEM ed25519 private key, as made by openssl genpkey -algorithm ed25519, that signs the worker binary; pods check the signature before running it")
+	flag.StringVar(&verifyKeyConfigMap, "verify-key-configmap", "", "A ConfigMap in the run's namespace, created by the cluster's admins, whose public-key entry is the PEM key pods check --signing-key signatures with")
+	flag.StringVar(&verifyImage, "verify-image", "alpine", "The image pods check --signing-key signatures in; openssl is installed with apk if it lacks it")
+	flag.StringVar(&architectures, "arch", "", "Comma separated architectures, such as amd64,arm64, to build the worker binary for (defaults to those of the nodes the workers can be scheduled on)")
+	flag.StringVar(&buildCache, "build-cache", "", "Directory that keeps worker binaries by the hash of their source and build settings, so unchanged source is neither rebuilt nor uploaded again (defaults to kargo/builds in the user cache directory); none disables it")
+	flag.StringVar(&dockerImage, "docker-image", "alpine", "The image --docker workers run the loadtest binary in")
 }
 
 type DeploymentConfig struct {
@@ -55,23 +102,107 @@ type DeploymentConfig struct {
 	ConfigMaps    []ConfigMap
 	Volumes       []Volume
 	DaemonSets    []Container
+	Job           *JobConfig
+
+	// BinaryToken, if set, is sent as a bearer token when downloading
+	// BinaryURL, as a BinaryServer requires. It reaches the pods in a Secret.
+	BinaryToken string
+	// BinarySHA256, if set, is checked before the binary runs, as are
+	// BinarySignature, an Artifact's base64 ed25519 signature. Pods check
+	// it with the key in --verify-key-configmap, which must match
+	// BinaryPublicKey.
+	BinarySHA256    string
+	BinarySignature string
+	BinaryPublicKey string
+	// Binaries, if set, replace BinaryURL and the fields that check it with
+	// one Artifact per node architecture. Pods install the binary built for
+	// their node, and with ArchAffinity are only scheduled on nodes labelled
+	// with one of their architectures. Leave ArchAffinity unset when the
+	// nodes are not labelled, as Architectures reports.
+	Binaries     []Artifact
+	ArchAffinity bool
+
+	// VolumeMounts are mounted into the worker container, typically from
+	// Volumes backed by ConfigMaps that the coordinator updates with
+	// UpdateConfigMap while the run is going.
+	VolumeMounts []VolumeMount
+
+	// ScalingPlan is carried out by RunScalingPlan. The workers start with
+	// the replicas of its first step.
+	ScalingPlan []ScalingStep
+
+	// NodeSelector, Tolerations, Affinity and TopologySpreadConstraints
+	// control where the workers are scheduled. Pod affinity terms and spread
+	// constraints without a label selector apply to the workers of this run.
+	NodeSelector              map[string]string
+	Tolerations               []Toleration
+	Affinity                  *Affinity
+	TopologySpreadConstraints []TopologySpreadConstraint
+
+	// MaxRunTime stops the workers this long after Create even if the
+	// coordinator is still running. Zero means no limit.
+	MaxRunTime time.Duration
+	// HeartbeatTimeout stops the workers once the coordinator has not sent a
+	// heartbeat for this long. Zero disables heartbeats.
+	HeartbeatTimeout time.Duration
+	// CleanupServiceAccount, if set, runs a Job under this service account
+	// that deletes the run's objects once its workers have stopped.
+	CleanupServiceAccount string
+
+	runID     string
+	owner     string
+	expiresAt time.Time
+	deadline  time.Time
+	heartbeat string
 }
 
 type DeploymentManager struct {
-	apiHost string
-	config  DeploymentConfig
+	client   *apiClient
+	config   DeploymentConfig
+	versions apiVersions
+	logs     *logMux
+	stopLogs context.CancelFunc
+
+	stopHeartbeats context.CancelFunc
+
+	diagnostics     *diagnostics
+	stopDiagnostics context.CancelFunc
 }
 
-func New() *DeploymentManager {
-	return &DeploymentManager{apiHost: apiHost}
+// New connects to the API server. A --dry-run that only renders manifests
+// does not need one, so it goes ahead if none is configured.
+func New() (*DeploymentManager, error) {
+	client, err := newAPIClient()
+	if err != nil {
+		if !renderOnly() {
+			return nil, err
+		}
+		client = &apiClient{err: err}
+	}
+	kubeClient = client
+	return &DeploymentManager{client: client}, nil
 }
 
+// namespace is where runs go: --namespace, or else the namespace of the
+// kubeconfig context or service account, or else default.
+func (dm *DeploymentManager) namespace() string {
+	if namespace != "" {
+		return namespace
+	}
+	if dm.client.namespace != "" {
+		return dm.client.namespace
+	}
+	return "default"
+}
+
+// Create submits the workers and everything they need. With --dry-run the
+// manifests are written out instead and nothing is created.
 func (dm *DeploymentManager) Create(config DeploymentConfig) error {
 	config.cpuRequest = cpuRequest
 	config.cpuLimit = cpuLimit
 	config.memoryRequest = memoryRequest
 	config.memoryLimit = memoryLimit
-	config.Namespace = namespace
+	config.Namespace = dm.namespace()
 
 	if config.Env == nil {
 		config.Env = make(map[string]string)
@@ -82,25 +213,157 @@ func (dm *DeploymentManager) Create(config DeploymentConfig) error {
 	if config.Labels == nil {
 		config.Labels = make(map[string]string)
 	}
+	config.Labels["run"] = config.Name
+	if len(config.ScalingPlan) > 0 {
+		config.Replicas = config.ScalingPlan[0].Replicas
+	}
+	if config.HeartbeatTimeout > 0 && config.HeartbeatTimeout < minHeartbeatTimeout {
+		return fmt.Errorf("heartbeat timeout must be at least %s", minHeartbeatTimeout)
+	}
+	if config.CleanupServiceAccount != "" && config.MaxRunTime <= 0 && config.HeartbeatTimeout <= 0 {
+		return errors.New("a cleanup Job needs a max run time or a heartbeat timeout to know when to run")
+	}
+	if signed(config) {
+		err := checkVerifyKey(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	config.runID = newRunID()
+	config.owner = runOwner()
+	config.expiresAt = start.Add(runTTL)
+	if config.MaxRunTime > 0 {
+		config.deadline = start.Add(config.MaxRunTime)
+		if config.deadline.Before(config.expiresAt) {
+			config.expiresAt = config.deadline
+		}
+	}
+	if config.HeartbeatTimeout > 0 {
+		config.heartbeat = config.Name + "-heartbeat"
+	}
+	for name, value := range selfDestructEnv(config) {
+		config.Env[name] = value
+	}
+	if config.Job == nil && (config.MaxRunTime > 0 || config.HeartbeatTimeout > 0) {
+		config.Env[idleOnStopEnv] = "true"
+	}
 	dm.config = config
 
-	fmt.Printf("Creating %s ReplicaSet...\n", config.Name)
-	createConfigMaps(dm.config)
-	createDaemonSets(dm.config)
-	return createReplicaSet(dm.config)
+	versions := defaultAPIVersions
+	if !renderOnly() {
+		var err error
+		versions, err = discoverAPIVersions()
+		if err != nil {
+			return err
+		}
+	}
+	dm.versions = versions
+
+	manifests := buildManifests(dm.versions, dm.config)
+	if DryRun {
+		return dryRun(manifests)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dm.diagnostics = newDiagnostics(dm.config, start)
+	dm.stopDiagnostics = cancel
+	go dm.diagnostics.run(ctx)
+
+	for _, m := range manifests {
+		fmt.Printf("Creating %s %s...\n", m.kind, m.name)
+		err := applyObject(m.kind, m.collectionPath, m.name, m.object)
+		if err != nil {
+			return err
+		}
+	}
+	if config.heartbeat != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		dm.stopHeartbeats = cancel
+		go sendHeartbeats(ctx, dm.config)
+	}
+	return nil
+}
+
+// RunID identifies the objects created by Create, as the kargo.io/run-id
+// label.
+func (dm *DeploymentManager) RunID() string {
+	return dm.config.runID
 }
 
+// Scale changes the number of running workers. For a Job this is the number
+// of pods running in parallel. The workers are looked up in the namespace
+// Create picked, which may differ from config.Namespace when --namespace or
+// the kubeconfig context sets one.
 func (dm *DeploymentManager) Scale(config DeploymentConfig, n int) error {
-	return scaleReplicaSet(config.Namespace, config.Name, n)
+	if dm.config.Job != nil {
+		return scaleJob(dm.versions.Jobs, dm.config.Namespace, config.Name, n)
+	}
+	return scaleDeployment(dm.versions.Workloads, dm.config.Namespace, config.Name, n)
+}
+
+// Wait blocks until the Job created by Create completes or fails and returns
+// the exit status of each of its pods.
+func (dm *DeploymentManager) Wait() (*JobResult, error) {
+	if dm.config.Job == nil {
+		return nil, errors.New("Wait is only supported for Job deployments")
+	}
+	return waitForJob(dm.versions, dm.config)
+}
+
+// WaitReady blocks until n pods are Running and Ready, printing progress, or
+// returns an error listing the pods that failed to start after
+// --ready-timeout.
+func (dm *DeploymentManager) WaitReady(n int) error {
+	return waitForPods(dm.config, n, readyTimeout)
 }
 
 func (dm *DeploymentManager) Delete() error {
-	fmt.Printf("Deleting %s ReplicaSet...\n", dm.config.Name)
+	if dm.stopLogs != nil {
+		dm.stopLogs()
+	}
+	if dm.stopHeartbeats != nil {
+		dm.stopHeartbeats()
+	}
+	if dm.stopDiagnostics != nil {
+		dm.stopDiagnostics()
+	}
+	if dm.config.CleanupServiceAccount != "" {
+		deleteCleanupJob(dm.versions, dm.config)
+	}
+	if dm.config.heartbeat != "" {
+		deleteHeartbeat(dm.config)
+	}
+	if dm.config.BinaryToken != "" {
+		deleteBinaryToken(dm.config)
+	}
 	deleteConfigMaps(dm.config)
-	deleteDaemonSets(dm.config)
-	return deleteReplicaSet(dm.config)
+	deleteDaemonSets(dm.versions, dm.config)
+	if dm.config.Job != nil {
+		fmt.Printf("Deleting %s Job...\n", dm.config.Name)
+		return deleteJob(dm.versions, dm.config)
+	}
+	fmt.Printf("Deleting %s Deployment...\n", dm.config.Name)
+	return deleteDeployment(dm.versions, dm.config)
 }
 
+// Logs follows the logs of every pod of the deployment, including pods added
+// later by Scale and restarted containers, and writes them to w with each line
+// prefixed by its pod name. It returns immediately.
 func (dm *DeploymentManager) Logs(w io.Writer) error {
-	return getLogs(dm.config, w)
+	if dm.logs != nil {
+		return errors.New("already following logs")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dm.logs = newLogMux(dm.config, w)
+	dm.stopLogs = cancel
+	go func() {
+		err := dm.logs.run(ctx)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	return nil
 }
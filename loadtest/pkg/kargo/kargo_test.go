@@ -0,0 +1,646 @@
+package kargo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.sc-corp.net/scaddlive/women-who-go.git/loadtest/pkg/kargo/kargotest"
+)
+
+// testFlags are the package variables tests change: flags, and the
+// intervals and timeouts that tests shorten.
+type testFlags struct {
+	apiHost, kubeconfigPath, namespace, dockerHost string
+	kubeconfigContext                              string
+	architectures, buildCache, outputPath          string
+	ServeBinary, binaryServerURL                   string
+	verifyKeyConfigMap                             string
+	DryRun, serverDryRun                           bool
+
+	readyTimeout, logRetryInterval, jobPollInterval time.Duration
+	dockerPollInterval, localReadyDelay             time.Duration
+	uploadRetryDelay, signedURLTTL                  time.Duration
+	uploadChunkSize                                 int64
+}
+
+// saveFlags restores every testFlags variable when t finishes, so that a
+// test or fixture can change any of them.
+func saveFlags(t *testing.T) {
+	saved := testFlags{
+		apiHost, kubeconfigPath, namespace, dockerHost,
+		kubeconfigContext,
+		architectures, buildCache, outputPath,
+		ServeBinary, binaryServerURL,
+		verifyKeyConfigMap,
+		DryRun, serverDryRun,
+		readyTimeout, logRetryInterval, jobPollInterval,
+		dockerPollInterval, localReadyDelay,
+		uploadRetryDelay, signedURLTTL,
+		uploadChunkSize,
+	}
+	t.Cleanup(func() {
+		apiHost, kubeconfigPath, namespace, dockerHost = saved.apiHost, saved.kubeconfigPath, saved.namespace, saved.dockerHost
+		kubeconfigContext = saved.kubeconfigContext
+		architectures, buildCache, outputPath = saved.architectures, saved.buildCache, saved.outputPath
+		ServeBinary, binaryServerURL = saved.ServeBinary, saved.binaryServerURL
+		verifyKeyConfigMap = saved.verifyKeyConfigMap
+		DryRun, serverDryRun = saved.DryRun, saved.serverDryRun
+		readyTimeout, logRetryInterval, jobPollInterval = saved.readyTimeout, saved.logRetryInterval, saved.jobPollInterval
+		dockerPollInterval, localReadyDelay = saved.dockerPollInterval, saved.localReadyDelay
+		uploadRetryDelay, signedURLTTL = saved.uploadRetryDelay, saved.signedURLTTL
+		uploadChunkSize = saved.uploadChunkSize
+	})
+}
+
+// newTestManager points kargo at a fresh fake API server. When the test
+// finishes whatever it created is deleted, the server is stopped and the
+// flags are restored.
+func newTestManager(t *testing.T) (*DeploymentManager, *kargotest.Server) {
+	saveFlags(t)
+	server := kargotest.NewServer()
+	t.Cleanup(server.Close)
+	apiHost = server.Host()
+	readyTimeout = 10 * time.Second
+	logRetryInterval = 10 * time.Millisecond
+	jobPollInterval = 10 * time.Millisecond
+
+	dm, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dm.Delete() })
+	return dm, server
+}
+
+func testConfig(replicas int) DeploymentConfig {
+	return DeploymentConfig{
+		Name:      "loadtest",
+		Namespace: "default",
+		Args:      []string{"--duration=1m"},
+		BinaryURL: "https://example.com/loadtest",
+		Replicas:  replicas,
+		ConfigMaps: []ConfigMap{
+			{Metadata: Metadata{Name: "loadtest-settings"}, Data: map[string]string{"rate": "10"}},
+		},
+		DaemonSets: []Container{
+			{Name: "loadtest-agent", Image: "alpine"},
+		},
+	}
+}
+
+// waitFor polls cond until it is true or timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that logs can be written to while the test
+// reads it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestCreate(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	err := dm.Create(testConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d Deployment
+	err = server.Decode("deployments", "default", "loadtest", &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Spec.Replicas != 2 {
+		t.Errorf("Deployment has %d replicas, want 2", d.Spec.Replicas)
+	}
+	if d.Metadata.Labels[managedByLabel] != managedByKargo || d.Metadata.Labels[runIDLabel] != dm.RunID() {
+		t.Errorf("Deployment labels = %v, want %s=%s and %s=%s", d.Metadata.Labels, managedByLabel, managedByKargo, runIDLabel, dm.RunID())
+	}
+	containers := d.Spec.Template.Spec.Containers
+	if len(containers) != 1 || strings.Join(containers[0].Args, " ") != "--duration=1m" {
+		t.Errorf("Deployment containers = %+v, want loadtest with --duration=1m", containers)
+	}
+
+	var cm ConfigMap
+	err = server.Decode("configmaps", "default", "loadtest-settings", &cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data["rate"] != "10" {
+		t.Errorf("ConfigMap data = %v, want rate=10", cm.Data)
+	}
+	if server.Get("daemonsets", "default", "loadtest-agent") == nil {
+		t.Error("DaemonSet loadtest-agent was not created")
+	}
+	if pods := server.Names("pods", "default", "run=loadtest"); len(pods) != 2 {
+		t.Errorf("pods = %v, want 2", pods)
+	}
+}
+
+func TestCreateUsesLegacyWorkloadGroup(t *testing.T) {
+	dm, server := newTestManager(t)
+	server.ServeGroupVersions("extensions/v1beta1", "batch/v1")
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "POST /apis/extensions/v1beta1/namespaces/default/deployments"
+	for _, request := range server.Requests() {
+		if request == want {
+			return
+		}
+	}
+	t.Errorf("no %q request in %v", want, server.Requests())
+}
+
+func TestCreateFails(t *testing.T) {
+	dm, server := newTestManager(t)
+	server.Fail("POST", "/apis/apps/v1/namespaces/*/deployments", 500, 1)
+
+	err := dm.Create(testConfig(1))
+	if err == nil {
+		t.Fatal("Create succeeded, want an error")
+	}
+	if server.Get("deployments", "default", "loadtest") != nil {
+		t.Error("Deployment was created")
+	}
+}
+
+func TestCreateUpdatesLeftoverObjects(t *testing.T) {
+	dm, server := newTestManager(t)
+	server.Put("configmaps", "default", kargotest.Object{
+		"metadata": kargotest.Object{
+			"name":   "loadtest-settings",
+			"labels": kargotest.Object{managedByLabel: managedByKargo},
+		},
+		"data": kargotest.Object{"rate": "1"},
+	})
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cm ConfigMap
+	server.Decode("configmaps", "default", "loadtest-settings", &cm)
+	if cm.Data["rate"] != "10" {
+		t.Errorf("ConfigMap data = %v, want rate=10", cm.Data)
+	}
+}
+
+func TestCreateRefusesForeignObjects(t *testing.T) {
+	dm, server := newTestManager(t)
+	server.Put("configmaps", "default", kargotest.Object{
+		"metadata": kargotest.Object{"name": "loadtest-settings"},
+		"data":     kargotest.Object{"rate": "1"},
+	})
+
+	err := dm.Create(testConfig(1))
+	if err == nil || !strings.Contains(err.Error(), "not created by kargo") {
+		t.Fatalf("Create error = %v, want one saying the ConfigMap was not created by kargo", err)
+	}
+}
+
+func TestScale(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	config := testConfig(1)
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{3, 2} {
+		err = dm.Scale(config, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dm.WaitReady(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var d Deployment
+		server.Decode("deployments", "default", "loadtest", &d)
+		if d.Spec.Replicas != int64(n) {
+			t.Errorf("Deployment has %d replicas, want %d", d.Spec.Replicas, n)
+		}
+		if pods := server.Names("pods", "default", "run=loadtest"); len(pods) != n {
+			t.Errorf("pods = %v, want %d", pods, n)
+		}
+	}
+}
+
+// TestScaleInNamespace scales workers that --namespace put somewhere other
+// than config.Namespace, as main's config always says default.
+func TestScaleInNamespace(t *testing.T) {
+	dm, server := newTestManager(t)
+	namespace = "load"
+
+	config := testConfig(1)
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.Scale(config, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d Deployment
+	err = server.Decode("deployments", "load", "loadtest", &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Spec.Replicas != 3 {
+		t.Errorf("Deployment in load has %d replicas, want 3", d.Spec.Replicas)
+	}
+	if names := server.Names("deployments", "default", ""); len(names) != 0 {
+		t.Errorf("Deployments in default: %v", names)
+	}
+}
+
+func TestScaleJobInNamespace(t *testing.T) {
+	dm, server := newTestManager(t)
+	namespace = "load"
+
+	config := testConfig(1)
+	config.Job = &JobConfig{Parallelism: 1, Completions: 4}
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.Scale(config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j Job
+	err = server.Decode("jobs", "load", "loadtest", &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Spec.Parallelism == nil || *j.Spec.Parallelism != 2 {
+		t.Errorf("Job in load has parallelism %v, want 2", j.Spec.Parallelism)
+	}
+}
+
+func TestWaitReadyReportsFailingPods(t *testing.T) {
+	dm, server := newTestManager(t)
+	readyTimeout = 500 * time.Millisecond
+	server.SetPodStatus(kargotest.WaitingStatus("ImagePullBackOff", "Back-off pulling image"))
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(1)
+	if err == nil || !strings.Contains(err.Error(), "ImagePullBackOff") {
+		t.Fatalf("WaitReady error = %v, want one naming ImagePullBackOff", err)
+	}
+}
+
+func TestWaitReadyAfterWatchExpires(t *testing.T) {
+	dm, server := newTestManager(t)
+	server.SetPodStatus(kargotest.PendingStatus)
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- dm.WaitReady(1)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	server.ExpireWatches()
+	for _, pod := range server.Names("pods", "default", "run=loadtest") {
+		server.Update("pods", "default", pod, func(obj kargotest.Object) {
+			obj["status"] = kargotest.RunningStatus(obj)
+		})
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitReady did not return after the pod became ready")
+	}
+}
+
+// TestWaitReadyIgnoresOtherRuns leaves a ready pod of an earlier run with the
+// same name, which must not count towards this run's ready pods.
+func TestWaitReadyIgnoresOtherRuns(t *testing.T) {
+	dm, server := newTestManager(t)
+	readyTimeout = 200 * time.Millisecond
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Put("pods", "default", kargotest.Object{
+		"metadata": kargotest.Object{
+			"name":   "loadtest-earlier",
+			"labels": kargotest.Object{"run": "loadtest", runIDLabel: "earlier"},
+		},
+		"spec":   kargotest.Object{"containers": []interface{}{kargotest.Object{"name": "loadtest"}}},
+		"status": kargotest.Object{"phase": "Running", "conditions": []interface{}{kargotest.Object{"type": "Ready", "status": "True"}}},
+	})
+
+	err = dm.WaitReady(2)
+	if err == nil {
+		t.Error("WaitReady counted the pod of an earlier run")
+	}
+	err = dm.WaitReady(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	config := testConfig(2)
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first request for each log fails, and is retried.
+	server.Fail("GET", "/api/v1/namespaces/default/pods/*/log", 500, 2)
+	var out syncBuffer
+	err = dm.Logs(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pods := server.Names("pods", "default", "run=loadtest")
+	for _, pod := range pods {
+		server.AppendLog("default", pod, "loadtest", "first from "+pod)
+	}
+	for _, pod := range pods {
+		line := fmt.Sprintf("[%s] first from %s\n", pod, pod)
+		waitFor(t, 5*time.Second, line, func() bool { return strings.Contains(out.String(), line) })
+	}
+
+	// Pods added by Scale are followed too.
+	err = dm.Scale(config, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pod := range server.Names("pods", "default", "run=loadtest") {
+		server.AppendLog("default", pod, "loadtest", "second from "+pod)
+		line := fmt.Sprintf("[%s] second from %s\n", pod, pod)
+		waitFor(t, 5*time.Second, line, func() bool { return strings.Contains(out.String(), line) })
+	}
+
+	if n := strings.Count(out.String(), "first from"); n != 2 {
+		t.Errorf("got %d first lines, want each written once:\n%s", n, out.String())
+	}
+}
+
+// TestLogsLongLine writes a line longer than maxLogLine, which is cut short
+// rather than breaking the stream.
+func TestLogsLongLine(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out syncBuffer
+	err = dm.Logs(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := server.Names("pods", "default", "run=loadtest")[0]
+	server.AppendLog("default", pod, "loadtest", strings.Repeat("x", 2*maxLogLine), "after the long line")
+	line := fmt.Sprintf("[%s] after the long line\n", pod)
+	waitFor(t, 5*time.Second, line, func() bool { return strings.Contains(out.String(), line) })
+
+	if n := strings.Count(out.String(), " [truncated]\n"); n != 1 {
+		t.Errorf("got %d truncated lines, want 1", n)
+	}
+	if n := strings.Count(out.String(), line); n != 1 {
+		t.Errorf("got the line after the long one %d times, want once", n)
+	}
+}
+
+// TestLogsCutLine drops a log stream in the middle of a line, which is
+// written once, whole, from the next stream.
+func TestLogsCutLine(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out syncBuffer
+	err = dm.Logs(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := server.Names("pods", "default", "run=loadtest")[0]
+	server.CutLog("default", pod, "loadtest")
+	server.AppendLog("default", pod, "loadtest", "before the cut", "across the cut")
+	line := fmt.Sprintf("[%s] across the cut\n", pod)
+	waitFor(t, 5*time.Second, line, func() bool { return strings.Contains(out.String(), line) })
+
+	want := fmt.Sprintf("[%s] before the cut\n[%s] across the cut\n", pod, pod)
+	if got := out.String(); got != want {
+		t.Errorf("got log\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	err := dm.Create(testConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resource := range []string{"deployments", "replicasets", "daemonsets", "configmaps", "pods"} {
+		if names := server.Names(resource, "default", ""); len(names) != 0 {
+			t.Errorf("%s left after Delete: %v", resource, names)
+		}
+	}
+}
+
+func TestJobWait(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	config := testConfig(2)
+	config.Job = &JobConfig{Parallelism: 2, Completions: 2}
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pods := server.Names("pods", "default", "run=loadtest")
+	server.FinishPod("default", pods[0], 0)
+	server.FinishPod("default", pods[1], 0)
+	result, err := dm.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete || result.Succeeded != 2 || len(result.Pods) != 2 {
+		t.Errorf("Wait = %+v, want a complete Job with 2 succeeded pods", result)
+	}
+}
+
+// TestDiagnostics checks that only the Warning events of the run's own
+// objects are reported, not those of an earlier run with the same name, and
+// that a pod's problems are dropped once it is deleted.
+func TestDiagnostics(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	err := dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Put("pods", "default", kargotest.Object{
+		"metadata": kargotest.Object{"name": "loadtest-earlier", "labels": kargotest.Object{"run": "loadtest", runIDLabel: "earlier"}},
+	})
+	pod := server.Names("pods", "default", "run=loadtest,"+runIDLabel+"!=earlier")[0]
+
+	server.AddEvent("default", "Deployment", "loadtest", "Normal", "ScalingReplicaSet", "scaled up")
+	server.AddEvent("default", "Deployment", "unrelated", "Warning", "FailedCreate", "quota exceeded")
+	server.AddEvent("default", "Pod", "loadtest-earlier", "Warning", "BackOff", "back-off restarting")
+	server.AddEvent("default", "Deployment", "loadtest", "Warning", "FailedCreate", "quota exceeded")
+	server.AddEvent("default", "Pod", pod, "Warning", "Unhealthy", "readiness probe failed")
+
+	waitFor(t, 5*time.Second, "the warnings", func() bool {
+		diagnostics, _ := dm.Diagnostics()
+		return len(diagnostics) >= 2
+	})
+	time.Sleep(100 * time.Millisecond)
+	diagnostics, _ := dm.Diagnostics()
+	objects := make([]string, 0)
+	for _, diagnostic := range diagnostics {
+		objects = append(objects, diagnostic.Object+" "+diagnostic.Reason)
+	}
+	want := []string{"Deployment loadtest FailedCreate", "Pod " + pod + " Unhealthy"}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("Diagnostics are %q, want only %q", objects, want)
+	}
+
+	server.Delete("pods", "default", pod)
+	waitFor(t, 5*time.Second, "the deleted pod's warning to be dropped", func() bool {
+		diagnostics, _ := dm.Diagnostics()
+		return len(diagnostics) == 1
+	})
+}
+
+// TestDryRunOffline renders manifests with no API server configured, as a
+// --dry-run without --server-dry-run needs none.
+func TestDryRunOffline(t *testing.T) {
+	saveFlags(t)
+	dir, err := ioutil.TempDir("", "kargo-dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	apiHost = ""
+	kubeconfigPath = filepath.Join(dir, "missing-kubeconfig")
+	outputPath = filepath.Join(dir, "manifests")
+	DryRun = true
+
+	dm, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arches, labelled, err := dm.Architectures(nil); err != nil || labelled || len(arches) != 1 || arches[0] != defaultArch {
+		t.Errorf("dry run architectures are %v, labelled %t, %v, want %s unlabelled", arches, labelled, err, defaultArch)
+	}
+	err = dm.Create(testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(outputPath, "02-deployment-loadtest.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "apiVersion: apps/v1") {
+		t.Errorf("the Deployment is not apps/v1:\n%s", data)
+	}
+
+	serverDryRun = true
+	_, err = New()
+	if err == nil {
+		t.Error("--server-dry-run without an API server has no error")
+	}
+}
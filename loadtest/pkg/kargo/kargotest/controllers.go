@@ -0,0 +1,560 @@
+package kargotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reconcile runs the controller for the object under key, if it has one, as
+// the cluster would after the object changed. s.mu must be held.
+func (s *Server) reconcile(key objectKey) {
+	switch key.resource {
+	case "deployments":
+		s.reconcileDeployment(key)
+	case "replicasets":
+		s.reconcileReplicaSet(key)
+	case "daemonsets":
+		s.reconcileDaemonSet(key)
+	case "jobs":
+		s.reconcileJob(key)
+	case "pods":
+		// A pod that finished or went away changes its owner's status.
+		if owner, ok := s.owner(key); ok {
+			s.reconcile(owner)
+		}
+	}
+}
+
+// owner returns the key of the controller of the object under key.
+func (s *Server) owner(key objectKey) (objectKey, bool) {
+	obj, ok := s.objects[key]
+	if !ok {
+		return objectKey{}, false
+	}
+	refs, _ := metadata(obj)["ownerReferences"].([]interface{})
+	for _, ref := range refs {
+		r, ok := ref.(Object)
+		if !ok {
+			continue
+		}
+		resource := strings.ToLower(stringField(r, "kind")) + "s"
+		return objectKey{resource, key.namespace, stringField(r, "name")}, true
+	}
+	return objectKey{}, false
+}
+
+func ownerReference(obj Object) Object {
+	return Object{
+		"apiVersion": stringField(obj, "apiVersion"),
+		"kind":       stringField(obj, "kind"),
+		"name":       stringField(obj, "metadata", "name"),
+		"uid":        stringField(obj, "metadata", "uid"),
+		"controller": true,
+	}
+}
+
+// replicas returns spec.replicas, which defaults to 1 when it is not set.
+func replicas(obj Object, field string) int {
+	spec, _ := obj["spec"].(Object)
+	if _, ok := spec[field]; !ok {
+		return 1
+	}
+	return intField(obj, "spec", field)
+}
+
+// setStatus replaces the status of the object under key if it changed.
+func (s *Server) setStatus(key objectKey, status Object) {
+	obj := s.objects[key]
+	old, _ := json.Marshal(obj["status"])
+	updated, _ := json.Marshal(status)
+	if string(old) == string(updated) {
+		return
+	}
+	obj = copyObject(obj)
+	obj["status"] = status
+	s.put(key, obj, "MODIFIED")
+}
+
+// reconcileDeployment keeps one ReplicaSet for the current pod template of a
+// Deployment, deleting the ReplicaSets of earlier templates with their pods.
+func (s *Server) reconcileDeployment(key objectKey) {
+	d, ok := s.objects[key]
+	if !ok {
+		return
+	}
+	spec, _ := d["spec"].(Object)
+	template, _ := spec["template"].(Object)
+	if template == nil {
+		return
+	}
+
+	h := fnv.New32a()
+	data, _ := json.Marshal(template)
+	h.Write(data)
+	rsKey := objectKey{"replicasets", key.namespace, fmt.Sprintf("%s-%x", key.name, h.Sum32())}
+
+	for _, owned := range s.ownedBy(stringField(d, "metadata", "uid")) {
+		if owned.resource == "replicasets" && owned != rsKey {
+			s.delete(owned, false)
+		}
+	}
+
+	want := replicas(d, "replicas")
+	rs, ok := s.objects[rsKey]
+	if !ok {
+		rs = Object{
+			"apiVersion": "apps/v1",
+			"kind":       "ReplicaSet",
+			"metadata": Object{
+				"labels":          metadata(copyObject(template))["labels"],
+				"ownerReferences": []interface{}{ownerReference(d)},
+			},
+			"spec": Object{
+				"replicas": want,
+				"selector": spec["selector"],
+				"template": template,
+			},
+		}
+		s.put(rsKey, rs, "ADDED")
+	} else if replicas(rs, "replicas") != want {
+		rs = copyObject(rs)
+		rs["spec"].(Object)["replicas"] = want
+		s.put(rsKey, rs, "MODIFIED")
+	}
+	s.reconcileReplicaSet(rsKey)
+}
+
+// reconcileReplicaSet creates or deletes pods until the ReplicaSet has as
+// many as it wants, then updates the status of its Deployment.
+func (s *Server) reconcileReplicaSet(key objectKey) {
+	rs, ok := s.objects[key]
+	if !ok {
+		return
+	}
+	pods := s.ownedBy(stringField(rs, "metadata", "uid"))
+	want := replicas(rs, "replicas")
+	for len(pods) < want {
+		pods = append(pods, s.createPod(rs, "", ""))
+	}
+	for len(pods) > want {
+		s.delete(pods[len(pods)-1], false)
+		pods = pods[:len(pods)-1]
+	}
+
+	ready := s.countReady(pods)
+	s.setStatus(key, Object{"replicas": len(pods), "readyReplicas": ready})
+	if owner, ok := s.owner(key); ok && owner.resource == "deployments" {
+		if _, ok := s.objects[owner]; ok {
+			s.setStatus(owner, Object{
+				"replicas":          len(pods),
+				"updatedReplicas":   len(pods),
+				"readyReplicas":     ready,
+				"availableReplicas": ready,
+			})
+		}
+	}
+}
+
+// reconcileDaemonSet runs one pod on every node.
+func (s *Server) reconcileDaemonSet(key objectKey) {
+	ds, ok := s.objects[key]
+	if !ok {
+		return
+	}
+	onNode := make(map[string]bool)
+	pods := s.ownedBy(stringField(ds, "metadata", "uid"))
+	for _, pod := range pods {
+		onNode[stringField(s.objects[pod], "spec", "nodeName")] = true
+	}
+	for _, node := range s.nodeNames() {
+		if !onNode[node] {
+			pods = append(pods, s.createPod(ds, node, ""))
+		}
+	}
+	s.setStatus(key, Object{
+		"desiredNumberScheduled": len(s.nodeNames()),
+		"currentNumberScheduled": len(pods),
+		"numberReady":            s.countReady(pods),
+	})
+}
+
+// reconcileJob keeps spec.parallelism pods running until spec.completions
+// have succeeded, and fails the Job once more than spec.backoffLimit have
+// failed.
+func (s *Server) reconcileJob(key objectKey) {
+	job, ok := s.objects[key]
+	if !ok {
+		return
+	}
+	parallelism := replicas(job, "parallelism")
+	completions := replicas(job, "completions")
+	backoffLimit := 6
+	if spec, _ := job["spec"].(Object); spec["backoffLimit"] != nil {
+		backoffLimit = intField(job, "spec", "backoffLimit")
+	}
+
+	var active []objectKey
+	succeeded, failed := 0, 0
+	for _, pod := range s.ownedBy(stringField(job, "metadata", "uid")) {
+		switch stringField(s.objects[pod], "status", "phase") {
+		case "Succeeded":
+			succeeded++
+		case "Failed":
+			failed++
+		default:
+			active = append(active, pod)
+		}
+	}
+
+	status := Object{"succeeded": succeeded, "failed": failed}
+	var condition Object
+	switch {
+	case succeeded >= completions:
+		condition = Object{"type": "Complete", "status": "True"}
+	case failed > backoffLimit:
+		condition = Object{"type": "Failed", "status": "True", "reason": "BackoffLimitExceeded", "message": "Job has reached the specified backoff limit"}
+	}
+	if condition != nil {
+		for _, pod := range active {
+			s.delete(pod, false)
+		}
+		status["conditions"] = []interface{}{condition}
+		s.setStatus(key, status)
+		return
+	}
+
+	want := parallelism
+	if remaining := completions - succeeded; remaining < want {
+		want = remaining
+	}
+	for len(active) < want {
+		active = append(active, s.createPod(job, "", key.name))
+	}
+	for len(active) > want {
+		s.delete(active[len(active)-1], false)
+		active = active[:len(active)-1]
+	}
+	status["active"] = len(active)
+	s.setStatus(key, status)
+}
+
+func (s *Server) countReady(pods []objectKey) int {
+	ready := 0
+	for _, key := range pods {
+		status, _ := s.objects[key]["status"].(Object)
+		conditions, _ := status["conditions"].([]interface{})
+		for _, c := range conditions {
+			condition, _ := c.(Object)
+			if condition["type"] == "Ready" && condition["status"] == "True" {
+				ready++
+			}
+		}
+	}
+	return ready
+}
+
+// createPod creates a pod from the template of owner, scheduled on node or,
+// if node is empty, on the next node that matches its node selector. Pods of
+// a Job are labelled with jobName as a real Job controller does.
+func (s *Server) createPod(owner Object, node, jobName string) objectKey {
+	ownerSpec, _ := owner["spec"].(Object)
+	template, _ := ownerSpec["template"].(Object)
+	template = copyObject(template)
+	meta := metadata(template)
+	spec, _ := template["spec"].(Object)
+	if spec == nil {
+		spec = make(Object)
+	}
+
+	if jobName != "" {
+		l, _ := meta["labels"].(Object)
+		if l == nil {
+			l = make(Object)
+		}
+		l["job-name"] = jobName
+		meta["labels"] = l
+	}
+	if node == "" {
+		node = s.scheduleNode(labels(template, "spec", "nodeSelector"))
+	}
+	if node != "" {
+		spec["nodeName"] = node
+	}
+
+	s.nextPod++
+	name := fmt.Sprintf("%s-%s", stringField(owner, "metadata", "name"), strconv.FormatInt(int64(36*36*36*36+s.nextPod), 36))
+	meta["ownerReferences"] = []interface{}{ownerReference(owner)}
+	pod := Object{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   meta,
+		"spec":       spec,
+	}
+	if node == "" {
+		pod["status"] = Object{
+			"phase": "Pending",
+			"conditions": []interface{}{Object{
+				"type": "PodScheduled", "status": "False", "reason": "Unschedulable",
+				"message": "0/" + strconv.Itoa(len(s.nodeNames())) + " nodes are available: node(s) didn't match node selector.",
+			}},
+		}
+	} else {
+		pod["status"] = s.podStatus(pod)
+	}
+
+	key := objectKey{"pods", stringField(owner, "metadata", "namespace"), name}
+	s.put(key, pod, "ADDED")
+	return key
+}
+
+// scheduleNode picks the node with the fewest pods among those whose labels
+// match nodeSelector, or "" if none do.
+func (s *Server) scheduleNode(nodeSelector map[string]string) string {
+	pods := make(map[string]int)
+	for key, obj := range s.objects {
+		if key.resource == "pods" {
+			pods[stringField(obj, "spec", "nodeName")]++
+		}
+	}
+
+	best := ""
+	for _, name := range s.nodeNames() {
+		node := s.objects[objectKey{"nodes", "", name}]
+		if !matches(nodeSelector, labels(node, "metadata", "labels")) {
+			continue
+		}
+		if best == "" || pods[name] < pods[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+func (s *Server) nodeNames() []string {
+	names := make([]string, 0)
+	for key := range s.objects {
+		if key.resource == "nodes" {
+			names = append(names, key.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddNode adds a node with labels. Nodes are always labelled with their
+// kubernetes.io/hostname, and DaemonSets get a pod on each new node.
+func (s *Server) AddNode(name string, nodeLabels map[string]string) {
+	l := Object{"kubernetes.io/hostname": name}
+	for key, value := range nodeLabels {
+		l[key] = value
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(objectKey{"nodes", "", name}, Object{
+		"apiVersion": "v1",
+		"kind":       "Node",
+		"metadata":   Object{"labels": l},
+	}, "ADDED")
+	for key := range s.objects {
+		if key.resource == "daemonsets" {
+			s.reconcileDaemonSet(key)
+		}
+	}
+}
+
+// SetPodStatus sets the function that gives each new scheduled pod its
+// status, such as RunningStatus, PendingStatus or WaitingStatus.
+func (s *Server) SetPodStatus(status func(pod Object) Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.podStatus = status
+}
+
+// RunningStatus is the status of a pod whose init containers have completed
+// and whose containers are running and ready. It is the default.
+func RunningStatus(pod Object) Object {
+	now := time.Now().UTC().Format(time.RFC3339)
+	initStatuses := make([]interface{}, 0)
+	for _, c := range containers(pod, "initContainers") {
+		initStatuses = append(initStatuses, Object{
+			"name":         c,
+			"ready":        true,
+			"restartCount": 0,
+			"state":        Object{"terminated": Object{"exitCode": 0, "reason": "Completed"}},
+		})
+	}
+	statuses := make([]interface{}, 0)
+	for _, c := range containers(pod, "containers") {
+		statuses = append(statuses, Object{
+			"name":         c,
+			"ready":        true,
+			"restartCount": 0,
+			"state":        Object{"running": Object{"startedAt": now}},
+		})
+	}
+	return Object{
+		"phase":                 "Running",
+		"conditions":            []interface{}{Object{"type": "Ready", "status": "True"}},
+		"initContainerStatuses": initStatuses,
+		"containerStatuses":     statuses,
+	}
+}
+
+// PendingStatus is the status of a pod that is scheduled but whose containers
+// have not been created yet.
+func PendingStatus(pod Object) Object {
+	return Object{
+		"phase":      "Pending",
+		"conditions": []interface{}{Object{"type": "Ready", "status": "False"}},
+	}
+}
+
+// WaitingStatus returns a status function for pods whose containers cannot
+// start, waiting with reason and message, such as ImagePullBackOff.
+func WaitingStatus(reason, message string) func(pod Object) Object {
+	return func(pod Object) Object {
+		statuses := make([]interface{}, 0)
+		for _, c := range containers(pod, "containers") {
+			statuses = append(statuses, Object{
+				"name":         c,
+				"ready":        false,
+				"restartCount": 0,
+				"state":        Object{"waiting": Object{"reason": reason, "message": message}},
+			})
+		}
+		status := PendingStatus(pod)
+		status["containerStatuses"] = statuses
+		return status
+	}
+}
+
+func containers(pod Object, field string) []string {
+	spec, _ := pod["spec"].(Object)
+	list, _ := spec[field].([]interface{})
+	names := make([]string, 0, len(list))
+	for _, c := range list {
+		if container, ok := c.(Object); ok {
+			names = append(names, stringField(container, "name"))
+		}
+	}
+	return names
+}
+
+// FinishPod makes the containers of a pod exit with exitCode, as a Job's pods
+// do when they are done, and reports whether the pod exists.
+func (s *Server) FinishPod(namespace, name string, exitCode int) bool {
+	return s.Update("pods", namespace, name, func(pod Object) {
+		phase, reason := "Succeeded", "Completed"
+		if exitCode != 0 {
+			phase, reason = "Failed", "Error"
+		}
+		statuses := make([]interface{}, 0)
+		for _, c := range containers(pod, "containers") {
+			statuses = append(statuses, Object{
+				"name":         c,
+				"ready":        false,
+				"restartCount": 0,
+				"state":        Object{"terminated": Object{"exitCode": exitCode, "reason": reason}},
+			})
+		}
+		pod["status"] = Object{
+			"phase":             phase,
+			"conditions":        []interface{}{Object{"type": "Ready", "status": "False"}},
+			"containerStatuses": statuses,
+		}
+	})
+}
+
+// AddEvent records an event about the object of kind and name, as the
+// cluster's components do when something goes wrong with it. The event
+// refers to the object by uid too, if it exists.
+func (s *Server) AddEvent(namespace, kind, name, eventType, reason, message string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	involved := Object{"kind": kind, "namespace": namespace, "name": name}
+	for resource, info := range resources {
+		if obj, ok := s.objects[objectKey{resource, namespace, name}]; ok && info.kind == kind {
+			involved["apiVersion"] = obj["apiVersion"]
+			involved["uid"] = stringField(obj, "metadata", "uid")
+		}
+	}
+
+	s.nextUID++
+	s.put(objectKey{"events", namespace, fmt.Sprintf("%s.%d", name, s.nextUID)}, Object{
+		"apiVersion":     "v1",
+		"kind":           "Event",
+		"involvedObject": involved,
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"count":          1,
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+	}, "ADDED")
+}
+
+func (s *Server) getScale(w http.ResponseWriter, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := objectKey{req.resource, req.namespace, req.name}
+	obj, ok := s.objects[key]
+	if !ok || (req.resource != "deployments" && req.resource != "replicasets") {
+		notFound(w, req)
+		return
+	}
+	writeJSON(w, http.StatusOK, scale(obj))
+}
+
+func (s *Server) putScale(w http.ResponseWriter, req request, body Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := objectKey{req.resource, req.namespace, req.name}
+	obj, ok := s.objects[key]
+	if !ok || (req.resource != "deployments" && req.resource != "replicasets") {
+		notFound(w, req)
+		return
+	}
+	version := stringField(body, "metadata", "resourceVersion")
+	if version != "" && version != stringField(obj, "metadata", "resourceVersion") {
+		writeStatus(w, http.StatusConflict, "Conflict", "the object has been modified; please apply your changes to the latest version and try again")
+		return
+	}
+
+	obj = copyObject(obj)
+	spec, _ := obj["spec"].(Object)
+	if spec == nil {
+		spec = make(Object)
+		obj["spec"] = spec
+	}
+	spec["replicas"] = intField(body, "spec", "replicas")
+	s.put(key, obj, "MODIFIED")
+	s.reconcile(key)
+	writeJSON(w, http.StatusOK, scale(s.objects[key]))
+}
+
+func scale(obj Object) Object {
+	meta := metadata(obj)
+	return Object{
+		"apiVersion": "autoscaling/v1",
+		"kind":       "Scale",
+		"metadata": Object{
+			"name":            meta["name"],
+			"namespace":       meta["namespace"],
+			"uid":             meta["uid"],
+			"resourceVersion": meta["resourceVersion"],
+		},
+		"spec":   Object{"replicas": replicas(obj, "replicas")},
+		"status": Object{"replicas": intField(obj, "status", "replicas")},
+	}
+}
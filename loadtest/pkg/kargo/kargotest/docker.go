@@ -0,0 +1,513 @@
+package kargotest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DockerServer is a stub Docker Engine API on a unix socket, with the image
+// and container endpoints kargo's Docker backend uses. Containers run as soon
+// as they are started, until they are stopped or Exit is called, and log what
+// AppendContainerLog gives them.
+type DockerServer struct {
+	dir      string
+	listener net.Listener
+	server   *http.Server
+
+	mu         sync.Mutex
+	images     map[string]bool
+	containers map[string]*DockerContainer
+	nextID     int
+	changed    chan struct{}
+	closed     chan struct{}
+	failures   []*failure
+	requests   []string
+}
+
+// DockerContainer is a container of a DockerServer.
+type DockerContainer struct {
+	ID         string
+	Name       string
+	Image      string
+	Cmd        []string
+	Env        []string
+	Labels     map[string]string
+	HostConfig DockerHostConfig
+
+	Running    bool
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	logs []dockerLogLine
+}
+
+// DockerHostConfig is the part of a container's host configuration the stub
+// keeps.
+type DockerHostConfig struct {
+	Binds             []string
+	NanoCpus          int64
+	CpuShares         int64
+	Memory            int64
+	MemoryReservation int64
+}
+
+type dockerLogLine struct {
+	stream byte
+	text   string
+}
+
+var dockerVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// NewDockerServer starts a stub Docker daemon that already has images. Call
+// Close when done with it.
+func NewDockerServer(images ...string) *DockerServer {
+	dir, err := ioutil.TempDir("", "kargotest")
+	if err != nil {
+		panic(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+
+	s := &DockerServer{
+		dir:        dir,
+		listener:   listener,
+		images:     make(map[string]bool),
+		containers: make(map[string]*DockerContainer),
+		changed:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	for _, image := range images {
+		s.images[image] = true
+	}
+	s.server = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+	go s.server.Serve(listener)
+	return s
+}
+
+// Host is the address to pass to --docker-host.
+func (s *DockerServer) Host() string {
+	return "unix://" + s.listener.Addr().String()
+}
+
+// Close ends open log streams and shuts the server down.
+func (s *DockerServer) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mu.Unlock()
+	s.server.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Fail makes the next times requests with method whose path, without the API
+// version, matches pattern fail with code, as Server.Fail does.
+func (s *DockerServer) Fail(method, pattern string, code, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{method, pattern, code, times})
+}
+
+// Requests returns every request served so far as "METHOD path?query", with
+// the API version left in the path.
+func (s *DockerServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// HasImage reports whether the image has been pulled, or was there from the
+// start.
+func (s *DockerServer) HasImage(image string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.images[image]
+}
+
+// Containers returns copies of the containers that have not been removed,
+// ordered by name.
+func (s *DockerServer) Containers() []DockerContainer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	containers := make([]DockerContainer, 0, len(s.containers))
+	for _, c := range s.containers {
+		copied := *c
+		copied.logs = nil
+		containers = append(containers, copied)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+	return containers
+}
+
+// AppendContainerLog logs lines to the stdout of the named container.
+func (s *DockerServer) AppendContainerLog(name string, lines ...string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.lookup(name)
+	if c == nil {
+		return false
+	}
+	for _, line := range lines {
+		c.logs = append(c.logs, dockerLogLine{1, line})
+	}
+	s.notify()
+	return true
+}
+
+// Exit stops the named container with exitCode, as if its process exited.
+func (s *DockerServer) Exit(name string, exitCode int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.lookup(name)
+	if c == nil || !c.Running {
+		return false
+	}
+	s.stop(c, exitCode)
+	return true
+}
+
+func (s *DockerServer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// lookup finds a container by ID or name.
+func (s *DockerServer) lookup(idOrName string) *DockerContainer {
+	if c, ok := s.containers[idOrName]; ok {
+		return c
+	}
+	for _, c := range s.containers {
+		if c.Name == idOrName {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *DockerServer) stop(c *DockerContainer, exitCode int) {
+	c.Running = false
+	c.ExitCode = exitCode
+	c.FinishedAt = time.Now()
+	s.notify()
+}
+
+func (s *DockerServer) injectedFailure(r *http.Request, p string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	for i, f := range s.failures {
+		if f.method != "" && f.method != r.Method {
+			continue
+		}
+		if ok, _ := path.Match(f.pattern, p); !ok {
+			continue
+		}
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f.code
+	}
+	return 0
+}
+
+func (s *DockerServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p := "/" + dockerVersionPrefix.ReplaceAllString(r.URL.Path, "")
+	if code := s.injectedFailure(r, p); code != 0 {
+		writeDockerError(w, code, "injected failure")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	switch {
+	case p == "/_ping":
+		w.Write([]byte("OK"))
+	case p == "/info" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, Object{"Name": "docker-host"})
+	case strings.HasPrefix(p, "/images/") && strings.HasSuffix(p, "/json") && r.Method == http.MethodGet:
+		s.inspectImage(w, strings.TrimSuffix(strings.TrimPrefix(p, "/images/"), "/json"))
+	case p == "/images/create" && r.Method == http.MethodPost:
+		s.pullImage(w, r.URL.Query().Get("fromImage"))
+	case p == "/containers/create" && r.Method == http.MethodPost:
+		s.createContainer(w, r)
+	case p == "/containers/json" && r.Method == http.MethodGet:
+		s.listContainers(w, r)
+	case len(parts) == 2 && parts[0] == "containers" && r.Method == http.MethodDelete:
+		s.removeContainer(w, parts[1], r.URL.Query().Get("force") == "1")
+	case len(parts) == 3 && parts[0] == "containers":
+		s.serveContainer(w, r, parts[1], parts[2])
+	default:
+		writeDockerError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func writeDockerError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, Object{"message": message})
+}
+
+func (s *DockerServer) inspectImage(w http.ResponseWriter, image string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.images[image] {
+		writeDockerError(w, http.StatusNotFound, "No such image: "+image)
+		return
+	}
+	writeJSON(w, http.StatusOK, Object{"Id": "sha256:" + image, "RepoTags": []string{image}})
+}
+
+// pullImage streams progress messages like Docker does.
+func (s *DockerServer) pullImage(w http.ResponseWriter, image string) {
+	s.mu.Lock()
+	s.images[image] = true
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(Object{"status": "Pulling from " + image})
+	encoder.Encode(Object{"status": "Status: Downloaded newer image for " + image})
+}
+
+func (s *DockerServer) createContainer(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Image      string
+		Cmd        []string
+		Env        []string
+		Labels     map[string]string
+		HostConfig DockerHostConfig
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &body)
+	}
+	if err != nil {
+		writeDockerError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := r.URL.Query().Get("name")
+	if !s.images[body.Image] {
+		writeDockerError(w, http.StatusNotFound, "No such image: "+body.Image)
+		return
+	}
+	if name != "" && s.lookup(name) != nil {
+		writeDockerError(w, http.StatusConflict, fmt.Sprintf("Conflict. The container name %q is already in use.", "/"+name))
+		return
+	}
+
+	s.nextID++
+	c := &DockerContainer{
+		ID:         fmt.Sprintf("%064x", s.nextID),
+		Name:       name,
+		Image:      body.Image,
+		Cmd:        body.Cmd,
+		Env:        body.Env,
+		Labels:     body.Labels,
+		HostConfig: body.HostConfig,
+	}
+	if c.Name == "" {
+		c.Name = "container-" + c.ID[len(c.ID)-6:]
+	}
+	s.containers[c.ID] = c
+	s.notify()
+	writeJSON(w, http.StatusCreated, Object{"Id": c.ID, "Warnings": []string{}})
+}
+
+// listContainers supports the label filter.
+func (s *DockerServer) listContainers(w http.ResponseWriter, r *http.Request) {
+	var filters map[string][]string
+	if f := r.URL.Query().Get("filters"); f != "" {
+		err := json.Unmarshal([]byte(f), &filters)
+		if err != nil {
+			writeDockerError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	all := r.URL.Query().Get("all") == "1"
+
+	list := make([]Object, 0)
+	for _, c := range s.Containers() {
+		if !all && !c.Running {
+			continue
+		}
+		matched := true
+		for _, label := range filters["label"] {
+			parts := strings.SplitN(label, "=", 2)
+			value, ok := c.Labels[parts[0]]
+			if !ok || (len(parts) == 2 && value != parts[1]) {
+				matched = false
+			}
+		}
+		if matched {
+			list = append(list, Object{"Id": c.ID, "Names": []string{"/" + c.Name}, "Image": c.Image, "Labels": c.Labels, "State": state(&c)})
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func state(c *DockerContainer) string {
+	switch {
+	case c.Running:
+		return "running"
+	case c.StartedAt.IsZero():
+		return "created"
+	}
+	return "exited"
+}
+
+func (s *DockerServer) removeContainer(w http.ResponseWriter, idOrName string, force bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.lookup(idOrName)
+	if c == nil {
+		writeDockerError(w, http.StatusNotFound, "No such container: "+idOrName)
+		return
+	}
+	if c.Running && !force {
+		writeDockerError(w, http.StatusConflict, "You cannot remove a running container "+c.ID+". Stop the container before attempting removal or force remove")
+		return
+	}
+	delete(s.containers, c.ID)
+	s.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *DockerServer) serveContainer(w http.ResponseWriter, r *http.Request, idOrName, action string) {
+	if action == "logs" && r.Method == http.MethodGet {
+		s.serveContainerLogs(w, r, idOrName)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.lookup(idOrName)
+	if c == nil {
+		writeDockerError(w, http.StatusNotFound, "No such container: "+idOrName)
+		return
+	}
+
+	switch {
+	case action == "json" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, Object{
+			"Id":   c.ID,
+			"Name": "/" + c.Name,
+			"State": Object{
+				"Status":     state(c),
+				"Running":    c.Running,
+				"ExitCode":   c.ExitCode,
+				"Error":      "",
+				"StartedAt":  c.StartedAt.UTC().Format(time.RFC3339Nano),
+				"FinishedAt": c.FinishedAt.UTC().Format(time.RFC3339Nano),
+			},
+			"Config":     Object{"Image": c.Image, "Cmd": c.Cmd, "Env": c.Env, "Labels": c.Labels},
+			"HostConfig": c.HostConfig,
+		})
+	case action == "start" && r.Method == http.MethodPost:
+		if c.Running {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		c.Running = true
+		c.StartedAt = time.Now()
+		s.notify()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "stop" && r.Method == http.MethodPost:
+		if !c.Running {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		s.stop(c, 0)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeDockerError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// serveContainerLogs writes the container's log as multiplexed stdout and
+// stderr frames, and with follow=1 keeps writing until the container stops.
+func (s *DockerServer) serveContainerLogs(w http.ResponseWriter, r *http.Request, idOrName string) {
+	query := r.URL.Query()
+	follow := query.Get("follow") == "1" || query.Get("follow") == "true"
+	streams := map[byte]bool{
+		1: query.Get("stdout") == "1" || query.Get("stdout") == "true",
+		2: query.Get("stderr") == "1" || query.Get("stderr") == "true",
+	}
+
+	s.mu.Lock()
+	c := s.lookup(idOrName)
+	s.mu.Unlock()
+	if c == nil {
+		writeDockerError(w, http.StatusNotFound, "No such container: "+idOrName)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	sent := 0
+	for {
+		s.mu.Lock()
+		lines := c.logs[sent:]
+		sent = len(c.logs)
+		_, exists := s.containers[c.ID]
+		running := c.Running
+		changed := s.changed
+		s.mu.Unlock()
+
+		for _, line := range lines {
+			if !streams[line.stream] {
+				continue
+			}
+			frame := make([]byte, 8, 8+len(line.text)+1)
+			frame[0] = line.stream
+			binary.BigEndian.PutUint32(frame[4:], uint32(len(line.text)+1))
+			frame = append(append(frame, line.text...), '\n')
+			w.Write(frame)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if !follow || !exists || !running {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
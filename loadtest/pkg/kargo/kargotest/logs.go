@@ -0,0 +1,144 @@
+package kargotest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type logLine struct {
+	at   time.Time
+	text string
+}
+
+func logKey(namespace, pod, container string) string {
+	return namespace + "/" + pod + "/" + container
+}
+
+// AppendLog adds lines to the log of a container of a pod. Requests that
+// follow the log get them straight away.
+func (s *Server) AppendLog(namespace, pod, container string, lines ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := logKey(namespace, pod, container)
+	for _, line := range lines {
+		s.logs[key] = append(s.logs[key], logLine{time.Now(), line})
+	}
+	s.notify()
+}
+
+// CutLog makes the next followed request for the log of a container of a pod
+// that writes lines end in the middle of the last of them, as a stream that
+// drops does.
+func (s *Server) CutLog(namespace, pod, container string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cutLogs[logKey(namespace, pod, container)] = true
+}
+
+// serveLogs serves the log of one container, honouring the follow,
+// timestamps, sinceTime and tailLines parameters. A followed log is streamed
+// until the pod is deleted.
+func (s *Server) serveLogs(w http.ResponseWriter, r *http.Request, req request) {
+	query := r.URL.Query()
+	podKey := objectKey{"pods", req.namespace, req.name}
+
+	s.mu.Lock()
+	pod, ok := s.objects[podKey]
+	s.mu.Unlock()
+	if !ok || req.resource != "pods" {
+		notFound(w, req)
+		return
+	}
+
+	container := query.Get("container")
+	if container == "" {
+		names := containers(pod, "containers")
+		if len(names) != 1 {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", "a container name must be specified for pod "+req.name)
+			return
+		}
+		container = names[0]
+	}
+
+	var since time.Time
+	if v := query.Get("sinceTime"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", "invalid sinceTime")
+			return
+		}
+		since = t
+	}
+	timestamps := query.Get("timestamps") == "true"
+	follow := query.Get("follow") == "true"
+
+	key := logKey(req.namespace, req.name, container)
+	tail := -1
+	if v := query.Get("tailLines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n >= 0 {
+			tail = n
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	start := 0
+	for {
+		s.mu.Lock()
+		lines := s.logs[key]
+		changed := s.changed
+		_, exists := s.objects[podKey]
+		s.mu.Unlock()
+
+		if tail >= 0 && tail < len(lines) {
+			start = len(lines) - tail
+		}
+		tail = -1
+
+		var b strings.Builder
+		for _, line := range lines[start:] {
+			if line.at.Before(since) {
+				continue
+			}
+			if timestamps {
+				b.WriteString(line.at.UTC().Format(time.RFC3339Nano) + " ")
+			}
+			b.WriteString(line.text + "\n")
+		}
+		start = len(lines)
+
+		out := b.String()
+		s.mu.Lock()
+		cut := follow && out != "" && s.cutLogs[key]
+		if cut {
+			delete(s.cutLogs, key)
+		}
+		s.mu.Unlock()
+		if cut {
+			last := strings.LastIndexByte(out[:len(out)-1], '\n') + 1
+			out = out[:last+(len(out)-last)/2]
+		}
+
+		_, err := w.Write([]byte(out))
+		if err != nil || !follow || !exists || cut {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Package kargotest runs an in-process fake of the parts of the Kubernetes
+// API that kargo uses, so that kargo can be tested without a cluster.
+//
+// The fake keeps every object as generic JSON and serves discovery, create,
+// get, update, delete, list and watch for pods, events, nodes, ConfigMaps,
+// Secrets, Deployments, ReplicaSets, DaemonSets and Jobs, plus the Deployment
+// scale subresource and pod logs. Small controllers stand in for the cluster:
+// Deployments get a ReplicaSet and ReplicaSets, DaemonSets and Jobs get pods,
+// which start Running and Ready unless SetPodStatus says otherwise. Requests
+// can be made to fail with Fail.
+package kargotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultGroupVersions are the API group versions served unless
+// ServeGroupVersions picks others.
+var DefaultGroupVersions = []string{"apps/v1", "batch/v1", "autoscaling/v1"}
+
+// Object is a Kubernetes object as generic JSON.
+type Object = map[string]interface{}
+
+// Server is a fake Kubernetes API server. Point kargo at it with
+// --api-host=Server.Host().
+type Server struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	groupVersions []string
+	objects       map[objectKey]Object
+	history       []watchEvent
+	compacted     int64
+	version       int64
+	changed       chan struct{}
+	closed        chan struct{}
+	failures      []*failure
+	requests      []string
+	podStatus     func(pod Object) Object
+	logs          map[string][]logLine
+	cutLogs       map[string]bool
+	nextUID       int
+	nextPod       int
+}
+
+// NewServer starts a fake API server with a single node, node-1 in zone-a.
+// Call Close when done with it.
+func NewServer() *Server {
+	s := &Server{
+		groupVersions: DefaultGroupVersions,
+		objects:       make(map[objectKey]Object),
+		changed:       make(chan struct{}),
+		closed:        make(chan struct{}),
+		podStatus:     RunningStatus,
+		logs:          make(map[string][]logLine),
+		cutLogs:       make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.AddNode("node-1", map[string]string{"topology.kubernetes.io/zone": "zone-a"})
+	return s
+}
+
+// Close ends open watches and log streams and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mu.Unlock()
+	s.Server.Close()
+}
+
+// Host is the address to pass to --api-host.
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// ServeGroupVersions replaces the API group versions the server serves, such
+// as extensions/v1beta1 to pose as an old cluster. Requests to other group
+// versions get a 404.
+func (s *Server) ServeGroupVersions(groupVersions ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groupVersions = groupVersions
+}
+
+// failure makes requests matching method and pattern fail with code.
+type failure struct {
+	method  string
+	pattern string
+	code    int
+	times   int
+}
+
+// Fail makes the next times requests with method whose path matches pattern,
+// as path.Match does, fail with code. An empty method matches every method,
+// and times of zero or less fails every matching request from now on.
+func (s *Server) Fail(method, pattern string, code, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{method, pattern, code, times})
+}
+
+// Requests returns every request served so far as "METHOD path?query".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// injectedFailure returns the code of the first failure matching r, if any,
+// and uses it up.
+func (s *Server) injectedFailure(r *http.Request) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	for i, f := range s.failures {
+		if f.method != "" && f.method != r.Method {
+			continue
+		}
+		if ok, _ := path.Match(f.pattern, r.URL.Path); !ok {
+			continue
+		}
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f.code
+	}
+	return 0
+}
+
+// request is an API path split into its parts.
+type request struct {
+	groupVersion string
+	namespace    string
+	resource     string
+	name         string
+	subresource  string
+}
+
+// parsePath splits paths such as /api/v1/namespaces/ns/pods/name/log and
+// /apis/apps/v1/deployments.
+func parsePath(p string) (request, bool) {
+	var req request
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		req.groupVersion = parts[1]
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		req.groupVersion = parts[1] + "/" + parts[2]
+		parts = parts[3:]
+	default:
+		return req, false
+	}
+
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		req.namespace = parts[1]
+		parts = parts[2:]
+	}
+	if len(parts) == 0 || len(parts) > 3 {
+		return req, false
+	}
+	req.resource = parts[0]
+	if len(parts) > 1 {
+		req.name = parts[1]
+	}
+	if len(parts) > 2 {
+		req.subresource = parts[2]
+	}
+	return req, true
+}
+
+func (s *Server) serves(groupVersion string) bool {
+	if groupVersion == "v1" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, gv := range s.groupVersions {
+		if gv == groupVersion {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if code := s.injectedFailure(r); code != 0 {
+		writeStatus(w, code, "InternalError", "injected failure")
+		return
+	}
+
+	if r.URL.Path == "/apis" && r.Method == http.MethodGet {
+		s.serveGroups(w)
+		return
+	}
+
+	req, ok := parsePath(r.URL.Path)
+	if !ok || !s.serves(req.groupVersion) || !knownResource(req) {
+		writeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+
+	var body Object
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		data, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(data, &body)
+		}
+		if err != nil {
+			writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	switch {
+	case req.subresource == "log" && r.Method == http.MethodGet:
+		s.serveLogs(w, r, req)
+	case req.subresource == "scale" && r.Method == http.MethodGet:
+		s.getScale(w, req)
+	case req.subresource == "scale" && r.Method == http.MethodPut:
+		s.putScale(w, req, body)
+	case req.subresource != "":
+		writeStatus(w, http.StatusNotFound, "NotFound", "unknown subresource "+req.subresource)
+	case req.name == "" && r.Method == http.MethodGet && query.Get("watch") == "true":
+		s.watch(w, r, req, query)
+	case req.name == "" && r.Method == http.MethodGet:
+		s.list(w, req, query)
+	case req.name == "" && r.Method == http.MethodPost:
+		s.create(w, req, body, query.Get("dryRun") == "All")
+	case r.Method == http.MethodGet:
+		s.get(w, req)
+	case r.Method == http.MethodPut:
+		s.update(w, req, body)
+	case r.Method == http.MethodDelete:
+		s.remove(w, req, query.Get("propagationPolicy"))
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not supported")
+	}
+}
+
+func (s *Server) serveGroups(w http.ResponseWriter) {
+	s.mu.Lock()
+	groupVersions := s.groupVersions
+	s.mu.Unlock()
+
+	groups := make([]Object, 0)
+	byName := make(map[string]Object)
+	for _, gv := range groupVersions {
+		parts := strings.SplitN(gv, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		version := Object{"groupVersion": gv, "version": parts[1]}
+		group, ok := byName[parts[0]]
+		if !ok {
+			group = Object{"name": parts[0], "versions": []interface{}{}, "preferredVersion": version}
+			byName[parts[0]] = group
+			groups = append(groups, group)
+		}
+		group["versions"] = append(group["versions"].([]interface{}), version)
+	}
+	writeJSON(w, http.StatusOK, Object{"kind": "APIGroupList", "apiVersion": "v1", "groups": groups})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	status := "Failure"
+	if code < 300 {
+		status = "Success"
+	}
+	writeJSON(w, code, Object{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"status":     status,
+		"reason":     reason,
+		"message":    message,
+		"code":       code,
+	})
+}
+
+func notFound(w http.ResponseWriter, req request) {
+	writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s %q not found", req.resource, req.name))
+}
@@ -0,0 +1,657 @@
+package kargotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resourceInfo describes a resource the server knows.
+type resourceInfo struct {
+	kind          string
+	namespaced    bool
+	groupVersions []string
+}
+
+var workloadGroupVersions = []string{"apps/v1", "apps/v1beta2", "extensions/v1beta1"}
+
+var resources = map[string]resourceInfo{
+	"pods":        {"Pod", true, []string{"v1"}},
+	"events":      {"Event", true, []string{"v1"}},
+	"configmaps":  {"ConfigMap", true, []string{"v1"}},
+	"secrets":     {"Secret", true, []string{"v1"}},
+	"nodes":       {"Node", false, []string{"v1"}},
+	"deployments": {"Deployment", true, workloadGroupVersions},
+	"replicasets": {"ReplicaSet", true, workloadGroupVersions},
+	"daemonsets":  {"DaemonSet", true, workloadGroupVersions},
+	"jobs":        {"Job", true, []string{"batch/v1"}},
+}
+
+func knownResource(req request) bool {
+	info, ok := resources[req.resource]
+	if !ok {
+		return false
+	}
+	if info.namespaced && req.namespace == "" && req.name != "" {
+		return false
+	}
+	if !info.namespaced && req.namespace != "" {
+		return false
+	}
+	for _, gv := range info.groupVersions {
+		if gv == req.groupVersion {
+			return true
+		}
+	}
+	return false
+}
+
+type objectKey struct {
+	resource  string
+	namespace string
+	name      string
+}
+
+type watchEvent struct {
+	version  int64
+	resource string
+	typ      string
+	object   Object
+}
+
+func metadata(obj Object) Object {
+	m, ok := obj["metadata"].(Object)
+	if !ok {
+		m = make(Object)
+		obj["metadata"] = m
+	}
+	return m
+}
+
+func stringField(obj Object, keys ...string) string {
+	var v interface{} = obj
+	for _, key := range keys {
+		m, ok := v.(Object)
+		if !ok {
+			return ""
+		}
+		v = m[key]
+	}
+	s, _ := v.(string)
+	return s
+}
+
+func intField(obj Object, keys ...string) int {
+	var v interface{} = obj
+	for _, key := range keys {
+		m, ok := v.(Object)
+		if !ok {
+			return 0
+		}
+		v = m[key]
+	}
+	n, _ := v.(float64)
+	return int(n)
+}
+
+func labels(obj Object, keys ...string) map[string]string {
+	var v interface{} = obj
+	for _, key := range keys {
+		m, ok := v.(Object)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	m, _ := v.(Object)
+	result := make(map[string]string, len(m))
+	for key, value := range m {
+		result[key], _ = value.(string)
+	}
+	return result
+}
+
+// copyObject returns a deep copy of obj, with numbers as float64 the way
+// encoding/json decodes them.
+func copyObject(obj Object) Object {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	var copied Object
+	err = json.Unmarshal(data, &copied)
+	if err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+// put stores obj under key and records the change for watches. s.mu must be
+// held.
+func (s *Server) put(key objectKey, obj Object, eventType string) Object {
+	obj = copyObject(obj)
+	meta := metadata(obj)
+	meta["name"] = key.name
+	if key.namespace != "" {
+		meta["namespace"] = key.namespace
+	}
+	if existing, ok := s.objects[key]; ok {
+		meta["uid"] = stringField(existing, "metadata", "uid")
+		meta["creationTimestamp"] = stringField(existing, "metadata", "creationTimestamp")
+	} else {
+		s.nextUID++
+		meta["uid"] = fmt.Sprintf("uid-%d", s.nextUID)
+		if _, ok := meta["creationTimestamp"]; !ok {
+			meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+	if _, ok := obj["kind"]; !ok {
+		obj["kind"] = resources[key.resource].kind
+	}
+
+	s.version++
+	meta["resourceVersion"] = strconv.FormatInt(s.version, 10)
+	s.objects[key] = obj
+	s.record(key.resource, eventType, obj)
+	return obj
+}
+
+// delete removes the object under key and, unless orphan is set, every
+// object it owns. s.mu must be held.
+func (s *Server) delete(key objectKey, orphan bool) {
+	obj, ok := s.objects[key]
+	if !ok {
+		return
+	}
+	delete(s.objects, key)
+	s.version++
+	obj = copyObject(obj)
+	metadata(obj)["resourceVersion"] = strconv.FormatInt(s.version, 10)
+	s.record(key.resource, "DELETED", obj)
+
+	if orphan {
+		return
+	}
+	for _, dependent := range s.ownedBy(stringField(obj, "metadata", "uid")) {
+		s.delete(dependent, false)
+	}
+}
+
+func (s *Server) record(resource, eventType string, obj Object) {
+	s.history = append(s.history, watchEvent{s.version, resource, eventType, copyObject(obj)})
+	s.notify()
+}
+
+// notify wakes up watches and log streams. s.mu must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// ownedBy returns the keys of the objects owned by uid, sorted by name.
+func (s *Server) ownedBy(uid string) []objectKey {
+	keys := make([]objectKey, 0)
+	for key, obj := range s.objects {
+		refs, _ := metadata(obj)["ownerReferences"].([]interface{})
+		for _, ref := range refs {
+			if r, ok := ref.(Object); ok && r["uid"] == uid {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+func (s *Server) create(w http.ResponseWriter, req request, body Object, dryRun bool) {
+	meta := metadata(body)
+	name, _ := meta["name"].(string)
+	if name == "" {
+		if prefix, _ := meta["generateName"].(string); prefix != "" {
+			s.mu.Lock()
+			s.nextUID++
+			name = fmt.Sprintf("%s%05d", prefix, s.nextUID)
+			s.mu.Unlock()
+		}
+	}
+	if name == "" {
+		writeStatus(w, http.StatusUnprocessableEntity, "Invalid", "metadata.name: Required value")
+		return
+	}
+	if namespace, _ := meta["namespace"].(string); namespace != "" && namespace != req.namespace {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", "the namespace of the object does not match the namespace of the request")
+		return
+	}
+	if message := validate(req.resource, body); message != "" {
+		writeStatus(w, http.StatusUnprocessableEntity, "Invalid", message)
+		return
+	}
+
+	key := objectKey{req.resource, req.namespace, name}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[key]; ok {
+		writeStatus(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("%s %q already exists", req.resource, name))
+		return
+	}
+	if dryRun {
+		writeJSON(w, http.StatusCreated, body)
+		return
+	}
+	obj := s.put(key, body, "ADDED")
+	s.reconcile(key)
+	writeJSON(w, http.StatusCreated, obj)
+}
+
+// validate returns why obj would be rejected by a real API server, for the
+// mistakes that are easy to make with hand-written objects.
+func validate(resource string, obj Object) string {
+	switch resource {
+	case "deployments", "replicasets", "daemonsets":
+		selector := labels(obj, "spec", "selector", "matchLabels")
+		if len(selector) == 0 {
+			return "spec.selector: Required value"
+		}
+		if !matches(selector, labels(obj, "spec", "template", "metadata", "labels")) {
+			return "spec.template.metadata.labels: Invalid value: `selector` does not match template `labels`"
+		}
+	}
+	return ""
+}
+
+func (s *Server) get(w http.ResponseWriter, req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[objectKey{req.resource, req.namespace, req.name}]
+	if !ok {
+		notFound(w, req)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *Server) update(w http.ResponseWriter, req request, body Object) {
+	key := objectKey{req.resource, req.namespace, req.name}
+	if message := validate(req.resource, body); message != "" {
+		writeStatus(w, http.StatusUnprocessableEntity, "Invalid", message)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.objects[key]
+	if !ok {
+		notFound(w, req)
+		return
+	}
+	version := stringField(body, "metadata", "resourceVersion")
+	if version != "" && version != stringField(existing, "metadata", "resourceVersion") {
+		writeStatus(w, http.StatusConflict, "Conflict", "the object has been modified; please apply your changes to the latest version and try again")
+		return
+	}
+	if status, ok := existing["status"]; ok {
+		// Like the real API server, status is only changed by the
+		// controllers.
+		body["status"] = status
+	}
+	obj := s.put(key, body, "MODIFIED")
+	s.reconcile(key)
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *Server) remove(w http.ResponseWriter, req request, propagationPolicy string) {
+	key := objectKey{req.resource, req.namespace, req.name}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[key]; !ok {
+		notFound(w, req)
+		return
+	}
+	owner, owned := s.owner(key)
+	s.delete(key, propagationPolicy == "Orphan")
+	if owned {
+		s.reconcile(owner)
+	}
+	writeStatus(w, http.StatusOK, "", "")
+}
+
+// selector is a parsed equality based label selector.
+type selector []func(map[string]string) bool
+
+func parseSelector(s string) (selector, error) {
+	sel := make(selector, 0)
+	if s == "" {
+		return sel, nil
+	}
+	for _, requirement := range strings.Split(s, ",") {
+		requirement = strings.TrimSpace(requirement)
+		switch {
+		case strings.Contains(requirement, "!="):
+			kv := strings.SplitN(requirement, "!=", 2)
+			sel = append(sel, func(l map[string]string) bool { return l[kv[0]] != kv[1] })
+		case strings.Contains(requirement, "=="):
+			kv := strings.SplitN(requirement, "==", 2)
+			sel = append(sel, func(l map[string]string) bool { v, ok := l[kv[0]]; return ok && v == kv[1] })
+		case strings.Contains(requirement, "="):
+			kv := strings.SplitN(requirement, "=", 2)
+			sel = append(sel, func(l map[string]string) bool { v, ok := l[kv[0]]; return ok && v == kv[1] })
+		case strings.HasPrefix(requirement, "!"):
+			key := requirement[1:]
+			sel = append(sel, func(l map[string]string) bool { _, ok := l[key]; return !ok })
+		case requirement != "":
+			key := requirement
+			sel = append(sel, func(l map[string]string) bool { _, ok := l[key]; return ok })
+		default:
+			return nil, fmt.Errorf("invalid label selector %q", s)
+		}
+	}
+	return sel, nil
+}
+
+func (sel selector) matches(obj Object) bool {
+	l := labels(obj, "metadata", "labels")
+	for _, requirement := range sel {
+		if !requirement(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldSelector is a parsed equality based field selector, such as
+// type=Warning. Fields are compared as strings.
+type fieldSelector []func(Object) bool
+
+func parseFieldSelector(s string) (fieldSelector, error) {
+	sel := make(fieldSelector, 0)
+	if s == "" {
+		return sel, nil
+	}
+	for _, requirement := range strings.Split(s, ",") {
+		requirement = strings.TrimSpace(requirement)
+		equal := !strings.Contains(requirement, "!=")
+		kv := strings.SplitN(strings.Replace(strings.Replace(requirement, "!=", "=", 1), "==", "=", 1), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid field selector %q", s)
+		}
+		path, value := strings.Split(kv[0], "."), kv[1]
+		sel = append(sel, func(obj Object) bool { return (stringField(obj, path...) == value) == equal })
+	}
+	return sel, nil
+}
+
+func (sel fieldSelector) matches(obj Object) bool {
+	for _, requirement := range sel {
+		if !requirement(obj) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether every label in selector is set in l.
+func matches(selector, l map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := l[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) list(w http.ResponseWriter, req request, query url.Values) {
+	sel, err := parseSelector(query.Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	fields, err := parseFieldSelector(query.Get("fieldSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]Object, 0)
+	for _, obj := range s.find(req.resource, req.namespace, sel) {
+		if fields.matches(obj) {
+			items = append(items, obj)
+		}
+	}
+	writeJSON(w, http.StatusOK, Object{
+		"apiVersion": req.groupVersion,
+		"kind":       resources[req.resource].kind + "List",
+		"metadata":   Object{"resourceVersion": strconv.FormatInt(s.version, 10)},
+		"items":      items,
+	})
+}
+
+// find returns the objects of resource in namespace, or in every namespace if
+// it is empty, that match sel, sorted by namespace and name. s.mu must be
+// held.
+func (s *Server) find(resource, namespace string, sel selector) []Object {
+	keys := make([]objectKey, 0)
+	for key, obj := range s.objects {
+		if key.resource != resource || (namespace != "" && key.namespace != namespace) {
+			continue
+		}
+		if sel.matches(obj) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	items := make([]Object, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, s.objects[key])
+	}
+	return items
+}
+
+// watch streams the changes to the objects matched by the request after the
+// resourceVersion in the query, until the client goes away or the server is
+// closed. A resourceVersion older than ExpireWatches allows gets a 410 Gone
+// error event, as from a real server after compaction.
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, req request, query url.Values) {
+	sel, err := parseSelector(query.Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	fields, err := parseFieldSelector(query.Get("fieldSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	since := s.version
+	if v := query.Get("resourceVersion"); v != "" {
+		since, err = strconv.ParseInt(v, 10, 64)
+	}
+	expired := since < s.compacted
+	s.mu.Unlock()
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", "invalid resourceVersion")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	if expired {
+		encoder.Encode(Object{"type": "ERROR", "object": Object{
+			"kind": "Status", "apiVersion": "v1", "status": "Failure",
+			"reason": "Expired", "message": "too old resource version", "code": http.StatusGone,
+		}})
+		return
+	}
+
+	for {
+		s.mu.Lock()
+		events := make([]watchEvent, 0)
+		for _, event := range s.history {
+			if event.version <= since || event.resource != req.resource {
+				continue
+			}
+			if req.namespace != "" && stringField(event.object, "metadata", "namespace") != req.namespace {
+				continue
+			}
+			if sel.matches(event.object) && fields.matches(event.object) {
+				events = append(events, event)
+			}
+		}
+		since = s.version
+		changed := s.changed
+		s.mu.Unlock()
+
+		for _, event := range events {
+			err := encoder.Encode(Object{"type": event.typ, "object": event.object})
+			if err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// ExpireWatches makes watches from any resource version seen so far fail with
+// 410 Gone, so that clients have to list again.
+func (s *Server) ExpireWatches() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compacted = s.version + 1
+	s.notify()
+}
+
+// Get returns a copy of an object, or nil if it does not exist. The resource
+// is its plural lower case name, such as "deployments", and namespace is
+// empty for nodes.
+func (s *Server) Get(resource, namespace, name string) Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[objectKey{resource, namespace, name}]
+	if !ok {
+		return nil
+	}
+	return copyObject(obj)
+}
+
+// Decode decodes an object into v, which is typically one of kargo's types.
+func (s *Server) Decode(resource, namespace, name string, v interface{}) error {
+	obj := s.Get(resource, namespace, name)
+	if obj == nil {
+		return fmt.Errorf("%s %s/%s not found", resource, namespace, name)
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// List returns copies of the objects of resource in namespace, or in every
+// namespace if it is empty, that match labelSelector.
+func (s *Server) List(resource, namespace, labelSelector string) []Object {
+	sel, err := parseSelector(labelSelector)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]Object, 0)
+	for _, obj := range s.find(resource, namespace, sel) {
+		items = append(items, copyObject(obj))
+	}
+	return items
+}
+
+// Names returns the names of the objects List returns.
+func (s *Server) Names(resource, namespace, labelSelector string) []string {
+	names := make([]string, 0)
+	for _, obj := range s.List(resource, namespace, labelSelector) {
+		names = append(names, stringField(obj, "metadata", "name"))
+	}
+	return names
+}
+
+// Put creates or replaces an object directly, as another client of the
+// cluster would, and runs the controllers for it. A new object keeps the
+// creationTimestamp it is given, so tests can add old objects.
+func (s *Server) Put(resource, namespace string, obj Object) Object {
+	key := objectKey{resource, namespace, stringField(obj, "metadata", "name")}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eventType := "ADDED"
+	if _, ok := s.objects[key]; ok {
+		eventType = "MODIFIED"
+	}
+	obj = s.put(key, obj, eventType)
+	s.reconcile(key)
+	return copyObject(obj)
+}
+
+// Update changes an existing object in place with update, as its controller
+// or the kubelet would, and reports whether it exists.
+func (s *Server) Update(resource, namespace, name string, update func(obj Object)) bool {
+	key := objectKey{resource, namespace, name}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return false
+	}
+	obj = copyObject(obj)
+	update(obj)
+	s.put(key, obj, "MODIFIED")
+	s.reconcile(key)
+	return true
+}
+
+// Delete removes an object and everything it owns. The controller of a
+// deleted pod replaces it if it still wants it.
+func (s *Server) Delete(resource, namespace, name string) {
+	key := objectKey{resource, namespace, name}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owner, owned := s.owner(key)
+	s.delete(key, false)
+	if owned {
+		s.reconcile(owner)
+	}
+}
@@ -0,0 +1,378 @@
+package kargo
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const execInfoEnv = "KUBERNETES_EXEC_INFO"
+
+var gcpScopes = []string{
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/userinfo.email",
+}
+
+type kubeconfig struct {
+	CurrentContext string         `json:"current-context"`
+	Clusters       []namedCluster `json:"clusters"`
+	Contexts       []namedContext `json:"contexts"`
+	Users          []namedUser    `json:"users"`
+}
+
+type namedCluster struct {
+	Name    string  `json:"name"`
+	Cluster cluster `json:"cluster"`
+}
+
+type cluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthority     string `json:"certificate-authority"`
+	CertificateAuthorityData string `json:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+}
+
+type namedContext struct {
+	Name    string      `json:"name"`
+	Context kubeContext `json:"context"`
+}
+
+type kubeContext struct {
+	Cluster   string `json:"cluster"`
+	User      string `json:"user"`
+	Namespace string `json:"namespace"`
+}
+
+type namedUser struct {
+	Name string   `json:"name"`
+	User authInfo `json:"user"`
+}
+
+type authInfo struct {
+	Token                 string        `json:"token"`
+	TokenFile             string        `json:"tokenFile"`
+	ClientCertificate     string        `json:"client-certificate"`
+	ClientCertificateData string        `json:"client-certificate-data"`
+	ClientKey             string        `json:"client-key"`
+	ClientKeyData         string        `json:"client-key-data"`
+	Exec                  *execConfig   `json:"exec"`
+	AuthProvider          *authProvider `json:"auth-provider"`
+}
+
+type execConfig struct {
+	Command    string       `json:"command"`
+	Args       []string     `json:"args"`
+	Env        []execEnvVar `json:"env"`
+	APIVersion string       `json:"apiVersion"`
+}
+
+type execEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type authProvider struct {
+	Name string `json:"name"`
+}
+
+// kubeconfigFile records which file an entry came from so relative paths in
+// it can be resolved.
+type kubeconfigFile struct {
+	path   string
+	config kubeconfig
+}
+
+// kubeconfigPaths returns the files to load, in the same order of precedence
+// kubectl uses: --kubeconfig, then $KUBECONFIG, then ~/.kube/config.
+func kubeconfigPaths() []string {
+	if kubeconfigPath != "" {
+		return []string{kubeconfigPath}
+	}
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)
+	}
+	return []string{filepath.Join(os.Getenv("HOME"), ".kube", "config")}
+}
+
+func loadKubeconfigs(paths []string) ([]kubeconfigFile, error) {
+	files := make([]kubeconfigFile, 0)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && len(paths) > 1 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var config kubeconfig
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+		files = append(files, kubeconfigFile{path: path, config: config})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no kubeconfig found in %v", paths)
+	}
+	return files, nil
+}
+
+// newKubeconfigClient connects to the cluster of the named context, or of the
+// current context when contextName is empty. When several files are given the
+// first definition of each name wins, as with kubectl.
+func newKubeconfigClient(paths []string, contextName string) (*apiClient, error) {
+	files, err := loadKubeconfigs(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if contextName == "" {
+		for _, f := range files {
+			if f.config.CurrentContext != "" {
+				contextName = f.config.CurrentContext
+				break
+			}
+		}
+	}
+	if contextName == "" {
+		return nil, fmt.Errorf("no current context set in %v", paths)
+	}
+
+	var kctx *kubeContext
+	for _, f := range files {
+		for i := range f.config.Contexts {
+			if kctx == nil && f.config.Contexts[i].Name == contextName {
+				kctx = &f.config.Contexts[i].Context
+			}
+		}
+	}
+	if kctx == nil {
+		return nil, fmt.Errorf("context %q not found in %v", contextName, paths)
+	}
+
+	var c *cluster
+	var clusterFile string
+	var user *authInfo
+	var userFile string
+	for _, f := range files {
+		for i := range f.config.Clusters {
+			if c == nil && f.config.Clusters[i].Name == kctx.Cluster {
+				c, clusterFile = &f.config.Clusters[i].Cluster, f.path
+			}
+		}
+		for i := range f.config.Users {
+			if user == nil && f.config.Users[i].Name == kctx.User {
+				user, userFile = &f.config.Users[i].User, f.path
+			}
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("cluster %q not found in %v", kctx.Cluster, paths)
+	}
+	if user == nil {
+		user, userFile = &authInfo{}, ""
+	}
+
+	server, err := url.Parse(c.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := fileOrData(clusterFile, c.CertificateAuthority, c.CertificateAuthorityData)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(ca, c.InsecureSkipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := configureUser(userFile, user, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiClient{
+		server:     server,
+		httpClient: newHTTPClient(tlsConfig, tokens),
+		namespace:  kctx.Namespace,
+	}, nil
+}
+
+// configureUser sets up client certificates on tlsConfig and returns the
+// source of bearer tokens for the user, if it has one.
+func configureUser(configFile string, user *authInfo, tlsConfig *tls.Config) (oauth2.TokenSource, error) {
+	cert, err := fileOrData(configFile, user.ClientCertificate, user.ClientCertificateData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := fileOrData(configFile, user.ClientKey, user.ClientKeyData)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert) > 0 || len(key) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	switch {
+	case user.Token != "":
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: user.Token}), nil
+	case user.TokenFile != "":
+		source := &tokenFileSource{path: resolvePath(configFile, user.TokenFile)}
+		return oauth2.ReuseTokenSource(nil, source), nil
+	case user.Exec != nil:
+		source := &execCredentialSource{config: *user.Exec, dir: filepath.Dir(configFile)}
+		tlsConfig.GetClientCertificate = source.clientCertificate
+		return source, nil
+	case user.AuthProvider != nil && user.AuthProvider.Name == "gcp":
+		return google.DefaultTokenSource(context.Background(), gcpScopes...)
+	case user.AuthProvider != nil:
+		return nil, fmt.Errorf("unsupported auth provider %q", user.AuthProvider.Name)
+	}
+	return nil, nil
+}
+
+// fileOrData returns inline base64 data if present, otherwise the contents of
+// the file, resolved relative to the kubeconfig that referenced it.
+func fileOrData(configFile, path, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(resolvePath(configFile, path))
+}
+
+func resolvePath(configFile, path string) string {
+	if configFile == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configFile), path)
+}
+
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Spec       execCredentialSpec    `json:"spec"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialSpec struct {
+	Interactive bool `json:"interactive"`
+}
+
+type execCredentialStatus struct {
+	Token                 string     `json:"token"`
+	ClientCertificateData string     `json:"clientCertificateData"`
+	ClientKeyData         string     `json:"clientKeyData"`
+	ExpirationTimestamp   *time.Time `json:"expirationTimestamp"`
+}
+
+// execCredentialSource runs an exec credential plugin, such as
+// gke-gcloud-auth-plugin or aws-iam-authenticator, and caches what it returns
+// until it expires.
+type execCredentialSource struct {
+	config execConfig
+	dir    string
+
+	mu     sync.Mutex
+	status *execCredentialStatus
+}
+
+func (s *execCredentialSource) credential() (*execCredentialStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status != nil {
+		expiry := s.status.ExpirationTimestamp
+		if expiry == nil || time.Until(*expiry) > 10*time.Second {
+			return s.status, nil
+		}
+	}
+
+	apiVersion := s.config.APIVersion
+	if apiVersion == "" {
+		apiVersion = "client.authentication.k8s.io/v1beta1"
+	}
+	info, err := json.Marshal(execCredential{
+		APIVersion: apiVersion,
+		Kind:       "ExecCredential",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands given as a relative path are relative to the kubeconfig, bare
+	// names are looked up in $PATH.
+	command := s.config.Command
+	if !filepath.IsAbs(command) && strings.Contains(command, string(filepath.Separator)) {
+		command = filepath.Join(s.dir, command)
+	}
+	cmd := exec.Command(command, s.config.Args...)
+	cmd.Env = append(os.Environ(), execInfoEnv+"="+string(info))
+	for _, env := range s.config.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("exec credential plugin %s: %v: %s", s.config.Command, err, stderr.String())
+	}
+
+	var credential execCredential
+	err = json.Unmarshal(output, &credential)
+	if err != nil {
+		return nil, fmt.Errorf("exec credential plugin %s: %v", s.config.Command, err)
+	}
+	if credential.Status == nil {
+		return nil, fmt.Errorf("exec credential plugin %s returned no status", s.config.Command)
+	}
+	s.status = credential.Status
+	return s.status, nil
+}
+
+func (s *execCredentialSource) Token() (*oauth2.Token, error) {
+	status, err := s.credential()
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: status.Token}, nil
+}
+
+func (s *execCredentialSource) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	status, err := s.credential()
+	if err != nil {
+		return nil, err
+	}
+	if status.ClientCertificateData == "" {
+		return &tls.Certificate{}, nil
+	}
+	pair, err := tls.X509KeyPair([]byte(status.ClientCertificateData), []byte(status.ClientKeyData))
+	if err != nil {
+		return nil, err
+	}
+	return &pair, nil
+}
@@ -0,0 +1,203 @@
+package kargo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fixtureServer is the TLS server a copy of testdata/kubeconfig points at. It
+// records the credentials of the last request it was sent.
+type fixtureServer struct {
+	*httptest.Server
+	dir string
+
+	mu     sync.Mutex
+	bearer string
+	client string
+}
+
+// newFixtureServer starts a server with the certificate in testdata, and
+// copies the fixtures to a directory with https://kargo.test replaced by the
+// server's address.
+func newFixtureServer(t *testing.T) *fixtureServer {
+	s := &fixtureServer{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.bearer = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		s.client = ""
+		if len(r.TLS.PeerCertificates) > 0 {
+			s.client = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	}))
+
+	pair, err := tls.LoadX509KeyPair("testdata/kubeconfig/server.crt", "testdata/kubeconfig/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ioutil.ReadFile("testdata/kubeconfig/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+
+	s.dir, err = ioutil.TempDir("", "kargo-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(s.dir) })
+	err = filepath.Walk("testdata/kubeconfig", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(s.dir, strings.TrimPrefix(path, filepath.Join("testdata", "kubeconfig")))
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		data = []byte(strings.Replace(string(data), "https://kargo.test", s.URL, -1))
+		return ioutil.WriteFile(target, data, info.Mode())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// sent returns the bearer token and the common name of the client
+// certificate of the last request.
+func (s *fixtureServer) sent() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bearer, s.client
+}
+
+// setenv sets an environment variable, or unsets it when value is empty,
+// until t finishes.
+func setenv(t *testing.T, key, value string) {
+	old, set := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+}
+
+func TestNewAPIClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		kubeconfig []string
+		flag       string
+		context    string
+		inCluster  bool
+
+		bearer    string
+		client    string
+		namespace string
+		err       string
+	}{
+		{name: "current context", kubeconfig: []string{"config"}, bearer: "static-token", namespace: "token-ns"},
+		{name: "token file", kubeconfig: []string{"config"}, context: "token-file", bearer: "file-token"},
+		{name: "client certificate files", kubeconfig: []string{"config"}, context: "cert-file", client: "kargo-test-client"},
+		{name: "exec plugin", kubeconfig: []string{"config"}, context: "exec", bearer: "from-exec-token"},
+		{name: "inline certificates", kubeconfig: []string{"inline"}, client: "kargo-test-client", namespace: "inline-ns"},
+		{name: "first file wins", kubeconfig: []string{"config", "inline"}, bearer: "static-token", namespace: "token-ns"},
+		{name: "context from a later file", kubeconfig: []string{"config", "inline"}, context: "cert-inline", client: "kargo-test-client", namespace: "inline-ns"},
+		{name: "missing files are skipped", kubeconfig: []string{"absent", "config"}, bearer: "static-token", namespace: "token-ns"},
+		{name: "flag over $KUBECONFIG", kubeconfig: []string{"inline"}, flag: "config", bearer: "static-token", namespace: "token-ns"},
+		{name: "flag in a cluster", flag: "config", inCluster: true, bearer: "static-token", namespace: "token-ns"},
+		{name: "in cluster", kubeconfig: []string{"config"}, inCluster: true, bearer: "sa-token", namespace: "sa-namespace"},
+		{name: "missing context", kubeconfig: []string{"config"}, context: "missing", err: `context "missing" not found`},
+		{name: "missing cluster", kubeconfig: []string{"config"}, context: "no-cluster", err: `cluster "missing" not found`},
+		{name: "missing kubeconfig", kubeconfig: []string{"absent"}, err: "absent"},
+	}
+
+	server := newFixtureServer(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.context == "exec" && runtime.GOOS == "windows" {
+				t.Skip("the fake exec plugin is a shell script")
+			}
+			saveFlags(t)
+			saved := serviceAccountDir
+			t.Cleanup(func() { serviceAccountDir = saved })
+
+			apiHost = ""
+			kubeconfigContext = test.context
+			kubeconfigPath = ""
+			if test.flag != "" {
+				kubeconfigPath = filepath.Join(server.dir, test.flag)
+			}
+			paths := make([]string, 0)
+			for _, name := range test.kubeconfig {
+				paths = append(paths, filepath.Join(server.dir, name))
+			}
+			setenv(t, "KUBECONFIG", strings.Join(paths, string(filepath.ListSeparator)))
+
+			host, port := "", ""
+			if test.inCluster {
+				u, err := url.Parse(server.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				host, port, _ = net.SplitHostPort(u.Host)
+			}
+			setenv(t, "KUBERNETES_SERVICE_HOST", host)
+			setenv(t, "KUBERNETES_SERVICE_PORT", port)
+			serviceAccountDir = filepath.Join(server.dir, "serviceaccount")
+
+			client, err := newAPIClient()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.namespace != test.namespace {
+				t.Errorf("namespace is %q, want %q", client.namespace, test.namespace)
+			}
+
+			resp, err := client.Do(&http.Request{Method: http.MethodGet, Header: make(http.Header), URL: &url.URL{Path: "/api"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			bearer, cert := server.sent()
+			if bearer != test.bearer || cert != test.client {
+				t.Errorf("sent token %q and client certificate %q, want %q and %q", bearer, cert, test.bearer, test.client)
+			}
+		})
+	}
+}
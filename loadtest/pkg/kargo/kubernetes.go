@@ -16,24 +16,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
-	"time"
+	"sort"
+	"strings"
 )
 
 var (
-	replicasetsEndpoint = "/apis/extensions/v1beta1/namespaces/%s/replicasets"
-	replicasetEndpoint  = "/apis/extensions/v1beta1/namespaces/%s/replicasets/%s"
-	scaleEndpoint       = "/apis/extensions/v1beta1/namespaces/%s/replicasets/%s/scale"
-	daemonSetsEndpoint  = "/apis/extensions/v1beta1/namespaces/%s/daemonsets"
-	daemonSetEndpoint   = "/apis/extensions/v1beta1/namespaces/%s/daemonsets/%s"
+	deploymentsEndpoint = "/apis/%s/namespaces/%s/deployments"
+	deploymentEndpoint  = "/apis/%s/namespaces/%s/deployments/%s"
+	scaleEndpoint       = "/apis/%s/namespaces/%s/deployments/%s/scale"
+	daemonSetsEndpoint  = "/apis/%s/namespaces/%s/daemonsets"
+	daemonSetEndpoint   = "/apis/%s/namespaces/%s/daemonsets/%s"
 	logsEndpoint        = "/api/v1/namespaces/%s/pods/%s/log"
 	podsEndpoint        = "/api/v1/namespaces/%s/pods"
 	configMapsEndpoint  = "/api/v1/namespaces/%s/configmaps"
 	configMapEndpoint   = "/api/v1/namespaces/%s/configmaps/%s"
+	secretsEndpoint     = "/api/v1/namespaces/%s/secrets"
+	secretEndpoint      = "/api/v1/namespaces/%s/secrets/%s"
 )
 
 var ErrNotExist = errors.New("does not exist")
@@ -49,18 +51,17 @@ func getPods(namespace, labelSelector string) (*PodList, error) {
 		Header: make(http.Header),
 		Method: http.MethodGet,
 		URL: &url.URL{
-			Host:     apiHost,
 			Path:     path,
-			Scheme:   "http",
 			RawQuery: v.Encode(),
 		},
 	}
 	request.Header.Set("Accept", "application/json, */*")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := kubeClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
 		fmt.Println("No pods found using selector: ", labelSelector)
@@ -78,144 +79,138 @@ func getPods(namespace, labelSelector string) (*PodList, error) {
 
 }
 
-func getLogs(config DeploymentConfig, w io.Writer) error {
-	time.Sleep(10 * time.Second)
-	rs, err := getReplicaSet(config.Namespace, config.Name)
+// selectorString renders labels as an equality based label selector.
+func selectorString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	requirements := make([]string, 0, len(keys))
+	for _, key := range keys {
+		requirements = append(requirements, fmt.Sprintf("%s=%s", key, labels[key]))
+	}
+	return strings.Join(requirements, ",")
+}
+
+func getDeployment(groupVersion, namespace, name string) (*Deployment, error) {
+	var d Deployment
+
+	path := fmt.Sprintf(deploymentEndpoint, groupVersion, namespace, name)
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path: path,
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	var labelSelector bytes.Buffer
-	for key, value := range rs.Spec.Selector.MatchLabels {
-		labelSelector.WriteString(fmt.Sprintf("%s=%s", key, value))
+	if resp.StatusCode == 404 {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Get deployment error non 200 reponse: " + resp.Status)
 	}
 
-	podList, err := getPods(config.Namespace, labelSelector.String())
+	err = json.NewDecoder(resp.Body).Decode(&d)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &d, nil
+}
 
-	go func(podList *PodList) {
-		for {
-			time.Sleep(60 * time.Second)
-			newPodList, err := getPods(config.Namespace, labelSelector.String())
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				podList = newPodList
-			}
-		}
-	}(podList)
+func getPod(namespace, name string) (*Pod, error) {
+	var pod Pod
 
-	for _, pod := range podList.Items {
-		v := url.Values{}
-		v.Set("follow", "true")
-		v.Set("container", config.Name)
-		v.Set("container", config.Name)
+	path := fmt.Sprintf(podsEndpoint, namespace) + "/" + name
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path: path,
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
 
-		path := fmt.Sprintf(logsEndpoint, config.Namespace, pod.Metadata.Name)
-		request := &http.Request{
-			Header: make(http.Header),
-			Method: http.MethodGet,
-			URL: &url.URL{
-				Host:     apiHost,
-				Path:     path,
-				Scheme:   "http",
-				RawQuery: v.Encode(),
-			},
-		}
-		request.Header.Set("Accept", "application/json, */*")
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-		go func() {
-			for {
-				resp, err := http.DefaultClient.Do(request)
-				if err != nil {
-					fmt.Println(err)
-					time.Sleep(5 * time.Second)
-					continue
-				}
-
-				if resp.StatusCode == 404 {
-					data, err := ioutil.ReadAll(resp.Body)
-					if err != nil {
-						fmt.Println(err)
-						time.Sleep(5 * time.Second)
-						continue
-					}
-					fmt.Println(string(data))
-					fmt.Println("GET pod logs error: ", ErrNotExist)
-					time.Sleep(5 * time.Second)
-					continue
-				}
-				if resp.StatusCode != 200 {
-					fmt.Println(errors.New("Get replica set error non 200 reponse: " + resp.Status))
-					time.Sleep(5 * time.Second)
-					continue
-				}
-
-				if _, err := io.Copy(w, resp.Body); err != nil {
-					fmt.Println(err)
-				}
-			}
-		}()
+	if resp.StatusCode == 404 {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Get pod error non 200 reponse: " + resp.Status)
 	}
 
-	return nil
+	err = json.NewDecoder(resp.Body).Decode(&pod)
+	if err != nil {
+		return nil, err
+	}
+	return &pod, nil
 }
 
-func getReplicaSet(namespace, name string) (*ReplicaSet, error) {
-	var rs ReplicaSet
+func getConfigMap(namespace, name string) (*ConfigMap, error) {
+	var cm ConfigMap
 
-	path := fmt.Sprintf(replicasetEndpoint, namespace, name)
+	path := fmt.Sprintf(configMapEndpoint, namespace, name)
 	request := &http.Request{
 		Header: make(http.Header),
 		Method: http.MethodGet,
 		URL: &url.URL{
-			Host:   apiHost,
-			Path:   path,
-			Scheme: "http",
+			Path: path,
 		},
 	}
 	request.Header.Set("Accept", "application/json, */*")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := kubeClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
 		return nil, ErrNotExist
 	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New("Get deployment error non 200 reponse: " + resp.Status)
+		return nil, errors.New("Get ConfigMap error non 200 reponse: " + resp.Status)
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&rs)
+	err = json.NewDecoder(resp.Body).Decode(&cm)
 	if err != nil {
 		return nil, err
 	}
-	return &rs, nil
+	return &cm, nil
 }
 
-func getScale(namespace, name string) (*Scale, error) {
+func getScale(groupVersion, namespace, name string) (*Scale, error) {
 	var scale Scale
 
-	path := fmt.Sprintf(scaleEndpoint, namespace, name)
+	path := fmt.Sprintf(scaleEndpoint, groupVersion, namespace, name)
 	request := &http.Request{
 		Header: make(http.Header),
 		Method: http.MethodGet,
 		URL: &url.URL{
-			Host:   apiHost,
-			Path:   path,
-			Scheme: "http",
+			Path: path,
 		},
 	}
 	request.Header.Set("Accept", "application/json, */*")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := kubeClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
 		return nil, ErrNotExist
@@ -231,8 +226,8 @@ func getScale(namespace, name string) (*Scale, error) {
 	return &scale, nil
 }
 
-func scaleReplicaSet(namespace, name string, replicas int) error {
-	scale, err := getScale(namespace, name)
+func scaleDeployment(groupVersion, namespace, name string, replicas int) error {
+	scale, err := getScale(groupVersion, namespace, name)
 	if err != nil {
 		return err
 	}
@@ -245,24 +240,23 @@ func scaleReplicaSet(namespace, name string, replicas int) error {
 		return err
 	}
 
-	path := fmt.Sprintf(scaleEndpoint, namespace, name)
+	path := fmt.Sprintf(scaleEndpoint, groupVersion, namespace, name)
 	request := &http.Request{
 		Body:          ioutil.NopCloser(body),
 		ContentLength: int64(body.Len()),
 		Header:        make(http.Header),
 		Method:        http.MethodPut,
 		URL: &url.URL{
-			Host:   apiHost,
-			Path:   path,
-			Scheme: "http",
+			Path: path,
 		},
 	}
 	request.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := kubeClient.Do(request)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
 		return ErrNotExist
@@ -273,40 +267,39 @@ func scaleReplicaSet(namespace, name string, replicas int) error {
 			return err
 		}
 		fmt.Println(string(data))
-		return errors.New("Scale ReplicaSet error non 200 reponse: " + resp.Status)
+		return errors.New("Scale Deployment error non 200 reponse: " + resp.Status)
 	}
 
 	return nil
 }
 
-func deleteReplicaSet(config DeploymentConfig) error {
-	err := scaleReplicaSet(config.Namespace, config.Name, 0)
+func deleteDeployment(versions apiVersions, config DeploymentConfig) error {
+	err := scaleDeployment(versions.Workloads, config.Namespace, config.Name, 0)
 	if err != nil {
 		return err
 	}
 
-	path := fmt.Sprintf(replicasetEndpoint, config.Namespace, config.Name)
+	path := fmt.Sprintf(deploymentEndpoint, versions.Workloads, config.Namespace, config.Name)
 	request := &http.Request{
 		Header: make(http.Header),
 		Method: http.MethodDelete,
 		URL: &url.URL{
-			Host:   apiHost,
-			Path:   path,
-			Scheme: "http",
+			Path: path,
 		},
 	}
 	request.Header.Set("Accept", "application/json, */*")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := kubeClient.Do(request)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
 		return ErrNotExist
 	}
 	if resp.StatusCode != 200 {
-		return errors.New("Delete ReplicaSet error non 200 reponse: " + resp.Status)
+		return errors.New("Delete Deployment error non 200 reponse: " + resp.Status)
 	}
 
 	return nil
@@ -319,17 +312,18 @@ func deleteConfigMaps(config DeploymentConfig) error {
 			Header: make(http.Header),
 			Method: http.MethodDelete,
 			URL: &url.URL{
-				Host:   apiHost,
-				Path:   path,
-				Scheme: "http",
+				Path: path,
 			},
 		}
 		request.Header.Set("Accept", "application/json, */*")
 
-		resp, err := http.DefaultClient.Do(request)
+		resp, err := kubeClient.Do(request)
 		if err != nil {
 			return err
 		}
+		// Only the status is needed, so the body is closed now rather
+		// than deferred to the end of the loop.
+		resp.Body.Close()
 
 		if resp.StatusCode == 404 {
 			return ErrNotExist
@@ -342,24 +336,23 @@ func deleteConfigMaps(config DeploymentConfig) error {
 	return nil
 }
 
-func deleteDaemonSets(config DeploymentConfig) error {
+func deleteDaemonSets(versions apiVersions, config DeploymentConfig) error {
 	for _, ds := range config.DaemonSets {
-		path := fmt.Sprintf(daemonSetEndpoint, config.Namespace, ds.Name)
+		path := fmt.Sprintf(daemonSetEndpoint, versions.Workloads, config.Namespace, ds.Name)
 		request := &http.Request{
 			Header: make(http.Header),
 			Method: http.MethodDelete,
 			URL: &url.URL{
-				Host:   apiHost,
-				Path:   path,
-				Scheme: "http",
+				Path: path,
 			},
 		}
 		request.Header.Set("Accept", "application/json, */*")
 
-		resp, err := http.DefaultClient.Do(request)
+		resp, err := kubeClient.Do(request)
 		if err != nil {
 			return err
 		}
+		resp.Body.Close()
 
 		if resp.StatusCode == 404 {
 			return ErrNotExist
@@ -372,89 +365,91 @@ func deleteDaemonSets(config DeploymentConfig) error {
 	return nil
 }
 
-func createConfigMaps(config DeploymentConfig) error {
+func configMapManifests(config DeploymentConfig) []manifest {
+	manifests := make([]manifest, 0)
 	for _, cm := range config.ConfigMaps {
-		var b []byte
-		body := bytes.NewBuffer(b)
-		err := json.NewEncoder(body).Encode(cm)
-		if err != nil {
-			return err
-		}
-
-		path := fmt.Sprintf(configMapsEndpoint, config.Namespace)
-		request := &http.Request{
-			Body:          ioutil.NopCloser(body),
-			ContentLength: int64(body.Len()),
-			Header:        make(http.Header),
-			Method:        http.MethodPost,
-			URL: &url.URL{
-				Host:   apiHost,
-				Path:   path,
-				Scheme: "http",
-			},
+		if cm.ApiVersion == "" {
+			cm.ApiVersion = "v1"
 		}
-		request.Header.Set("Content-Type", "application/json")
-
-		resp, err := http.DefaultClient.Do(request)
-		if err != nil {
-			return err
+		if cm.Kind == "" {
+			cm.Kind = "ConfigMap"
 		}
+		cm.Metadata.Namespace = config.Namespace
+		cm.Metadata.Labels = objectLabels(config, cm.Metadata.Labels)
+		cm.Metadata.Annotations = objectAnnotations(config, cm.Metadata.Annotations)
 
-		if resp.StatusCode != 201 {
-			data, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return err
-			}
-			fmt.Println(string(data))
-			return errors.New("ConfigMap: Unexpected HTTP status code" + resp.Status)
-		}
+		path := fmt.Sprintf(configMapsEndpoint, config.Namespace)
+		manifests = append(manifests, manifest{"ConfigMap", path, cm.Metadata.Name, cm})
 	}
 
-	return nil
+	return manifests
 }
 
-func createDaemonSets(config DeploymentConfig) error {
-	for _, ds := range config.DaemonSets {
-		var b []byte
-		body := bytes.NewBuffer(b)
-		err := json.NewEncoder(body).Encode(ds)
-		if err != nil {
-			return err
+// UpdateConfigMap replaces the data of one of the run's ConfigMaps. Pods that
+// mount it see the change once the kubelet syncs the volume, which can take a
+// minute or two; pods created later see it straight away.
+func (dm *DeploymentManager) UpdateConfigMap(name string, data map[string]string) error {
+	for i, cm := range dm.config.ConfigMaps {
+		if cm.Metadata.Name != name {
+			continue
 		}
-
-		path := fmt.Sprintf(daemonSetsEndpoint, config.Namespace)
-		request := &http.Request{
-			Body:          ioutil.NopCloser(body),
-			ContentLength: int64(body.Len()),
-			Header:        make(http.Header),
-			Method:        http.MethodPost,
-			URL: &url.URL{
-				Host:   apiHost,
-				Path:   path,
-				Scheme: "http",
-			},
+		configMaps := append([]ConfigMap{}, dm.config.ConfigMaps...)
+		configMaps[i].Data = data
+		dm.config.ConfigMaps = configMaps
+		if DryRun {
+			return nil
 		}
-		request.Header.Set("Content-Type", "application/json")
 
-		resp, err := http.DefaultClient.Do(request)
+		m := configMapManifests(dm.config)[i]
+		path := fmt.Sprintf(configMapEndpoint, dm.config.Namespace, name)
+		status, body, err := sendObject(http.MethodPut, path, m.object)
 		if err != nil {
 			return err
 		}
+		if status != 200 {
+			return fmt.Errorf("Update ConfigMap error non 200 reponse: %d %s", status, body)
+		}
+		return nil
+	}
+	return fmt.Errorf("ConfigMap %s is not part of the run", name)
+}
 
-		if resp.StatusCode != 201 {
-			data, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return err
-			}
-			fmt.Println(string(data))
-			return errors.New("DaemonSet: Unexpected HTTP status code" + resp.Status)
+func daemonSetManifests(versions apiVersions, config DeploymentConfig) []manifest {
+	manifests := make([]manifest, 0)
+	for _, container := range config.DaemonSets {
+		labels := map[string]string{"run": container.Name}
+		ds := DaemonSet{
+			ApiVersion: versions.Workloads,
+			Kind:       "DaemonSet",
+			Metadata: Metadata{
+				Name:        container.Name,
+				Namespace:   config.Namespace,
+				Labels:      objectLabels(config, labels),
+				Annotations: objectAnnotations(config, nil),
+			},
+			Spec: DaemonSetSpec{
+				Selector: LabelSelector{
+					MatchLabels: labels,
+				},
+				Template: PodTemplate{
+					Metadata: Metadata{
+						Labels: labels,
+					},
+					Spec: PodSpec{
+						Containers: []Container{container},
+					},
+				},
+			},
 		}
+
+		path := fmt.Sprintf(daemonSetsEndpoint, versions.Workloads, config.Namespace)
+		manifests = append(manifests, manifest{"DaemonSet", path, ds.Metadata.Name, ds})
 	}
 
-	return nil
+	return manifests
 }
 
-func createReplicaSet(config DeploymentConfig) error {
+func podTemplate(config DeploymentConfig) PodTemplate {
 
 	volumes := append(config.Volumes, Volume{
 		Name:         "bin",
@@ -467,6 +462,22 @@ func createReplicaSet(config DeploymentConfig) error {
 		MountPath: "/opt/bin",
 	})
 
+	volumeMounts = append(volumeMounts, config.VolumeMounts...)
+
+	if config.heartbeat != "" {
+		volumes = append(volumes, Volume{
+			Name: heartbeatVolume,
+			VolumeSource: VolumeSource{
+				ConfigMap: &ConfigMapVolumeSource{Name: config.heartbeat},
+			},
+		})
+		volumeMounts = append(volumeMounts, VolumeMount{
+			Name:      heartbeatVolume,
+			MountPath: heartbeatMountPath,
+			ReadOnly:  true,
+		})
+	}
+
 	container := Container{
 		Args:            config.Args,
 		Command:         []string{filepath.Join("/opt/bin", config.Name)},
@@ -474,6 +485,8 @@ func createReplicaSet(config DeploymentConfig) error {
 		ImagePullPolicy: "Always",
 		Name:            config.Name,
 		VolumeMounts:    volumeMounts,
+
+		TerminationMessagePolicy: "FallbackToLogsOnError",
 	}
 
 	resourceLimits := make(ResourceList)
@@ -500,12 +513,19 @@ func createReplicaSet(config DeploymentConfig) error {
 	}
 
 	if len(config.Env) > 0 {
+		names := make([]string, 0, len(config.Env))
+		for name := range config.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
 		env := make([]EnvVar, 0)
-		for name, value := range config.Env {
-			env = append(env, EnvVar{Name: name, Value: value})
+		for _, name := range names {
+			env = append(env, EnvVar{Name: name, Value: config.Env[name]})
 		}
 		container.Env = env
 	}
+	container.Env = append(container.Env, downwardAPIEnv()...)
 
 	annotations := config.Annotations
 
@@ -514,13 +534,29 @@ func createReplicaSet(config DeploymentConfig) error {
 		Name:            "install",
 		Image:           "alpine",
 		ImagePullPolicy: "Always",
-		Command:         []string{"wget", "-O", binaryPath, config.BinaryURL},
+		Command:         installCommand(config, binaryPath),
+		Env:             installEnv(config),
 		VolumeMounts: []VolumeMount{
 			VolumeMount{
 				Name:      "bin",
 				MountPath: "/opt/bin",
 			},
 		},
+
+		TerminationMessagePolicy: "FallbackToLogsOnError",
+	}
+	if config.BinaryToken != "" {
+		volumes = append(volumes, Volume{
+			Name: binaryTokenVolume,
+			VolumeSource: VolumeSource{
+				Secret: &SecretVolumeSource{SecretName: binaryTokenSecretName(config)},
+			},
+		})
+		initContainer0.VolumeMounts = append(initContainer0.VolumeMounts, VolumeMount{
+			Name:      binaryTokenVolume,
+			MountPath: binaryTokenMountPath,
+			ReadOnly:  true,
+		})
 	}
 
 	initContainer1 := Container{
@@ -534,72 +570,57 @@ func createReplicaSet(config DeploymentConfig) error {
 				MountPath: "/opt/bin",
 			},
 		},
+
+		TerminationMessagePolicy: "FallbackToLogsOnError",
+	}
+
+	initContainers := append(config.InitSidecars, initContainer0)
+	if signed(config) {
+		initContainers = append(initContainers, verifyContainer(config, binaryPath))
+		volumes = append(volumes, Volume{
+			Name: verifyKeyVolume,
+			VolumeSource: VolumeSource{
+				ConfigMap: &ConfigMapVolumeSource{Name: verifyKeyConfigMap},
+			},
+		})
 	}
+	initContainers = append(initContainers, initContainer1)
 
-	initContainers := append(config.InitSidecars, initContainer0, initContainer1)
+	spec := PodSpec{
+		Containers:     append(config.Sidecars, container),
+		InitContainers: initContainers,
+		Volumes:        volumes,
+	}
+	applyScheduling(&spec, config)
 
-	config.Labels["run"] = config.Name
+	return PodTemplate{
+		Metadata: Metadata{
+			Annotations: annotations,
+			Labels:      objectLabels(config, config.Labels),
+		},
+		Spec: spec,
+	}
+}
 
-	rs := ReplicaSet{
-		ApiVersion: "extensions/v1beta1",
-		Kind:       "ReplicaSet",
+func deploymentManifest(versions apiVersions, config DeploymentConfig) manifest {
+	d := Deployment{
+		ApiVersion: versions.Workloads,
+		Kind:       "Deployment",
 		Metadata: Metadata{
-			Name:      config.Name,
-			Namespace: config.Namespace,
+			Name:        config.Name,
+			Namespace:   config.Namespace,
+			Labels:      objectLabels(config, config.Labels),
+			Annotations: objectAnnotations(config, nil),
 		},
-		Spec: ReplicaSetSpec{
+		Spec: DeploymentSpec{
 			Replicas: int64(config.Replicas),
 			Selector: LabelSelector{
 				MatchLabels: config.Labels,
 			},
-			Template: PodTemplate{
-				Metadata: Metadata{
-					Annotations: annotations,
-					Labels:      config.Labels,
-				},
-				Spec: PodSpec{
-					Containers:     append(config.Sidecars, container),
-					InitContainers: initContainers,
-					Volumes:        volumes,
-				},
-			},
-		},
-	}
-
-	var b []byte
-	body := bytes.NewBuffer(b)
-	err := json.NewEncoder(body).Encode(rs)
-	if err != nil {
-		return err
-	}
-
-	path := fmt.Sprintf(replicasetsEndpoint, config.Namespace)
-	request := &http.Request{
-		Body:          ioutil.NopCloser(body),
-		ContentLength: int64(body.Len()),
-		Header:        make(http.Header),
-		Method:        http.MethodPost,
-		URL: &url.URL{
-			Host:   apiHost,
-			Path:   path,
-			Scheme: "http",
+			Template: podTemplate(config),
 		},
 	}
-	request.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return err
-	}
 
-	if resp.StatusCode != 201 {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
-		fmt.Println(string(data))
-		return errors.New("ReplicaSet: Unexpected HTTP status code" + resp.Status)
-	}
-
-	return nil
+	path := fmt.Sprintf(deploymentsEndpoint, versions.Workloads, config.Namespace)
+	return manifest{"Deployment", path, config.Name, d}
 }
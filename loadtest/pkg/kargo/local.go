@@ -0,0 +1,445 @@
+package kargo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Local workers that ignore SIGTERM for this long are killed.
+const localStopTimeout = 10 * time.Second
+
+// Local workers are ready once they have run this long, so that workers that
+// exit straight away, such as on a bad flag, are not counted.
+var localReadyDelay = time.Second
+
+// Lines logged before Logs is called are kept, up to this many, and written
+// once it is.
+const localLogBacklog = 1000
+
+// localHeartbeatTimeout stops local workers shortly after their coordinator
+// dies, as nothing else would.
+const localHeartbeatTimeout = 30 * time.Second
+
+// LocalBackend runs the workers as processes on this machine, so that
+// distributed runs, scaling and log parsing can be tried without a cluster.
+// config.BinaryURL is the path of the binary the workers run, and settings
+// that only mean something on Kubernetes, such as ConfigMaps, sidecars and
+// scheduling, are ignored.
+//
+// A worker is ready once its process has been running for a second. Workers
+// that exit are not restarted.
+type LocalBackend struct {
+	config         DeploymentConfig
+	node           string
+	dir            string
+	stopHeartbeats context.CancelFunc
+
+	mu       sync.Mutex
+	workers  []*localWorker
+	replicas int
+	nextID   int
+	changed  chan struct{}
+	logs     io.Writer
+	backlog  []string
+
+	writeMu sync.Mutex
+}
+
+type localWorker struct {
+	name     string
+	cmd      *exec.Cmd
+	started  time.Time
+	stopping bool
+	exited   bool
+	err      error
+	done     chan struct{}
+}
+
+// NewLocal returns a backend that runs the workers on this machine.
+func NewLocal() *LocalBackend {
+	node, err := os.Hostname()
+	if err != nil {
+		node = "localhost"
+	}
+	return &LocalBackend{
+		node:    node,
+		changed: make(chan struct{}),
+	}
+}
+
+// Create starts the workers. With --dry-run the commands are printed instead.
+// A heartbeat file stops the workers if this process dies without deleting
+// them, as does config.MaxRunTime.
+func (b *LocalBackend) Create(config DeploymentConfig) error {
+	if b.config.Name != "" {
+		return errors.New("the local workers have already been created")
+	}
+	if config.BinaryURL == "" {
+		return errors.New("local workers need the path of a binary to run")
+	}
+	if config.Env == nil {
+		config.Env = make(map[string]string)
+	}
+	if len(config.ScalingPlan) > 0 {
+		config.Replicas = config.ScalingPlan[0].Replicas
+	}
+	config.runID = newRunID()
+	if config.MaxRunTime > 0 {
+		config.deadline = time.Now().Add(config.MaxRunTime)
+	}
+
+	if DryRun {
+		for i := 1; i <= config.Replicas; i++ {
+			fmt.Printf("%s-%d: %s\n", config.Name, i, strings.Join(append([]string{config.BinaryURL}, config.Args...), " "))
+		}
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "kargo-"+config.Name)
+	if err != nil {
+		return err
+	}
+	b.dir = dir
+	config.heartbeat = filepath.Join(dir, heartbeatKey)
+	err = writeLocalHeartbeat(config.heartbeat)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopHeartbeats = cancel
+	go sendLocalHeartbeats(ctx, config.heartbeat)
+
+	b.config = config
+	fmt.Printf("Starting %d %s workers on %s...\n", config.Replicas, config.Name, b.node)
+	return b.Scale(config, config.Replicas)
+}
+
+// RunID identifies the run, and appears in no object as there are none.
+func (b *LocalBackend) RunID() string {
+	return b.config.runID
+}
+
+// Scale starts or stops workers until n are running. The newest workers are
+// stopped first.
+func (b *LocalBackend) Scale(config DeploymentConfig, n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.notify()
+
+	b.replicas = n
+	running := b.running()
+	for len(running) < n {
+		w, err := b.start()
+		if err != nil {
+			return err
+		}
+		running = append(running, w)
+	}
+	for _, w := range running[n:] {
+		b.stop(w)
+	}
+	return nil
+}
+
+// running returns the workers that are running and not being stopped, oldest
+// first.
+func (b *LocalBackend) running() []*localWorker {
+	running := make([]*localWorker, 0, len(b.workers))
+	for _, w := range b.workers {
+		if !w.exited && !w.stopping {
+			running = append(running, w)
+		}
+	}
+	return running
+}
+
+func (w *localWorker) ready() bool {
+	return !w.exited && !w.stopping && time.Since(w.started) >= localReadyDelay
+}
+
+func (b *LocalBackend) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// start runs a new worker with the kargo environment a pod would get, and
+// copies its output to the logs.
+func (b *LocalBackend) start() (*localWorker, error) {
+	b.nextID++
+	w := &localWorker{
+		name: fmt.Sprintf("%s-%d", b.config.Name, b.nextID),
+		done: make(chan struct{}),
+	}
+
+	env := os.Environ()
+	for name, value := range b.config.Env {
+		env = append(env, name+"="+value)
+	}
+	env = append(env,
+		PodNameEnv+"="+w.name,
+		PodIPEnv+"=127.0.0.1",
+		NodeNameEnv+"="+b.node,
+		heartbeatFileEnv+"="+b.config.heartbeat,
+		heartbeatTimeoutEnv+"="+localHeartbeatTimeout.String(),
+	)
+	if !b.config.deadline.IsZero() {
+		env = append(env, deadlineEnv+"="+b.config.deadline.UTC().Format(time.RFC3339))
+	}
+
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	w.cmd = exec.Command(b.config.BinaryURL, b.config.Args...)
+	w.cmd.Env = env
+	w.cmd.Stdout = pw
+	w.cmd.Stderr = pw
+	err = w.cmd.Start()
+	pw.Close()
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("Start worker %s error: %s", w.name, err)
+	}
+	w.started = time.Now()
+	b.workers = append(b.workers, w)
+
+	go b.follow(w, r)
+	return w, nil
+}
+
+// follow copies the output of w to the logs until it exits.
+func (b *LocalBackend) follow(w *localWorker, r *os.File) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		b.writeLine(w.name, scanner.Text())
+	}
+	err := w.cmd.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w.exited = true
+	w.err = err
+	if !w.stopping {
+		if err != nil {
+			fmt.Printf("Worker %s exited: %s\n", w.name, err)
+		} else {
+			fmt.Printf("Worker %s exited\n", w.name)
+		}
+	}
+	close(w.done)
+	b.notify()
+}
+
+// stop asks w to shut down, as Kubernetes would, and kills it if it has not
+// after localStopTimeout.
+func (b *LocalBackend) stop(w *localWorker) {
+	w.stopping = true
+	w.cmd.Process.Signal(syscall.SIGTERM)
+	go func() {
+		select {
+		case <-w.done:
+		case <-time.After(localStopTimeout):
+			fmt.Printf("Worker %s did not stop after %s, killing it\n", w.name, localStopTimeout)
+			w.cmd.Process.Kill()
+		}
+	}()
+}
+
+func (b *LocalBackend) writeLine(worker, line string) {
+	b.mu.Lock()
+	w := b.logs
+	if w == nil {
+		b.backlog = append(b.backlog, fmt.Sprintf("[%s] %s\n", worker, line))
+		if len(b.backlog) > localLogBacklog {
+			b.backlog = b.backlog[len(b.backlog)-localLogBacklog:]
+		}
+	}
+	b.mu.Unlock()
+	if w == nil {
+		return
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	fmt.Fprintf(w, "[%s] %s\n", worker, line)
+}
+
+// WaitReady blocks until n workers are ready, printing progress, or returns
+// an error listing the workers that exited after --ready-timeout.
+func (b *LocalBackend) WaitReady(n int) error {
+	timeout := time.After(readyTimeout)
+	ticker := time.NewTicker(localReadyDelay / 4)
+	defer ticker.Stop()
+
+	lastReady := -1
+	for {
+		b.mu.Lock()
+		count := 0
+		for _, w := range b.workers {
+			if w.ready() {
+				count++
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if count != lastReady {
+			fmt.Printf("%d/%d %s workers ready\n", count, n, b.config.Name)
+			lastReady = count
+		}
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-timeout:
+			return b.readyError(n)
+		}
+	}
+}
+
+func (b *LocalBackend) readyError(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failing := make([]string, 0)
+	for _, w := range b.workers {
+		if w.exited && !w.stopping {
+			failing = append(failing, w.name+": "+w.state())
+		}
+	}
+	if len(failing) > 0 {
+		return fmt.Errorf("timed out after %s waiting for %d ready workers; exited workers:\n%s", readyTimeout, n, strings.Join(failing, "\n"))
+	}
+	return fmt.Errorf("timed out after %s waiting for %d ready workers", readyTimeout, n)
+}
+
+func (w *localWorker) state() string {
+	switch {
+	case w.exited && w.err != nil:
+		return "Exited: " + w.err.Error()
+	case w.exited:
+		return "Completed"
+	case w.stopping:
+		return "Stopping"
+	case !w.ready():
+		return "Starting"
+	}
+	return "Running"
+}
+
+// Logs writes the lines the workers logged so far, and every line they log
+// from now on, to w with each line prefixed by the worker name. It returns
+// immediately.
+func (b *LocalBackend) Logs(w io.Writer) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	b.mu.Lock()
+	if b.logs != nil {
+		b.mu.Unlock()
+		return errors.New("already following logs")
+	}
+	b.logs = w
+	backlog := b.backlog
+	b.backlog = nil
+	b.mu.Unlock()
+
+	for _, line := range backlog {
+		io.WriteString(w, line)
+	}
+	return nil
+}
+
+// Status lists the workers that are running or being stopped, and those
+// that exited on their own.
+func (b *LocalBackend) Status() (*RunStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := &RunStatus{Replicas: b.replicas}
+	for _, w := range b.workers {
+		if w.stopping && w.exited {
+			// Gone, like a pod deleted by scaling down.
+			continue
+		}
+		ready := w.ready()
+		if ready {
+			status.Ready++
+		}
+		status.Workers = append(status.Workers, WorkerStatus{
+			Name:  w.name,
+			Node:  b.node,
+			Ready: ready,
+			State: w.state(),
+		})
+	}
+	sort.Slice(status.Workers, func(i, j int) bool {
+		return status.Workers[i].Name < status.Workers[j].Name
+	})
+	return status, nil
+}
+
+// Delete stops every worker and waits for them to exit.
+func (b *LocalBackend) Delete() error {
+	b.mu.Lock()
+	running := b.running()
+	fmt.Printf("Stopping %d %s workers...\n", len(running), b.config.Name)
+	for _, w := range running {
+		b.stop(w)
+	}
+	b.replicas = 0
+	workers := append([]*localWorker{}, b.workers...)
+	b.mu.Unlock()
+
+	for _, w := range workers {
+		<-w.done
+	}
+	if b.stopHeartbeats != nil {
+		b.stopHeartbeats()
+	}
+	if b.dir != "" {
+		return os.RemoveAll(b.dir)
+	}
+	return nil
+}
+
+func writeLocalHeartbeat(path string) error {
+	return ioutil.WriteFile(path, []byte(time.Now().UTC().Format(time.RFC3339Nano)), 0644)
+}
+
+// sendLocalHeartbeats updates the heartbeat file several times per heartbeat
+// timeout until ctx is done.
+func sendLocalHeartbeats(ctx context.Context, path string) {
+	ticker := time.NewTicker(localHeartbeatTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := writeLocalHeartbeat(path)
+		if err != nil {
+			fmt.Println("Heartbeat error: ", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package kargo
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// localTestScript logs its worker name and how it was stopped, and runs until
+// it is.
+const localTestScript = `echo started $POD_NAME on $NODE_NAME; trap 'echo stopping; exit 0' TERM; while true; do sleep 0.1; done`
+
+func newLocalTest(t *testing.T) (*LocalBackend, DeploymentConfig) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh to run workers with")
+	}
+	saveFlags(t)
+	config := testConfig(2)
+	config.Name = "worker"
+	config.BinaryURL = "/bin/sh"
+	config.Args = []string{"-c", localTestScript}
+	return NewLocal(), config
+}
+
+func TestLocalCreateScaleLogsDelete(t *testing.T) {
+	b, config := newLocalTest(t)
+	err := b.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete()
+	err = b.WaitReady(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out syncBuffer
+	err = b.Logs(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"[worker-1] started worker-1 on ", "[worker-2] started worker-2 on "} {
+		waitFor(t, 5*time.Second, line, func() bool { return strings.Contains(out.String(), line) })
+	}
+
+	err = b.Scale(config, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "worker-3", func() bool { return strings.Contains(out.String(), "[worker-3] started") })
+
+	// Scaling down stops the newest worker.
+	err = b.Scale(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "worker-3 to stop", func() bool { return strings.Contains(out.String(), "[worker-3] stopping") })
+	waitFor(t, 5*time.Second, "worker-2 to stop", func() bool { return strings.Contains(out.String(), "[worker-2] stopping") })
+	status, err := b.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "one worker", func() bool {
+		status, err = b.Status()
+		return err == nil && len(status.Workers) == 1
+	})
+	if status.Replicas != 1 || status.Ready != 1 || status.Workers[0].Name != "worker-1" || status.Workers[0].State != "Running" {
+		t.Errorf("Status = %+v, want worker-1 running", status)
+	}
+
+	err = b.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "[worker-1] stopping") {
+		t.Errorf("worker-1 was not stopped:\n%s", out.String())
+	}
+}
+
+func TestLocalWaitReadyReportsExitedWorkers(t *testing.T) {
+	b, config := newLocalTest(t)
+	readyTimeout = 500 * time.Millisecond
+
+	config.Args = []string{"-c", "exit 3"}
+	err := b.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Delete()
+
+	err = b.WaitReady(2)
+	if err == nil || !strings.Contains(err.Error(), "worker-1: Exited: exit status 3") {
+		t.Fatalf("WaitReady error = %v, want one saying worker-1 exited with status 3", err)
+	}
+}
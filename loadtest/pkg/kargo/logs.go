@@ -0,0 +1,333 @@
+package kargo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logRetryInterval  = 5 * time.Second
+	logReconnectDelay = time.Second
+)
+
+// maxLogLine is the longest log line written out, in bytes.
+const maxLogLine = 1024 * 1024
+
+// logMux follows the logs of every pod of a deployment and writes them, one
+// whole line at a time and prefixed with the pod name, to a single writer. A
+// pod watch attaches exactly one follower per pod and container once the
+// container has started, and detaches it when the pod is deleted.
+type logMux struct {
+	config DeploymentConfig
+	ctx    context.Context
+
+	mu        sync.Mutex
+	pods      map[string]*Pod
+	followers map[string]*logFollower
+	nodes     map[string]string
+
+	writeMu sync.Mutex
+	w       io.Writer
+}
+
+// logFollower streams the log of one instance of a container. A container
+// restart is a new instance and gets a new follower.
+//
+// Lines are requested with timestamps. When a stream drops the follower
+// resumes from the last timestamp it wrote, and skips the lines at or before
+// it that were already written, so every line is written exactly once. A
+// line the stream drops in the middle of is not written, and the resume
+// point stays before it, so the next stream sends it again whole.
+type logFollower struct {
+	pod          string
+	container    string
+	restartCount int32
+	cancel       context.CancelFunc
+	done         bool
+
+	last       time.Time
+	seenAtLast int
+
+	// partial is the line the last stream ended in the middle of. It is
+	// only written if no stream follows to send it whole.
+	partial          string
+	partialTruncated bool
+	partialAtLast    int
+}
+
+// accept strips the timestamp from a log line and reports whether the line
+// has not been written before.
+func (f *logFollower) accept(line string, atLast *int) (string, bool) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return line, true
+	}
+	ts, err := time.Parse(time.RFC3339Nano, line[:i])
+	if err != nil {
+		return line, true
+	}
+	line = line[i+1:]
+
+	switch {
+	case ts.Before(f.last):
+		return line, false
+	case ts.Equal(f.last):
+		*atLast++
+		if *atLast <= f.seenAtLast {
+			return line, false
+		}
+		f.seenAtLast++
+	default:
+		f.last = ts
+		f.seenAtLast = 1
+		*atLast = 1
+	}
+	return line, true
+}
+
+func newLogMux(config DeploymentConfig, w io.Writer) *logMux {
+	return &logMux{
+		config:    config,
+		pods:      make(map[string]*Pod),
+		followers: make(map[string]*logFollower),
+		nodes:     make(map[string]string),
+		w:         w,
+	}
+}
+
+func (m *logMux) run(ctx context.Context) error {
+	m.ctx = ctx
+	return watchPods(ctx, m.config.Namespace, podSelector(m.config), m.handle)
+}
+
+func (m *logMux) handle(eventType string, pod *Pod) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name := pod.Metadata.Name
+	if eventType == "DELETED" {
+		delete(m.pods, name)
+		for key, f := range m.followers {
+			if f.pod == name {
+				f.cancel()
+				delete(m.followers, key)
+			}
+		}
+		return nil
+	}
+
+	m.pods[name] = pod
+	if pod.Spec.NodeName != "" {
+		m.nodes[name] = pod.Spec.NodeName
+	}
+	m.sync(pod)
+	return nil
+}
+
+// placements returns the node of every pod seen so far, including deleted
+// ones.
+func (m *logMux) placements() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodes := make(map[string]string, len(m.nodes))
+	for pod, node := range m.nodes {
+		nodes[pod] = node
+	}
+	return nodes
+}
+
+// sync starts a follower for each started container of pod that is not
+// already being followed. m.mu must be held.
+func (m *logMux) sync(pod *Pod) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != m.config.Name {
+			continue
+		}
+		if status.State.Running == nil && status.State.Terminated == nil {
+			continue
+		}
+
+		key := pod.Metadata.Name + "/" + status.Name
+		if f, ok := m.followers[key]; ok {
+			if !f.done || f.restartCount == status.RestartCount {
+				continue
+			}
+		}
+
+		ctx, cancel := context.WithCancel(m.ctx)
+		f := &logFollower{
+			pod:          pod.Metadata.Name,
+			container:    status.Name,
+			restartCount: status.RestartCount,
+			cancel:       cancel,
+		}
+		m.followers[key] = f
+		go m.follow(ctx, f)
+	}
+}
+
+// running reports whether the instance f follows is still the running one.
+func (m *logMux) running(f *logFollower) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pod, ok := m.pods[f.pod]
+	if !ok {
+		return false
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == f.container {
+			return status.State.Running != nil && status.RestartCount == f.restartCount
+		}
+	}
+	return false
+}
+
+// finish marks f as done and picks up a restarted container that was seen
+// while f was still streaming.
+func (m *logMux) finish(f *logFollower) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f.done = true
+	if pod, ok := m.pods[f.pod]; ok && m.ctx.Err() == nil {
+		m.sync(pod)
+	}
+}
+
+func (m *logMux) follow(ctx context.Context, f *logFollower) {
+	defer m.finish(f)
+
+	for {
+		err := m.stream(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Printf("GET pod %s logs error: %s\n", f.pod, err)
+			time.Sleep(logRetryInterval)
+		} else {
+			time.Sleep(logReconnectDelay)
+		}
+		if !m.running(f) {
+			m.flush(f)
+			return
+		}
+	}
+}
+
+// flush writes the partial line of f once its container has stopped, since
+// no stream will end it.
+func (m *logMux) flush(f *logFollower) {
+	if f.partial == "" {
+		return
+	}
+	atLast := f.partialAtLast
+	line, ok := f.accept(f.partial, &atLast)
+	if ok {
+		if f.partialTruncated {
+			line += " [truncated]"
+		}
+		m.writeLine(f.pod, line)
+	}
+	f.partial = ""
+}
+
+func (m *logMux) stream(ctx context.Context, f *logFollower) error {
+	v := url.Values{}
+	v.Set("follow", "true")
+	v.Set("container", f.container)
+	v.Set("timestamps", "true")
+	if !f.last.IsZero() {
+		// sinceTime only has second precision, so this asks for some lines
+		// that were already written; accept drops them.
+		v.Set("sinceTime", f.last.UTC().Format(time.RFC3339))
+	}
+
+	path := fmt.Sprintf(logsEndpoint, m.config.Namespace, f.pod)
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(resp.Status + ": " + string(data))
+	}
+
+	reader := bufio.NewReaderSize(resp.Body, 64*1024)
+	atLast := 0
+	for {
+		text, truncated, err := readLogLine(reader)
+		if err != nil {
+			f.partial, f.partialTruncated, f.partialAtLast = text, truncated, atLast
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		f.partial = ""
+		line, ok := f.accept(text, &atLast)
+		if ok {
+			if truncated {
+				line += " [truncated]"
+			}
+			m.writeLine(f.pod, line)
+		}
+	}
+}
+
+// readLogLine reads a line from r without its newline. With an error, the
+// line is what was read of it before the stream ended. Lines longer than
+// maxLogLine are cut short and the rest is skipped, so the timestamp at the
+// start still moves the resume point past them.
+func readLogLine(r *bufio.Reader) (string, bool, error) {
+	line := make([]byte, 0)
+	truncated := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+		if room := maxLogLine - len(line); len(chunk) > room {
+			chunk = chunk[:room]
+			truncated = true
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), truncated, err
+		}
+	}
+}
+
+func (m *logMux) writeLine(pod, line string) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	fmt.Fprintf(m.w, "[%s] %s\n", pod, line)
+}
@@ -0,0 +1,191 @@
+package kargo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// manifest is one object Create submits, along with the collection it is
+// created in.
+type manifest struct {
+	kind           string
+	collectionPath string
+	name           string
+	object         interface{}
+}
+
+// buildManifests returns every object of a run, in the order they are
+// created: whatever the pods mount first, then the workers.
+func buildManifests(versions apiVersions, config DeploymentConfig) []manifest {
+	manifests := configMapManifests(config)
+	if config.heartbeat != "" {
+		manifests = append(manifests, heartbeatManifest(config))
+	}
+	if config.BinaryToken != "" {
+		manifests = append(manifests, binaryTokenManifest(config))
+	}
+	manifests = append(manifests, daemonSetManifests(versions, config)...)
+	if config.Job != nil {
+		manifests = append(manifests, jobManifest(versions, config))
+	} else {
+		manifests = append(manifests, deploymentManifest(versions, config))
+	}
+	if config.CleanupServiceAccount != "" {
+		manifests = append(manifests, cleanupJobManifest(versions, config))
+	}
+	return manifests
+}
+
+// renderOnly is true when --dry-run only writes manifests out, which needs
+// no API server.
+func renderOnly() bool {
+	return DryRun && !serverDryRun
+}
+
+// dryRun writes manifests to --output instead of creating them, after
+// validating them with the API server if --server-dry-run is set.
+func dryRun(manifests []manifest) error {
+	if serverDryRun {
+		for _, m := range manifests {
+			err := validateManifest(m)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if outputPath == "" || outputPath == "-" {
+		return writeManifests(os.Stdout, manifests, outputFormat)
+	}
+	return writeManifestFiles(outputPath, manifests, outputFormat)
+}
+
+func renderManifest(m manifest, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(m.object, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "json":
+		return append(data, '\n'), nil
+	case "yaml":
+		return yaml.JSONToYAML(data)
+	}
+	return nil, fmt.Errorf("unknown output format %q, expected yaml or json", format)
+}
+
+// writeManifests writes manifests to w as a multi-document YAML stream, or as
+// a JSON List that kubectl accepts.
+func writeManifests(w io.Writer, manifests []manifest, format string) error {
+	if format == "json" {
+		list := struct {
+			ApiVersion string        `json:"apiVersion"`
+			Kind       string        `json:"kind"`
+			Items      []interface{} `json:"items"`
+		}{"v1", "List", make([]interface{}, 0, len(manifests))}
+		for _, m := range manifests {
+			list.Items = append(list.Items, m.object)
+		}
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+
+	for i, m := range manifests {
+		data, err := renderManifest(m, format)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeManifestFiles writes each manifest to its own file in dir, numbered in
+// the order they are created.
+func writeManifestFiles(dir string, manifests []manifest, format string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for i, m := range manifests {
+		data, err := renderManifest(m, format)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%02d-%s-%s.%s", i, strings.ToLower(m.kind), m.name, format)
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	}
+	return nil
+}
+
+// validateManifest submits m with dryRun=All, so the API server runs
+// admission and validation without persisting anything.
+func validateManifest(m manifest) error {
+	var b strings.Builder
+	err := json.NewEncoder(&b).Encode(m.object)
+	if err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	v.Set("dryRun", "All")
+
+	request := &http.Request{
+		Body:          ioutil.NopCloser(strings.NewReader(b.String())),
+		ContentLength: int64(b.Len()),
+		Header:        make(http.Header),
+		Method:        http.MethodPost,
+		URL: &url.URL{
+			Path:     m.collectionPath,
+			RawQuery: v.Encode(),
+		},
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200, 201:
+		fmt.Fprintf(os.Stderr, "%s %s is valid\n", m.kind, m.name)
+		return nil
+	case 409:
+		fmt.Fprintf(os.Stderr, "%s %s is valid but already exists\n", m.kind, m.name)
+		return nil
+	}
+
+	var status Status
+	data, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(data, &status) == nil && status.Message != "" {
+		return errors.New(m.kind + " " + m.name + " is invalid: " + status.Message)
+	}
+	return errors.New(m.kind + " " + m.name + " dry run error non 200 reponse: " + resp.Status)
+}
@@ -0,0 +1,134 @@
+package kargo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Waiting reasons that mean a container will not start without intervention.
+var failedWaitingReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+func podReady(pod *Pod) bool {
+	if pod.Status.Phase == "Succeeded" {
+		return true
+	}
+	if pod.Status.Phase != "Running" {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == "Ready" {
+			return condition.Status == "True"
+		}
+	}
+	return false
+}
+
+// podProblem describes why a pod is not starting, in the same terms kubectl
+// get pods uses, or returns "" if nothing is wrong with it yet.
+func podProblem(pod *Pod) string {
+	if pod.Status.Phase == "Failed" {
+		return strings.TrimSpace(fmt.Sprintf("%s %s", pod.Status.Reason, pod.Status.Message))
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if problem := containerProblem(status); problem != "" {
+			return "Init:" + problem
+		}
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			return fmt.Sprintf("Init:Error: %s exited with code %d: %s", status.Name, terminated.ExitCode, terminated.Message)
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if problem := containerProblem(status); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+func containerProblem(status ContainerStatus) string {
+	waiting := status.State.Waiting
+	if waiting == nil || !failedWaitingReasons[waiting.Reason] {
+		return ""
+	}
+
+	problem := fmt.Sprintf("%s: %s", waiting.Reason, status.Name)
+	if waiting.Message != "" {
+		problem += ": " + waiting.Message
+	}
+	if last := status.LastTerminationState.Terminated; last != nil {
+		problem += fmt.Sprintf(" (last exit code %d", last.ExitCode)
+		if last.Message != "" {
+			problem += ": " + strings.TrimSpace(last.Message)
+		}
+		problem += ")"
+	}
+	return problem
+}
+
+// waitForPods blocks until n pods of the deployment are Running and Ready, or
+// timeout passes, printing progress. Pods that fail to start are printed by
+// the run's diagnostics as they are seen, and listed in the timeout error.
+func waitForPods(config DeploymentConfig, n int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ready := make(map[string]bool)
+	problems := make(map[string]string)
+	lastReady := -1
+
+	err := watchPods(ctx, config.Namespace, podSelector(config), func(eventType string, pod *Pod) error {
+		name := pod.Metadata.Name
+		if eventType == "DELETED" {
+			delete(ready, name)
+			delete(problems, name)
+		} else {
+			ready[name] = podReady(pod)
+			problems[name] = podProblem(pod)
+		}
+
+		count := 0
+		for _, isReady := range ready {
+			if isReady {
+				count++
+			}
+		}
+		if count != lastReady {
+			fmt.Printf("%d/%d %s pods ready\n", count, n, config.Name)
+			lastReady = count
+		}
+		if count >= n {
+			return errStopWatch
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		return nil
+	}
+
+	failing := make([]string, 0)
+	for name, problem := range problems {
+		if problem != "" {
+			failing = append(failing, name+": "+problem)
+		}
+	}
+	sort.Strings(failing)
+	if len(failing) > 0 {
+		return fmt.Errorf("timed out after %s waiting for %d ready pods; failing pods:\n%s", timeout, n, strings.Join(failing, "\n"))
+	}
+	return fmt.Errorf("timed out after %s waiting for %d ready pods", timeout, n)
+}
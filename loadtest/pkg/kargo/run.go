@@ -0,0 +1,76 @@
+package kargo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Every object kargo creates carries the ID of the run that created it, who
+// started the run, and when its resources may be garbage collected.
+const (
+	runIDLabel        = "kargo.io/run-id"
+	ownerLabel        = "kargo.io/owner"
+	expiresAnnotation = "kargo.io/expires-at"
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+// runOwner identifies who started the run as a valid label value.
+func runOwner() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	host, err := os.Hostname()
+	if err == nil {
+		user += "." + host
+	}
+
+	owner := strings.Trim(invalidLabelChars.ReplaceAllString(user, "-"), "-_.")
+	if len(owner) > 63 {
+		owner = strings.Trim(owner[:63], "-_.")
+	}
+	return owner
+}
+
+func mergeLabels(maps ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, m := range maps {
+		for key, value := range m {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// objectLabels returns labels plus the labels that mark an object as created
+// by kargo for this run.
+func objectLabels(config DeploymentConfig, labels map[string]string) map[string]string {
+	return mergeLabels(labels, map[string]string{
+		managedByLabel: managedByKargo,
+		runIDLabel:     config.runID,
+		ownerLabel:     config.owner,
+	})
+}
+
+// podSelector selects the worker pods of this run alone, and not those of an
+// earlier run of the same name that are still shutting down.
+func podSelector(config DeploymentConfig) string {
+	return selectorString(mergeLabels(config.Labels, map[string]string{runIDLabel: config.runID}))
+}
+
+func objectAnnotations(config DeploymentConfig, annotations map[string]string) map[string]string {
+	return mergeLabels(annotations, map[string]string{
+		expiresAnnotation: config.expiresAt.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,546 @@
+package kargo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Objects are sent without hashing them first, which S3 and MinIO allow when
+// the payload is marked as unsigned.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// The hash of an empty payload, for requests without a body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store keeps objects in an S3 bucket, or in a bucket of an S3 compatible
+// store such as MinIO. Requests are signed with AWS Signature Version 4.
+type s3Store struct {
+	bucket   string
+	endpoint *url.URL
+	// pathStyle puts the bucket in the path rather than the host name, as
+	// S3 compatible stores expect.
+	pathStyle bool
+	region    string
+	public    bool
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time
+}
+
+// newS3Store uses AWS S3 in region, us-east-1 by default, unless endpoint
+// names another store.
+func newS3Store(bucket, endpoint, region string, public bool) (*s3Store, error) {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	s := &s3Store{
+		bucket:       bucket,
+		region:       region,
+		public:       public,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       http.DefaultClient,
+		now:          time.Now,
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("the S3 artifact store needs $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+
+	if endpoint == "" {
+		s.endpoint = &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+		return s, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	s.endpoint = u
+	s.pathStyle = true
+	return s, nil
+}
+
+// objectURL is the URL of name in the bucket, or of the bucket itself when
+// name is empty.
+func (s *s3Store) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + name
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + name
+	}
+	return &u
+}
+
+func (s *s3Store) URL(name string) string {
+	return s.objectURL(name).String()
+}
+
+func (s *s3Store) Exists(name string) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.objectURL(name), nil, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, &statusError{resp.StatusCode, "Head object error non 200 reponse: " + resp.Status}
+}
+
+// Put creates the bucket if it does not exist yet, and uploads the object
+// with its metadata as x-amz-meta- headers. Objects larger than
+// uploadChunkSize are sent as a multipart upload.
+func (s *s3Store) Put(name string, r io.ReaderAt, size int64, metadata map[string]string) error {
+	err := s.createBucket()
+	if err != nil {
+		return err
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/octet-stream")
+	for key, value := range metadata {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+	if s.public {
+		header.Set("X-Amz-Acl", "public-read")
+	}
+	if size > uploadChunkSize {
+		return s.putMultipart(name, r, size, header)
+	}
+
+	return withRetries("Upload of "+name, func() error {
+		resp, err := s.do(http.MethodPut, s.objectURL(name), io.NewSectionReader(r, 0, size), size, header)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			return s3Error("Put object", resp)
+		}
+		return nil
+	})
+}
+
+func (s *s3Store) createBucket() error {
+	resp, err := s.do(http.MethodHead, s.objectURL(""), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return nil
+	}
+	if resp.StatusCode != 404 {
+		return &statusError{resp.StatusCode, "Head bucket error non 200 reponse: " + resp.Status}
+	}
+
+	var body io.Reader
+	var size int64
+	if s.region != "us-east-1" {
+		configuration := fmt.Sprintf(`<CreateBucketConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><LocationConstraint>%s</LocationConstraint></CreateBucketConfiguration>`, s.region)
+		body = strings.NewReader(configuration)
+		size = int64(len(configuration))
+	}
+	fmt.Printf("Creating the %s bucket...\n", s.bucket)
+	resp, err = s.do(http.MethodPut, s.objectURL(""), body, size, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return s3Error("Create bucket", resp)
+	}
+	return nil
+}
+
+func s3Error(what string, resp *http.Response) error {
+	data, _ := ioutil.ReadAll(resp.Body)
+	return &statusError{resp.StatusCode, fmt.Sprintf("%s error non 200 reponse: %s: %s", what, resp.Status, strings.TrimSpace(string(data)))}
+}
+
+// do sends a signed request. A body is sent as an unsigned payload.
+func (s *s3Store) do(method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	request, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = size
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = unsignedPayload
+	}
+	s.sign(request, payloadHash, s.now())
+	return s.client.Do(request)
+}
+
+// sign adds AWS Signature Version 4 headers to request, signing every header
+// it already has.
+func (s *s3Store) sign(request *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for key, values := range request.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		awsURIEncode(request.URL.Path, false),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	signature := s.signature(canonicalRequest, amzDate)
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, s.scope(amzDate), signedHeaders, signature))
+}
+
+func (s *s3Store) Public() bool {
+	return s.public
+}
+
+// SignedURL is a presigned GET of name that is valid for ttl, so that workers
+// can download a private object.
+func (s *s3Store) SignedURL(name string, ttl time.Duration) (string, error) {
+	return s.presign(s.objectURL(name), ttl, s.now()), nil
+}
+
+func (s *s3Store) presign(u *url.URL, ttl time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(amzDate))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if s.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		awsURIEncode(u.Path, false),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(canonicalRequest, amzDate))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+	return signed.String()
+}
+
+func (s *s3Store) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature signs canonicalRequest with a key derived from the secret key
+// for the day of amzDate.
+func (s *s3Store) signature(canonicalRequest, amzDate string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + s.scope(amzDate) + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes every byte but unreserved characters, and
+// slashes unless encodeSlash is set, as Signature Version 4 requires.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+// putMultipart uploads r in parts of uploadChunkSize, each retried on its
+// own. A failed upload is left for the next run to resume: an unfinished
+// upload of the same object is picked up, and the parts it already holds are
+// not sent again. Buckets should abort incomplete uploads after a few days.
+//
+// An upload keeps the ACL and metadata of the run that created it, which S3
+// does not report, so a resumed upload is copied onto itself afterwards with
+// this run's.
+func (s *s3Store) putMultipart(name string, r io.ReaderAt, size int64, header http.Header) error {
+	uploadID, uploaded, err := s.findUpload(name)
+	if err != nil {
+		return err
+	}
+	resumed := uploadID != ""
+	if !resumed {
+		uploadID, err = s.createUpload(name, header)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Resuming the upload of %s, %d parts were already uploaded\n", name, len(uploaded))
+	}
+
+	parts := make([]s3Part, 0)
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+uploadChunkSize {
+		partSize := uploadChunkSize
+		if offset+partSize > size {
+			partSize = size - offset
+		}
+		section := io.NewSectionReader(r, offset, partSize)
+
+		if part, ok := uploaded[number]; ok && part.Size == partSize {
+			h := md5.New()
+			_, err := io.Copy(h, section)
+			if err == nil && strings.Trim(part.ETag, `"`) == hex.EncodeToString(h.Sum(nil)) {
+				parts = append(parts, s3Part{PartNumber: number, ETag: part.ETag})
+				continue
+			}
+		}
+
+		var etag string
+		err := withRetries(fmt.Sprintf("Upload of part %d of %s", number, name), func() error {
+			u := s.objectURL(name)
+			u.RawQuery = url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}.Encode()
+			resp, err := s.do(http.MethodPut, u, io.NewSectionReader(r, offset, partSize), partSize, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != 200 {
+				return s3Error("Upload part", resp)
+			}
+			etag = resp.Header.Get("ETag")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		parts = append(parts, s3Part{PartNumber: number, ETag: etag})
+	}
+	err = s.completeUpload(name, uploadID, parts)
+	if err != nil || !resumed {
+		return err
+	}
+	return s.replaceHeaders(name, header)
+}
+
+// replaceHeaders copies name onto itself with the metadata and ACL in header.
+// A copy without an X-Amz-Acl header is private. Copies are limited to 5 GiB,
+// far more than a worker binary.
+func (s *s3Store) replaceHeaders(name string, header http.Header) error {
+	copyHeader := header.Clone()
+	copyHeader.Set("X-Amz-Copy-Source", "/"+s.bucket+"/"+awsURIEncode(name, false))
+	copyHeader.Set("X-Amz-Metadata-Directive", "REPLACE")
+	return withRetries("Copy of "+name, func() error {
+		resp, err := s.do(http.MethodPut, s.objectURL(name), nil, 0, copyHeader)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// As with completing an upload, S3 can report a failure after
+		// sending 200.
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 || bytes.Contains(data, []byte("<Error>")) {
+			return &statusError{500, fmt.Sprintf("Copy object error non 200 reponse: %s: %s", resp.Status, strings.TrimSpace(string(data)))}
+		}
+		return nil
+	})
+}
+
+// findUpload returns the ID of an unfinished upload of name and the parts it
+// holds, or "" if there is none.
+func (s *s3Store) findUpload(name string) (string, map[int]s3Part, error) {
+	var uploads struct {
+		Upload []struct {
+			Key      string `xml:"Key"`
+			UploadID string `xml:"UploadId"`
+		} `xml:"Upload"`
+	}
+	u := s.objectURL("")
+	u.RawQuery = url.Values{"uploads": {""}, "prefix": {name}}.Encode()
+	err := s.getXML("List uploads", u, &uploads)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, upload := range uploads.Upload {
+		if upload.Key != name {
+			continue
+		}
+		var list struct {
+			Part []s3Part `xml:"Part"`
+		}
+		u := s.objectURL(name)
+		u.RawQuery = url.Values{"uploadId": {upload.UploadID}}.Encode()
+		err := s.getXML("List parts", u, &list)
+		if err != nil {
+			return "", nil, err
+		}
+		parts := make(map[int]s3Part)
+		for _, part := range list.Part {
+			parts[part.PartNumber] = part
+		}
+		return upload.UploadID, parts, nil
+	}
+	return "", nil, nil
+}
+
+func (s *s3Store) createUpload(name string, header http.Header) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	u := s.objectURL(name)
+	u.RawQuery = "uploads="
+	err := withRetries("Create upload of "+name, func() error {
+		resp, err := s.do(http.MethodPost, u, nil, 0, header)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return s3Error("Create upload", resp)
+		}
+		return xml.NewDecoder(resp.Body).Decode(&result)
+	})
+	if err == nil && result.UploadID == "" {
+		err = errors.New("Create upload error: no upload ID in the response")
+	}
+	return result.UploadID, err
+}
+
+func (s *s3Store) completeUpload(name, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []s3Part `xml:"Part"`
+	}{Part: parts})
+	if err != nil {
+		return err
+	}
+
+	u := s.objectURL(name)
+	u.RawQuery = url.Values{"uploadId": {uploadID}}.Encode()
+	return withRetries("Complete upload of "+name, func() error {
+		resp, err := s.do(http.MethodPost, u, bytes.NewReader(body), int64(len(body)), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// S3 can report a failure after sending 200.
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 || bytes.Contains(data, []byte("<Error>")) {
+			return &statusError{500, fmt.Sprintf("Complete upload error non 200 reponse: %s: %s", resp.Status, strings.TrimSpace(string(data)))}
+		}
+		return nil
+	})
+}
+
+// getXML decodes the response to a signed GET of u into v.
+func (s *s3Store) getXML(what string, u *url.URL, v interface{}) error {
+	return withRetries(what, func() error {
+		resp, err := s.do(http.MethodGet, u, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return s3Error(what, resp)
+		}
+		return xml.NewDecoder(resp.Body).Decode(v)
+	})
+}
@@ -0,0 +1,149 @@
+package kargo
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScalingStep runs Replicas workers for Hold once they are ready. A step with
+// no Hold lasts until the run ends.
+type ScalingStep struct {
+	Replicas int
+	Hold     time.Duration
+}
+
+// ScalingEvent records one step of a scaling plan as it was carried out.
+type ScalingEvent struct {
+	Step     int
+	Replicas int
+	Started  time.Time
+	Ready    time.Time
+	Err      error
+}
+
+var (
+	scalingStepPattern = regexp.MustCompile(`^(\d+)(?:@(\S+))?$`)
+	scalingRampPattern = regexp.MustCompile(`^(linear|exp):(\d+)-(\d+)([+*])(\d+)@(\S+)$`)
+)
+
+// ParseScalingPlan parses a plan written either as a list of steps,
+// "1@30s,5@1m,10", or as a ramp from one replica count to another with a
+// hold at each step: "linear:1-10+1@30s" adds one replica at a time and
+// "exp:1-64*2@1m" doubles them. The last step of a list may leave out its
+// hold to keep running until the run ends.
+func ParseScalingPlan(s string) ([]ScalingStep, error) {
+	s = strings.TrimSpace(s)
+	if m := scalingRampPattern.FindStringSubmatch(s); m != nil {
+		return parseScalingRamp(m)
+	}
+	if strings.Contains(s, ":") {
+		return nil, fmt.Errorf("invalid scaling plan %q, expected linear:from-to+step@hold or exp:from-to*factor@hold", s)
+	}
+
+	steps := make([]ScalingStep, 0)
+	parts := strings.Split(s, ",")
+	for i, part := range parts {
+		m := scalingStepPattern.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil {
+			return nil, fmt.Errorf("invalid scaling step %q, expected replicas@hold", part)
+		}
+		replicas, _ := strconv.Atoi(m[1])
+		step := ScalingStep{Replicas: replicas}
+		if m[2] != "" {
+			hold, err := time.ParseDuration(m[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid scaling step %q: %s", part, err)
+			}
+			step.Hold = hold
+		}
+		if step.Hold <= 0 && i != len(parts)-1 {
+			return nil, fmt.Errorf("invalid scaling step %q, only the last step can run without a hold", part)
+		}
+		steps = append(steps, step)
+	}
+	return steps, validateScalingPlan(steps)
+}
+
+func parseScalingRamp(m []string) ([]ScalingStep, error) {
+	from, _ := strconv.Atoi(m[2])
+	if from < 1 {
+		return nil, errors.New("every scaling step needs at least 1 replica")
+	}
+	to, _ := strconv.Atoi(m[3])
+	if from > to {
+		return nil, fmt.Errorf("invalid scaling ramp from %d down to %d, ramps only scale up", from, to)
+	}
+	by, _ := strconv.Atoi(m[5])
+	if m[1] == "linear" && by < 1 {
+		return nil, errors.New("linear scaling needs a step of at least 1")
+	}
+	if m[1] == "exp" && by < 2 {
+		return nil, errors.New("exponential scaling needs a factor of at least 2")
+	}
+	hold, err := time.ParseDuration(m[6])
+	if err != nil {
+		return nil, fmt.Errorf("invalid scaling hold %q: %s", m[6], err)
+	}
+	if hold <= 0 {
+		return nil, errors.New("scaling ramps need a hold greater than zero")
+	}
+
+	steps := make([]ScalingStep, 0)
+	replicas := from
+	for {
+		steps = append(steps, ScalingStep{Replicas: replicas, Hold: hold})
+		if replicas >= to {
+			break
+		}
+		if m[1] == "linear" {
+			replicas += by
+		} else {
+			replicas *= by
+		}
+		if replicas > to {
+			replicas = to
+		}
+	}
+	return steps, validateScalingPlan(steps)
+}
+
+func validateScalingPlan(steps []ScalingStep) error {
+	if len(steps) == 0 {
+		return errors.New("scaling plan has no steps")
+	}
+	for _, step := range steps {
+		if step.Replicas < 1 {
+			return errors.New("every scaling step needs at least 1 replica")
+		}
+	}
+	return nil
+}
+
+// RunScalingPlan carries out config.ScalingPlan with the workers b created
+// from config. Each step scales the workers, waits for them to be ready,
+// calls notify, and then holds. It returns once the last step's hold is over,
+// or as soon as the last step is ready if it has no hold.
+func RunScalingPlan(b Backend, config DeploymentConfig, notify func(ScalingEvent)) {
+	plan := config.ScalingPlan
+	for i, step := range plan {
+		event := ScalingEvent{Step: i + 1, Replicas: step.Replicas, Started: time.Now()}
+		if i > 0 {
+			fmt.Printf("Scaling to %d replicas (step %d/%d)\n", step.Replicas, i+1, len(plan))
+			event.Err = b.Scale(config, step.Replicas)
+		}
+		if event.Err == nil {
+			event.Err = b.WaitReady(step.Replicas)
+		}
+		if event.Err != nil {
+			fmt.Println(event.Err)
+		}
+		event.Ready = time.Now()
+		notify(event)
+
+		time.Sleep(step.Hold)
+	}
+}
@@ -0,0 +1,56 @@
+package kargo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScalingPlan(t *testing.T) {
+	tests := []struct {
+		plan  string
+		steps []ScalingStep
+		err   string
+	}{
+		{"3", []ScalingStep{{3, 0}}, ""},
+		{"1@30s, 5@1m,10", []ScalingStep{{1, 30 * time.Second}, {5, time.Minute}, {10, 0}}, ""},
+		{"1@30s,5@1m", []ScalingStep{{1, 30 * time.Second}, {5, time.Minute}}, ""},
+		{"linear:1-10+4@30s", []ScalingStep{{1, 30 * time.Second}, {5, 30 * time.Second}, {9, 30 * time.Second}, {10, 30 * time.Second}}, ""},
+		{"exp:1-20*2@1m", []ScalingStep{{1, time.Minute}, {2, time.Minute}, {4, time.Minute}, {8, time.Minute}, {16, time.Minute}, {20, time.Minute}}, ""},
+		{"linear:5-5+1@30s", []ScalingStep{{5, 30 * time.Second}}, ""},
+
+		{"1,5@1m", nil, "only the last step can run without a hold"},
+		{"1@0s,5", nil, "only the last step can run without a hold"},
+		{"0", nil, "at least 1 replica"},
+		{"1@30s,0", nil, "at least 1 replica"},
+		{"linear:0-10+1@30s", nil, "at least 1 replica"},
+		{"linear:10-1+1@30s", nil, "ramps only scale up"},
+		{"exp:64-1*2@1m", nil, "ramps only scale up"},
+		{"linear:1-10+0@30s", nil, "a step of at least 1"},
+		{"exp:1-10*1@30s", nil, "a factor of at least 2"},
+		{"exp:5-5*1@30s", nil, "a factor of at least 2"},
+		{"linear:1-10+1@0s", nil, "a hold greater than zero"},
+		{"linear:1-10+1@soon", nil, "invalid scaling hold"},
+		{"log:1-10+1@30s", nil, "expected linear:from-to+step@hold"},
+		{"1@soon", nil, "invalid scaling step"},
+		{"1@30s,,5", nil, "invalid scaling step"},
+		{"", nil, "invalid scaling step"},
+	}
+	for _, test := range tests {
+		steps, err := ParseScalingPlan(test.plan)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want one containing %q", test.plan, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.plan, err)
+			continue
+		}
+		if !reflect.DeepEqual(steps, test.steps) {
+			t.Errorf("%q: got %v, want %v", test.plan, steps, test.steps)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package kargo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	HostnameTopologyKey = "kubernetes.io/hostname"
+	ZoneTopologyKey     = "topology.kubernetes.io/zone"
+
+	// Clusters older than Kubernetes 1.17 only label nodes with this.
+	legacyZoneTopologyKey = "failure-domain.beta.kubernetes.io/zone"
+)
+
+var nodeEndpoint = "/api/v1/nodes/%s"
+
+// Placement is where one worker pod ran.
+type Placement struct {
+	Pod  string
+	Node string
+	Zone string
+}
+
+// SpreadConstraints spreads workers evenly over the values of each of
+// topologyKeys, such as HostnameTopologyKey or ZoneTopologyKey. Workers are
+// still scheduled when the cluster cannot spread them evenly.
+func SpreadConstraints(topologyKeys ...string) []TopologySpreadConstraint {
+	constraints := make([]TopologySpreadConstraint, 0, len(topologyKeys))
+	for _, key := range topologyKeys {
+		constraints = append(constraints, TopologySpreadConstraint{
+			MaxSkew:           1,
+			TopologyKey:       key,
+			WhenUnsatisfiable: "ScheduleAnyway",
+		})
+	}
+	return constraints
+}
+
+// NodeAntiAffinity keeps workers off nodes that already run one. Unless
+// required is set, workers share nodes once every node has one.
+func NodeAntiAffinity(required bool) *Affinity {
+	term := PodAffinityTerm{TopologyKey: HostnameTopologyKey}
+	if required {
+		return &Affinity{PodAntiAffinity: &PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []PodAffinityTerm{term},
+		}}
+	}
+	return &Affinity{PodAntiAffinity: &PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []WeightedPodAffinityTerm{
+			{Weight: 100, PodAffinityTerm: term},
+		},
+	}}
+}
+
+// ParseNodeSelector parses a comma separated list of key=value node labels.
+func ParseNodeSelector(s string) (map[string]string, error) {
+	selector := make(map[string]string)
+	if s == "" {
+		return selector, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid node selector %q, expected key=value", pair)
+		}
+		selector[kv[0]] = kv[1]
+	}
+	return selector, nil
+}
+
+// ParseTolerations parses a comma separated list of taints to tolerate, each
+// written as kubectl taint does: key[=value]:effect. An empty effect
+// tolerates every effect, and a key without a value tolerates any value.
+func ParseTolerations(s string) ([]Toleration, error) {
+	tolerations := make([]Toleration, 0)
+	if s == "" {
+		return tolerations, nil
+	}
+	for _, taint := range strings.Split(s, ",") {
+		parts := strings.SplitN(taint, ":", 2)
+		toleration := Toleration{Operator: "Exists"}
+		if len(parts) == 2 {
+			toleration.Effect = parts[1]
+		}
+		kv := strings.SplitN(parts[0], "=", 2)
+		toleration.Key = kv[0]
+		if len(kv) == 2 {
+			toleration.Operator = "Equal"
+			toleration.Value = kv[1]
+		}
+		if toleration.Key == "" {
+			return nil, fmt.Errorf("invalid toleration %q, expected key[=value]:effect", taint)
+		}
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations, nil
+}
+
+// applyScheduling copies the scheduling controls of config onto spec. Pod
+// affinity terms and spread constraints without a label selector select the
+// pods of this run. With config.ArchAffinity, pods are only scheduled on
+// nodes of the architectures of config.Binaries.
+func applyScheduling(spec *PodSpec, config DeploymentConfig) {
+	spec.NodeSelector = config.NodeSelector
+	spec.Tolerations = config.Tolerations
+
+	runSelector := &LabelSelector{MatchLabels: config.Labels}
+	if config.Affinity != nil {
+		affinity := *config.Affinity
+		if a := affinity.PodAffinity; a != nil {
+			affinity.PodAffinity = &PodAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution:  withSelector(a.RequiredDuringSchedulingIgnoredDuringExecution, runSelector),
+				PreferredDuringSchedulingIgnoredDuringExecution: withWeightedSelector(a.PreferredDuringSchedulingIgnoredDuringExecution, runSelector),
+			}
+		}
+		if a := affinity.PodAntiAffinity; a != nil {
+			affinity.PodAntiAffinity = &PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution:  withSelector(a.RequiredDuringSchedulingIgnoredDuringExecution, runSelector),
+				PreferredDuringSchedulingIgnoredDuringExecution: withWeightedSelector(a.PreferredDuringSchedulingIgnoredDuringExecution, runSelector),
+			}
+		}
+		spec.Affinity = &affinity
+	}
+	if config.ArchAffinity && len(config.Binaries) > 0 {
+		spec.Affinity = archAffinity(spec.Affinity, config.Binaries)
+	}
+
+	if len(config.TopologySpreadConstraints) > 0 {
+		constraints := make([]TopologySpreadConstraint, 0, len(config.TopologySpreadConstraints))
+		for _, constraint := range config.TopologySpreadConstraints {
+			if constraint.LabelSelector == nil {
+				constraint.LabelSelector = runSelector
+			}
+			constraints = append(constraints, constraint)
+		}
+		spec.TopologySpreadConstraints = constraints
+	}
+}
+
+func withSelector(terms []PodAffinityTerm, selector *LabelSelector) []PodAffinityTerm {
+	if terms == nil {
+		return nil
+	}
+	result := make([]PodAffinityTerm, 0, len(terms))
+	for _, term := range terms {
+		if term.LabelSelector == nil {
+			term.LabelSelector = selector
+		}
+		result = append(result, term)
+	}
+	return result
+}
+
+func withWeightedSelector(terms []WeightedPodAffinityTerm, selector *LabelSelector) []WeightedPodAffinityTerm {
+	if terms == nil {
+		return nil
+	}
+	result := make([]WeightedPodAffinityTerm, 0, len(terms))
+	for _, term := range terms {
+		if term.PodAffinityTerm.LabelSelector == nil {
+			term.PodAffinityTerm.LabelSelector = selector
+		}
+		result = append(result, term)
+	}
+	return result
+}
+
+func getNode(name string) (*Node, error) {
+	var node Node
+
+	path := fmt.Sprintf(nodeEndpoint, name)
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path: path,
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Get Node error non 200 reponse: " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&node)
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func nodeZone(node *Node) string {
+	if zone, ok := node.Metadata.Labels[ZoneTopologyKey]; ok {
+		return zone
+	}
+	return node.Metadata.Labels[legacyZoneTopologyKey]
+}
+
+// Placements returns the node and zone of every worker pod of the run that
+// has been scheduled, including pods that have since been deleted if logs
+// are being followed. The zone is empty if it cannot be looked up.
+func (dm *DeploymentManager) Placements() ([]Placement, error) {
+	nodes := make(map[string]string)
+	if dm.logs != nil {
+		for pod, node := range dm.logs.placements() {
+			nodes[pod] = node
+		}
+	}
+
+	podList, err := getPods(dm.config.Namespace, podSelector(dm.config))
+	if err != nil && err != ErrNotExist {
+		return nil, err
+	}
+	if podList != nil {
+		for _, pod := range podList.Items {
+			if pod.Spec.NodeName != "" {
+				nodes[pod.Metadata.Name] = pod.Spec.NodeName
+			}
+		}
+	}
+
+	zones := make(map[string]string)
+	placements := make([]Placement, 0, len(nodes))
+	for pod, nodeName := range nodes {
+		zone, ok := zones[nodeName]
+		if !ok {
+			node, err := getNode(nodeName)
+			if err == nil {
+				zone = nodeZone(node)
+			}
+			zones[nodeName] = zone
+		}
+		placements = append(placements, Placement{Pod: pod, Node: nodeName, Zone: zone})
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].Pod < placements[j].Pod
+	})
+	return placements, nil
+}
@@ -0,0 +1,54 @@
+package kargo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlacements(t *testing.T) {
+	dm, server := newTestManager(t)
+	server.AddNode("node-2", map[string]string{ZoneTopologyKey: "zone-b"})
+	server.AddNode("node-3", map[string]string{legacyZoneTopologyKey: "zone-c"})
+
+	config := testConfig(3)
+	config.TopologySpreadConstraints = SpreadConstraints(ZoneTopologyKey)
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dm.WaitReady(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placements, err := dm.Placements()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones := make(map[string]string)
+	for _, p := range placements {
+		zones[p.Node] = p.Zone
+	}
+	want := map[string]string{"node-1": "zone-a", "node-2": "zone-b", "node-3": "zone-c"}
+	if len(placements) != 3 || !reflect.DeepEqual(zones, want) {
+		t.Errorf("placements are %+v, want one pod on each of %v", placements, want)
+	}
+}
+
+func TestParseSchedulingFlags(t *testing.T) {
+	selector, err := ParseNodeSelector("pool=load,disk=ssd")
+	if err != nil || !reflect.DeepEqual(selector, map[string]string{"pool": "load", "disk": "ssd"}) {
+		t.Errorf("ParseNodeSelector = %v, %v", selector, err)
+	}
+	if _, err := ParseNodeSelector("pool"); err == nil {
+		t.Error("ParseNodeSelector(\"pool\") succeeded")
+	}
+
+	tolerations, err := ParseTolerations("dedicated=load:NoSchedule,spot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tolerations) != 2 || tolerations[0].Key != "dedicated" || tolerations[0].Value != "load" || tolerations[0].Effect != "NoSchedule" {
+		t.Errorf("ParseTolerations = %+v", tolerations)
+	}
+}
@@ -0,0 +1,221 @@
+package kargo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Workers learn their limits from the environment, and see the coordinator's
+// heartbeat as a ConfigMap mounted into the pod.
+const (
+	deadlineEnv         = "KARGO_DEADLINE"
+	heartbeatFileEnv    = "KARGO_HEARTBEAT_FILE"
+	heartbeatTimeoutEnv = "KARGO_HEARTBEAT_TIMEOUT"
+	idleOnStopEnv       = "KARGO_IDLE_ON_STOP"
+
+	heartbeatVolume    = "heartbeat"
+	heartbeatMountPath = "/etc/kargo/heartbeat"
+	heartbeatKey       = "heartbeat"
+)
+
+// The kubelet takes up to a minute or two to update a mounted ConfigMap, so
+// shorter heartbeat timeouts would stop healthy runs.
+const minHeartbeatTimeout = 2 * time.Minute
+
+var selfDestructPollInterval = 5 * time.Second
+
+// SelfDestruct is how long a worker keeps generating load without its
+// coordinator.
+type SelfDestruct struct {
+	// Deadline is when the run ends regardless of the coordinator.
+	Deadline time.Time
+	// HeartbeatFile is updated by the coordinator while it is running.
+	HeartbeatFile    string
+	HeartbeatTimeout time.Duration
+	// IdleOnStop means the worker should stay up without generating load once
+	// it stops, so that a Deployment does not restart it.
+	IdleOnStop bool
+}
+
+// SelfDestructFromEnv returns the limits kargo set for this worker, or nil if
+// it was not deployed with any.
+func SelfDestructFromEnv() (*SelfDestruct, error) {
+	s := &SelfDestruct{
+		HeartbeatFile: os.Getenv(heartbeatFileEnv),
+		IdleOnStop:    os.Getenv(idleOnStopEnv) == "true",
+	}
+
+	var err error
+	if deadline := os.Getenv(deadlineEnv); deadline != "" {
+		s.Deadline, err = time.Parse(time.RFC3339, deadline)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", deadlineEnv, err)
+		}
+	}
+	if timeout := os.Getenv(heartbeatTimeoutEnv); timeout != "" {
+		s.HeartbeatTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", heartbeatTimeoutEnv, err)
+		}
+	}
+
+	if s.Deadline.IsZero() && (s.HeartbeatFile == "" || s.HeartbeatTimeout <= 0) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Wait blocks until the deadline passes or the heartbeat file has not changed
+// for HeartbeatTimeout, and returns the reason. It returns "" if ctx is done
+// first.
+//
+// The heartbeat is judged by when this process last saw the file change, not
+// by the time written in it, so clock skew between the coordinator and the
+// node does not matter.
+func (s *SelfDestruct) Wait(ctx context.Context) string {
+	ticker := time.NewTicker(selfDestructPollInterval)
+	defer ticker.Stop()
+
+	var lastBeat []byte
+	lastChange := time.Now()
+	for {
+		now := time.Now()
+		if !s.Deadline.IsZero() && now.After(s.Deadline) {
+			return fmt.Sprintf("run deadline %s passed", s.Deadline.Format(time.RFC3339))
+		}
+		if s.HeartbeatFile != "" && s.HeartbeatTimeout > 0 {
+			beat, err := ioutil.ReadFile(s.HeartbeatFile)
+			if err == nil && !bytes.Equal(beat, lastBeat) {
+				lastBeat = beat
+				lastChange = now
+			}
+			if now.Sub(lastChange) > s.HeartbeatTimeout {
+				return fmt.Sprintf("no coordinator heartbeat for %s", s.HeartbeatTimeout)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-ticker.C:
+		}
+	}
+}
+
+func cleanupJobName(config DeploymentConfig) string {
+	return config.Name + "-cleanup"
+}
+
+// selfDestructEnv is the environment that tells a pod of the run when to stop
+// on its own.
+func selfDestructEnv(config DeploymentConfig) map[string]string {
+	env := make(map[string]string)
+	if config.MaxRunTime > 0 {
+		env[deadlineEnv] = config.deadline.UTC().Format(time.RFC3339)
+	}
+	if config.HeartbeatTimeout > 0 {
+		env[heartbeatFileEnv] = filepath.Join(heartbeatMountPath, heartbeatKey)
+		env[heartbeatTimeoutEnv] = config.HeartbeatTimeout.String()
+	}
+	return env
+}
+
+func heartbeatConfigMap(config DeploymentConfig) ConfigMap {
+	return ConfigMap{
+		ApiVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata: Metadata{
+			Name:        config.heartbeat,
+			Namespace:   config.Namespace,
+			Labels:      objectLabels(config, nil),
+			Annotations: objectAnnotations(config, nil),
+		},
+		Data: map[string]string{
+			heartbeatKey: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}
+}
+
+func heartbeatManifest(config DeploymentConfig) manifest {
+	path := fmt.Sprintf(configMapsEndpoint, config.Namespace)
+	return manifest{"ConfigMap", path, config.heartbeat, heartbeatConfigMap(config)}
+}
+
+// sendHeartbeats updates the heartbeat ConfigMap several times per heartbeat
+// timeout until ctx is done.
+func sendHeartbeats(ctx context.Context, config DeploymentConfig) {
+	ticker := time.NewTicker(config.HeartbeatTimeout / 4)
+	defer ticker.Stop()
+
+	path := fmt.Sprintf(configMapEndpoint, config.Namespace, config.heartbeat)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		status, data, err := sendObject(http.MethodPut, path, heartbeatConfigMap(config))
+		if err != nil {
+			fmt.Println("Heartbeat error: ", err)
+			continue
+		}
+		if status != 200 {
+			fmt.Printf("Heartbeat error: Unexpected HTTP status code %d: %s\n", status, data)
+		}
+	}
+}
+
+func deleteHeartbeat(config DeploymentConfig) error {
+	path := fmt.Sprintf(configMapEndpoint, config.Namespace, config.heartbeat)
+	return deleteInBackground(path)
+}
+
+// cleanupJobManifest is a Job that waits until the run's workers stop on
+// their own and then deletes everything labelled with the run ID. It runs the
+// loadtest binary's gc command under config.CleanupServiceAccount, which
+// needs permission to list and delete the run's objects.
+func cleanupJobManifest(versions apiVersions, config DeploymentConfig) manifest {
+	cleanup := config
+	cleanup.Name = cleanupJobName(config)
+	cleanup.Args = []string{"gc", "--run-id=" + config.runID, "--namespace=" + config.Namespace}
+	cleanup.Annotations = nil
+	cleanup.Env = selfDestructEnv(config)
+	cleanup.Labels = map[string]string{"run": cleanup.Name}
+	cleanup.Sidecars = nil
+	cleanup.InitSidecars = nil
+	cleanup.Volumes = nil
+	cleanup.VolumeMounts = nil
+
+	template := podTemplate(cleanup)
+	template.Spec.RestartPolicy = "OnFailure"
+	template.Spec.ServiceAccountName = config.CleanupServiceAccount
+
+	job := Job{
+		ApiVersion: versions.Jobs,
+		Kind:       "Job",
+		Metadata: Metadata{
+			Name:        cleanup.Name,
+			Namespace:   config.Namespace,
+			Labels:      objectLabels(config, cleanup.Labels),
+			Annotations: objectAnnotations(config, nil),
+		},
+		Spec: JobSpec{
+			Template: template,
+		},
+	}
+
+	path := fmt.Sprintf(jobsEndpoint, versions.Jobs, config.Namespace)
+	return manifest{"Job", path, cleanup.Name, job}
+}
+
+func deleteCleanupJob(versions apiVersions, config DeploymentConfig) error {
+	path := fmt.Sprintf(jobEndpoint, versions.Jobs, config.Namespace, cleanupJobName(config))
+	return deleteInBackground(path)
+}
@@ -0,0 +1,49 @@
+package kargo
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCleanupJobVolumes creates a run whose workers mount a ConfigMap, as
+// --rate does for its rate file, and checks that the cleanup Job only mounts
+// volumes it has.
+func TestCleanupJobVolumes(t *testing.T) {
+	dm, server := newTestManager(t)
+
+	config := testConfig(1)
+	config.MaxRunTime = time.Hour
+	config.CleanupServiceAccount = "kargo-cleanup"
+	config.ConfigMaps = append(config.ConfigMaps, ConfigMap{
+		Metadata: Metadata{Name: "loadtest-rate"},
+		Data:     map[string]string{"rate": "0"},
+	})
+	config.Volumes = append(config.Volumes, Volume{
+		Name:         "rate",
+		VolumeSource: VolumeSource{ConfigMap: &ConfigMapVolumeSource{Name: "loadtest-rate"}},
+	})
+	config.VolumeMounts = append(config.VolumeMounts, VolumeMount{Name: "rate", MountPath: "/etc/loadtest", ReadOnly: true})
+	config.Args = append(config.Args, "--rate-file=/etc/loadtest/rate")
+	err := dm.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var job Job
+	err = server.Decode("jobs", "default", cleanupJobName(config), &job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := job.Spec.Template.Spec
+	volumes := make(map[string]bool)
+	for _, v := range spec.Volumes {
+		volumes[v.Name] = true
+	}
+	for _, c := range append(spec.InitContainers, spec.Containers...) {
+		for _, m := range c.VolumeMounts {
+			if !volumes[m.Name] {
+				t.Errorf("cleanup container %s mounts %s, which is not a volume of the pod", c.Name, m.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package kargo
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Binaries larger than uploadChunkSize are uploaded in chunks of this size,
+// each retried on its own, where the store supports it.
+var uploadChunkSize int64 = 16 << 20
+
+// A request that fails with a network error or a server error is retried up
+// to uploadRetries times in all, waiting uploadRetryDelay and then twice as
+// long after each attempt.
+var (
+	uploadRetries    = 5
+	uploadRetryDelay = time.Second
+)
+
+// Upload progress is printed at most this often.
+var progressInterval = 2 * time.Second
+
+// statusError is an HTTP response that was not the one expected.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// temporary reports whether a request that failed with err may succeed if it
+// is sent again.
+func temporary(err error) bool {
+	switch err := err.(type) {
+	case *statusError:
+		return err.status >= 500 || err.status == 429 || err.status == 408
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+// withRetries calls f until it succeeds, fails with an error that is not
+// temporary, or has been called uploadRetries times.
+func withRetries(what string, f func() error) error {
+	delay := uploadRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= uploadRetries || !temporary(err) {
+			return err
+		}
+		fmt.Printf("%s failed, retrying in %s: %s\n", what, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// uploadProgress prints how much of a binary has been uploaded.
+type uploadProgress struct {
+	name string
+	size int64
+	out  io.Writer
+
+	mu      sync.Mutex
+	done    int64
+	printed time.Time
+}
+
+func newUploadProgress(name string, size int64) *uploadProgress {
+	return &uploadProgress{name: name, size: size, out: os.Stdout, printed: time.Now()}
+}
+
+// set records that the first done bytes have been sent. Bytes that are sent
+// again after a retry do not count twice.
+func (p *uploadProgress) set(done int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if done <= p.done {
+		return
+	}
+	p.done = done
+	if done < p.size && time.Since(p.printed) < progressInterval {
+		return
+	}
+	p.printed = time.Now()
+	percent := 100.0
+	if p.size > 0 {
+		percent = float64(done) * 100 / float64(p.size)
+	}
+	fmt.Fprintf(p.out, "Uploaded %.1f of %.1f MB of %s (%.0f%%)\n", float64(done)/(1<<20), float64(p.size)/(1<<20), p.name, percent)
+}
+
+// reader returns r with every read counted as sent.
+func (p *uploadProgress) reader(r io.ReaderAt) io.ReaderAt {
+	return &progressReaderAt{r: r, progress: p}
+}
+
+type progressReaderAt struct {
+	r        io.ReaderAt
+	progress *uploadProgress
+}
+
+func (r *progressReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(b, off)
+	r.progress.set(off + int64(n))
+	return n, err
+}
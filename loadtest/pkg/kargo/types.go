@@ -11,15 +11,19 @@
 
 package kargo
 
+import "time"
+
 type Metadata struct {
-	Name            string            `json:"name"`
-	Namespace       string            `json:"namespace"`
-	GenerateName    string            `json:"generateName"`
-	ResourceVersion string            `json:"resourceVersion"`
-	SelfLink        string            `json:"selfLink"`
-	Labels          map[string]string `json:"labels"`
-	Annotations     map[string]string `json:"annotations"`
-	Uid             string            `json:"uid"`
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	GenerateName    string            `json:"generateName,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	SelfLink        string            `json:"selfLink,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	Uid             string            `json:"uid,omitempty"`
+
+	CreationTimestamp string `json:"creationTimestamp,omitempty"`
 }
 
 type ListMetadata struct {
@@ -27,9 +31,77 @@ type ListMetadata struct {
 }
 
 type Pod struct {
-	Kind     string   `json:"kind,omitempty"`
-	Metadata Metadata `json:"metadata"`
-	Spec     PodSpec  `json:"spec"`
+	Kind     string    `json:"kind,omitempty"`
+	Metadata Metadata  `json:"metadata"`
+	Spec     PodSpec   `json:"spec"`
+	Status   PodStatus `json:"status,omitempty"`
+}
+
+type PodStatus struct {
+	Phase                 string            `json:"phase,omitempty"`
+	Reason                string            `json:"reason,omitempty"`
+	Message               string            `json:"message,omitempty"`
+	PodIP                 string            `json:"podIP,omitempty"`
+	Conditions            []PodCondition    `json:"conditions,omitempty"`
+	InitContainerStatuses []ContainerStatus `json:"initContainerStatuses,omitempty"`
+	ContainerStatuses     []ContainerStatus `json:"containerStatuses,omitempty"`
+}
+
+type PodCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type ContainerStatus struct {
+	Name                 string         `json:"name"`
+	Ready                bool           `json:"ready"`
+	RestartCount         int32          `json:"restartCount"`
+	State                ContainerState `json:"state,omitempty"`
+	LastTerminationState ContainerState `json:"lastState,omitempty"`
+}
+
+type ContainerState struct {
+	Waiting    *ContainerStateWaiting    `json:"waiting,omitempty"`
+	Running    *ContainerStateRunning    `json:"running,omitempty"`
+	Terminated *ContainerStateTerminated `json:"terminated,omitempty"`
+}
+
+type ContainerStateWaiting struct {
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type ContainerStateRunning struct {
+	StartedAt string `json:"startedAt,omitempty"`
+}
+
+type ContainerStateTerminated struct {
+	ExitCode int32  `json:"exitCode"`
+	Signal   int32  `json:"signal,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+type Event struct {
+	Kind           string          `json:"kind,omitempty"`
+	Metadata       Metadata        `json:"metadata"`
+	InvolvedObject ObjectReference `json:"involvedObject"`
+	Reason         string          `json:"reason,omitempty"`
+	Message        string          `json:"message,omitempty"`
+	Type           string          `json:"type,omitempty"`
+	Count          int32           `json:"count,omitempty"`
+	FirstTimestamp time.Time       `json:"firstTimestamp,omitempty"`
+	LastTimestamp  time.Time       `json:"lastTimestamp,omitempty"`
+}
+
+type ObjectReference struct {
+	ApiVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Uid        string `json:"uid,omitempty"`
 }
 
 type PodList struct {
@@ -46,19 +118,71 @@ type ConfigMap struct {
 	Data       map[string]string `json:"data,omitempty"`
 }
 
-type ReplicaSet struct {
+type Secret struct {
+	ApiVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   Metadata          `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	StringData map[string]string `json:"stringData,omitempty"`
+}
+
+type Deployment struct {
 	ApiVersion string         `json:"apiVersion,omitempty"`
 	Kind       string         `json:"kind,omitempty"`
 	Metadata   Metadata       `json:"metadata"`
-	Spec       ReplicaSetSpec `json:"spec"`
+	Spec       DeploymentSpec `json:"spec"`
 }
 
-type ReplicaSetSpec struct {
+type DeploymentSpec struct {
 	Replicas int64         `json:"replicas,omitempty"`
 	Selector LabelSelector `json:"selector,omitempty"`
 	Template PodTemplate   `json:"template,omitempty"`
 }
 
+type DaemonSet struct {
+	ApiVersion string        `json:"apiVersion,omitempty"`
+	Kind       string        `json:"kind,omitempty"`
+	Metadata   Metadata      `json:"metadata"`
+	Spec       DaemonSetSpec `json:"spec"`
+}
+
+type DaemonSetSpec struct {
+	Selector LabelSelector `json:"selector,omitempty"`
+	Template PodTemplate   `json:"template,omitempty"`
+}
+
+type Job struct {
+	ApiVersion string    `json:"apiVersion,omitempty"`
+	Kind       string    `json:"kind,omitempty"`
+	Metadata   Metadata  `json:"metadata"`
+	Spec       JobSpec   `json:"spec"`
+	Status     JobStatus `json:"status,omitempty"`
+}
+
+type JobSpec struct {
+	Parallelism           *int32        `json:"parallelism,omitempty"`
+	Completions           *int32        `json:"completions,omitempty"`
+	ActiveDeadlineSeconds *int64        `json:"activeDeadlineSeconds,omitempty"`
+	BackoffLimit          *int32        `json:"backoffLimit,omitempty"`
+	Selector              LabelSelector `json:"selector,omitempty"`
+	ManualSelector        bool          `json:"manualSelector,omitempty"`
+	Template              PodTemplate   `json:"template,omitempty"`
+}
+
+type JobStatus struct {
+	Active     int32          `json:"active,omitempty"`
+	Succeeded  int32          `json:"succeeded,omitempty"`
+	Failed     int32          `json:"failed,omitempty"`
+	Conditions []JobCondition `json:"conditions,omitempty"`
+}
+
+type JobCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
 type LabelSelector struct {
 	MatchLabels map[string]string `json:"matchLabels,omitempty"`
 }
@@ -69,9 +193,88 @@ type PodTemplate struct {
 }
 
 type PodSpec struct {
-	Containers     []Container `json:"containers"`
-	InitContainers []Container `json:"initContainers"`
-	Volumes        []Volume    `json:"volumes,omitempty"`
+	Containers         []Container `json:"containers"`
+	InitContainers     []Container `json:"initContainers"`
+	RestartPolicy      string      `json:"restartPolicy,omitempty"`
+	ServiceAccountName string      `json:"serviceAccountName,omitempty"`
+	Volumes            []Volume    `json:"volumes,omitempty"`
+
+	NodeName                  string                     `json:"nodeName,omitempty"`
+	NodeSelector              map[string]string          `json:"nodeSelector,omitempty"`
+	Tolerations               []Toleration               `json:"tolerations,omitempty"`
+	Affinity                  *Affinity                  `json:"affinity,omitempty"`
+	TopologySpreadConstraints []TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+}
+
+type Toleration struct {
+	Key               string `json:"key,omitempty"`
+	Operator          string `json:"operator,omitempty"`
+	Value             string `json:"value,omitempty"`
+	Effect            string `json:"effect,omitempty"`
+	TolerationSeconds *int64 `json:"tolerationSeconds,omitempty"`
+}
+
+type Affinity struct {
+	NodeAffinity    *NodeAffinity    `json:"nodeAffinity,omitempty"`
+	PodAffinity     *PodAffinity     `json:"podAffinity,omitempty"`
+	PodAntiAffinity *PodAntiAffinity `json:"podAntiAffinity,omitempty"`
+}
+
+type NodeAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution  *NodeSelector             `json:"requiredDuringSchedulingIgnoredDuringExecution,omitempty"`
+	PreferredDuringSchedulingIgnoredDuringExecution []PreferredSchedulingTerm `json:"preferredDuringSchedulingIgnoredDuringExecution,omitempty"`
+}
+
+type NodeSelector struct {
+	NodeSelectorTerms []NodeSelectorTerm `json:"nodeSelectorTerms"`
+}
+
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement `json:"matchExpressions,omitempty"`
+}
+
+type NodeSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
+type PreferredSchedulingTerm struct {
+	Weight     int32            `json:"weight"`
+	Preference NodeSelectorTerm `json:"preference"`
+}
+
+type PodAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution  []PodAffinityTerm         `json:"requiredDuringSchedulingIgnoredDuringExecution,omitempty"`
+	PreferredDuringSchedulingIgnoredDuringExecution []WeightedPodAffinityTerm `json:"preferredDuringSchedulingIgnoredDuringExecution,omitempty"`
+}
+
+type PodAntiAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution  []PodAffinityTerm         `json:"requiredDuringSchedulingIgnoredDuringExecution,omitempty"`
+	PreferredDuringSchedulingIgnoredDuringExecution []WeightedPodAffinityTerm `json:"preferredDuringSchedulingIgnoredDuringExecution,omitempty"`
+}
+
+type PodAffinityTerm struct {
+	LabelSelector *LabelSelector `json:"labelSelector,omitempty"`
+	Namespaces    []string       `json:"namespaces,omitempty"`
+	TopologyKey   string         `json:"topologyKey"`
+}
+
+type WeightedPodAffinityTerm struct {
+	Weight          int32           `json:"weight"`
+	PodAffinityTerm PodAffinityTerm `json:"podAffinityTerm"`
+}
+
+type TopologySpreadConstraint struct {
+	MaxSkew           int32          `json:"maxSkew"`
+	TopologyKey       string         `json:"topologyKey"`
+	WhenUnsatisfiable string         `json:"whenUnsatisfiable"`
+	LabelSelector     *LabelSelector `json:"labelSelector,omitempty"`
+}
+
+type Node struct {
+	Kind     string   `json:"kind,omitempty"`
+	Metadata Metadata `json:"metadata"`
 }
 
 type Port struct {
@@ -97,7 +300,7 @@ type Probe struct {
 }
 
 type Container struct {
-	Args            []string             `json:"args"`
+	Args            []string             `json:"args,omitempty"`
 	Command         []string             `json:"command"`
 	Env             []EnvVar             `json:"env,omitempty"`
 	Image           string               `json:"image"`
@@ -109,6 +312,8 @@ type Container struct {
 	ReadinessProbe  *Probe               `json:"readinessProbe,omitempty"`
 	LivenessProbe   *Probe               `json:"livenessProbe,omitempty"`
 	SecurityContext SecurityContext      `json:"securityContext,omitempty"`
+
+	TerminationMessagePolicy string `json:"terminationMessagePolicy,omitempty"`
 }
 
 type SecurityContext struct {
@@ -122,9 +327,9 @@ type Capabilities struct {
 }
 
 type EnvVar struct {
-	Name      string       `json:"name"`
-	Value     string       `json:"value,omitempty"`
-	ValueFrom EnvVarSource `json:"valueFrom,omitempty"`
+	Name      string        `json:"name"`
+	Value     string        `json:"value,omitempty"`
+	ValueFrom *EnvVarSource `json:"valueFrom,omitempty"`
 }
 
 type EnvVarSource struct {
@@ -144,7 +349,7 @@ type ResourceList map[string]string
 type VolumeMount struct {
 	Name      string `json:"name"`
 	MountPath string `json:"mountPath"`
-	ReadOnly  bool   `json:readOnly,omitempty`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
 }
 
 type Volume struct {
@@ -190,3 +395,19 @@ type Scale struct {
 type ScaleSpec struct {
 	Replicas int64 `json:"replicas,omitempty"`
 }
+
+type APIGroupList struct {
+	Kind   string     `json:"kind"`
+	Groups []APIGroup `json:"groups"`
+}
+
+type APIGroup struct {
+	Name             string                     `json:"name"`
+	Versions         []GroupVersionForDiscovery `json:"versions"`
+	PreferredVersion GroupVersionForDiscovery   `json:"preferredVersion"`
+}
+
+type GroupVersionForDiscovery struct {
+	GroupVersion string `json:"groupVersion"`
+	Version      string `json:"version"`
+}
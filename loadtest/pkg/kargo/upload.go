@@ -12,13 +12,26 @@
 package kargo
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
@@ -36,124 +49,340 @@ type UploadConfig struct {
 	BuildPath  string
 	ProjectID  string
 	Path       string
+	// Store overrides --artifact-store.
+	Store ArtifactStore
+	// Arch is the GOARCH to build for, amd64 if empty.
+	Arch string
 }
 
-func build(name string, directory string) (string, error) {
-	tmpDir, err := ioutil.TempDir("", "")
-	if err != nil {
-		return "", err
-	}
-	output := filepath.Join(tmpDir, name)
-	fmt.Println(output)
+// build builds the binary for linux/goarch in the user's Go environment.
+// Unless --build-cache is none, builds are cached under the hash of their
+// source and settings, and a build whose source has not changed is reused.
+func build(out io.Writer, name string, directory string, goarch string) (string, error) {
+	env := buildEnv(goarch)
+	goBuild := func(output string) error {
+		command := append([]string{"go", "build", "-o", output}, buildFlags...)
+		cmd := exec.Command(command[0], append(command[1:], ".")...)
+		cmd.Dir = directory
+		cmd.Env = env
 
-	ldflags := `-extldflags "-static"`
-	command := []string{
-		"go", "build", "-o", output, "-a", "--ldflags",
-		ldflags, "-tags", "netgo",
-		"-installsuffix", "netgo", directory,
+		data, err := cmd.CombinedOutput()
+		if err != nil {
+			fmt.Fprintln(out, string(data))
+			return err
+		}
+		return nil
 	}
-	cmd := exec.Command(command[0], command[1:]...)
 
-	gopath := os.Getenv("GOPATH")
-	cmd.Env = []string{
-		"GOOS=linux",
-		"GOARCH=amd64",
-		"GOPATH=" + gopath,
-		"HOME=" + os.Getenv("HOME"),
+	cacheDir := buildCacheDir()
+	if cacheDir == "" {
+		tmpDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			return "", err
+		}
+		output := filepath.Join(tmpDir, name)
+		err = goBuild(output)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(out, "Created: "+output)
+		return output, nil
 	}
 
-	data, err := cmd.CombinedOutput()
+	key, err := buildKey(env, directory)
 	if err != nil {
-		fmt.Println(string(data))
 		return "", err
 	}
+	return cachedBuild(out, cacheDir, key, name, goBuild)
+}
 
-	return output, nil
+// Build builds the linux binary the workers run for config.Arch and returns
+// its path, without uploading it. With --dry-run progress goes to stderr, as
+// for Upload.
+func Build(config UploadConfig) (string, error) {
+	var out io.Writer = os.Stdout
+	if DryRun {
+		out = os.Stderr
+	}
+
+	goarch := config.Arch
+	if goarch == "" {
+		goarch = defaultArch
+	}
+	fmt.Fprintf(out, "Building %s binary for linux/%s...\n", config.ObjectName, goarch)
+	return build(out, config.ObjectName, config.BuildPath, goarch)
 }
 
-func Upload(config UploadConfig) (string, error) {
-	if config.Path == "" {
-		fmt.Printf("Building %s binary...\n", config.ObjectName)
-		output, err := build(config.ObjectName, config.BuildPath)
+// Artifact is an uploaded binary and what workers need to check it before
+// running it.
+type Artifact struct {
+	// URL is where workers download the binary, signed with --signed-url-ttl.
+	URL    string
+	SHA256 string
+	// Arch is the architecture the binary was built for.
+	Arch string
+	// Signature is the base64 ed25519 signature of the hex SHA256 made with
+	// --signing-key, and PublicKey the PEM public key that verifies it. Both
+	// are empty without a signing key.
+	Signature string
+	PublicKey string
+}
 
+// Upload builds the binary unless config.Path is set and stores it under its
+// checksum in config.Store, or the store picked by --artifact-store, which
+// defaults to config.BucketName on GCS. The binary is streamed rather than
+// read into memory, and uploads print their progress. With --dry-run the
+// binary is only built to work out the link, and progress goes to stderr so
+// that stdout holds nothing but manifests.
+func Upload(config UploadConfig) (*Artifact, error) {
+	store := config.Store
+	if store == nil {
+		spec := artifactStore
+		if spec == "" {
+			spec = "gs://" + config.BucketName + "?project=" + url.QueryEscape(config.ProjectID)
+		}
+		var err error
+		store, err = ParseArtifactStore(spec)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+	}
+	signer, ok := store.(urlSigner)
+	if signedURLTTL > 0 && !ok {
+		return nil, errors.New("--signed-url-ttl needs a GCS or S3 artifact store")
+	}
+	signed := ok && !signer.Public()
+
+	if config.Path == "" {
+		output, err := Build(config)
+		if err != nil {
+			return nil, err
 		}
 		config.Path = output
-		fmt.Println("Created: " + config.Path)
 	}
 
-	client, err := google.DefaultClient(context.Background(), scope)
+	f, err := os.Open(config.Path)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	service, err := storage.New(client)
+	defer f.Close()
+	info, err := f.Stat()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	_, err = service.Buckets.Get(config.BucketName).Do()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
 	if err != nil {
-		_, err := service.Buckets.Insert(config.ProjectID, &storage.Bucket{Name: config.BucketName}).Do()
+		return nil, err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	metadata := make(map[string]string)
+	metadata["sha256"] = checksum
+
+	artifact := &Artifact{SHA256: checksum, Arch: config.Arch}
+	if artifact.Arch == "" {
+		artifact.Arch = defaultArch
+	}
+	if signingKey != "" {
+		artifact.Signature, artifact.PublicKey, err = signBinary(signingKey, checksum)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+		metadata["ed25519"] = artifact.Signature
 	}
 
-	f, err := os.Open(config.Path)
+	objectName := path.Join(checksum, config.ObjectName)
+	link := store.URL(objectName)
+	artifact.URL = link
+	if signed {
+		ttl := signedURLTTL
+		if ttl == 0 {
+			ttl = defaultSignedURLTTL
+		}
+		artifact.URL, err = signer.SignedURL(objectName, ttl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if DryRun {
+		return artifact, nil
+	}
+
+	exists, err := store.Exists(objectName)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		fmt.Printf("Object %s already exists, skipping upload.\n", link)
+		return artifact, nil
+	}
+
+	fmt.Printf("Uploading %s to %s...\n", config.ObjectName, link)
+	progress := newUploadProgress(config.ObjectName, info.Size())
+	err = store.Put(objectName, progress.reader(f), info.Size(), metadata)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Upload complete.")
+	return artifact, nil
+}
+
+// gcsStore keeps objects in a Google Cloud Storage bucket, using the
+// application default credentials.
+type gcsStore struct {
+	projectID string
+	bucket    string
+	public    bool
+	service   *storage.Service
+}
+
+func (s *gcsStore) URL(name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.bucket, name)
+}
+
+func (s *gcsStore) Public() bool {
+	return s.public
+}
+
+// SignedURL is a V4 signed GET of name that is valid for ttl. Signing needs
+// a private key, so the application default credentials must be a service
+// account key file.
+func (s *gcsStore) SignedURL(name string, ttl time.Duration) (string, error) {
+	credentials, err := google.FindDefaultCredentials(context.Background(), scope)
 	if err != nil {
 		return "", err
 	}
+	if len(credentials.JSON) == 0 {
+		return "", errors.New("signed GCS URLs need a service account key in $GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	conf, err := google.JWTConfigFromJSON(credentials.JSON, scope)
+	if err != nil {
+		return "", fmt.Errorf("signed GCS URLs need a service account key: %s", err)
+	}
+	key, err := parseRSAKey(conf.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	return gcsSignedURL(s.bucket, name, conf.Email, key, ttl, time.Now())
+}
+
+// gcsSignedURL signs a GET of name with the key of the service account
+// email, as V4 signing with GOOG4-RSA-SHA256 requires.
+func gcsSignedURL(bucket, name, email string, key *rsa.PrivateKey, ttl time.Duration, now time.Time) (string, error) {
+	if ttl > 7*24*time.Hour {
+		return "", errors.New("signed GCS URLs are valid for at most 7 days")
+	}
+	date := now.UTC().Format("20060102T150405Z")
+	scope := date[:8] + "/auto/storage/goog4_request"
 
-	data, err := ioutil.ReadAll(f)
+	u := &url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + bucket + "/" + name}
+	query := url.Values{}
+	query.Set("X-Goog-Algorithm", "GOOG4-RSA-SHA256")
+	query.Set("X-Goog-Credential", email+"/"+scope)
+	query.Set("X-Goog-Date", date)
+	query.Set("X-Goog-Expires", strconv.Itoa(int(ttl/time.Second)))
+	query.Set("X-Goog-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		awsURIEncode(u.Path, false),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "GOOG4-RSA-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
 	if err != nil {
 		return "", err
 	}
-	f.Seek(0, 0)
+	query.Set("X-Goog-Signature", hex.EncodeToString(signature))
+	u.RawQuery = canonicalQuery(query)
+	return u.String(), nil
+}
 
-	h := sha256.New()
-	h.Write(data)
-	checksum := hex.EncodeToString(h.Sum(nil))
-	metadata := make(map[string]string)
-	metadata["sha256"] = checksum
+// parseRSAKey reads the PEM private key of a service account key file.
+func parseRSAKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("the service account key has no PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the service account key is not an RSA key")
+	}
+	return rsaKey, nil
+}
 
-	objectName := filepath.Join(checksum, config.ObjectName)
+func (s *gcsStore) connect() error {
+	if s.service != nil {
+		return nil
+	}
+	client, err := google.DefaultClient(context.Background(), scope)
+	if err != nil {
+		return err
+	}
+	s.service, err = storage.New(client)
+	return err
+}
 
-	publicLink := fmt.Sprintf("https://storage.googleapis.com/%s/%s", config.BucketName, objectName)
-	object, err := service.Objects.Get(config.BucketName, objectName).Do()
+func (s *gcsStore) Exists(name string) (bool, error) {
+	err := s.connect()
+	if err != nil {
+		return false, err
+	}
 
-	if object != nil {
-		if object.HTTPStatusCode == 200 {
-			fmt.Printf("Object %s already exists, skipping upload.\n", filepath.Join(config.BucketName, objectName))
-			return publicLink, nil
+	object, err := s.service.Objects.Get(s.bucket, name).Do()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == 404 {
+			return false, nil
 		}
+		return false, err
 	}
+	return object.HTTPStatusCode == 200, nil
+}
 
+// Put creates the bucket in the project if it does not exist yet. Objects
+// larger than uploadChunkSize are sent as a resumable upload, whose chunks
+// the client library retries.
+func (s *gcsStore) Put(name string, r io.ReaderAt, size int64, metadata map[string]string) error {
+	err := s.connect()
 	if err != nil {
-		if err.(*googleapi.Error).Code != 404 {
-			return "", err
-		}
+		return err
 	}
 
-	acl := &storage.ObjectAccessControl{
-		Bucket: config.BucketName,
-		Entity: "allUsers",
-		Object: objectName,
-		Role:   "READER",
+	_, err = s.service.Buckets.Get(s.bucket).Do()
+	if err != nil {
+		if s.projectID == "" {
+			return fmt.Errorf("the %s bucket cannot be created without a project: %s", s.bucket, err)
+		}
+		_, err := s.service.Buckets.Insert(s.projectID, &storage.Bucket{Name: s.bucket}).Do()
+		if err != nil {
+			return err
+		}
 	}
 
-	object = &storage.Object{
-		Acl:      []*storage.ObjectAccessControl{acl},
-		Name:     objectName,
+	object := &storage.Object{
+		Name:     name,
 		Metadata: metadata,
 	}
-
-	fmt.Printf("Uploading %s to the %s bucket...\n", object.Name, config.BucketName)
-	_, err = service.Objects.Insert(config.BucketName, object).Media(f).Do()
-	if err != nil {
-		return "", err
+	if s.public {
+		object.Acl = []*storage.ObjectAccessControl{{
+			Bucket: s.bucket,
+			Entity: "allUsers",
+			Object: name,
+			Role:   "READER",
+		}}
 	}
-	fmt.Println("Upload complete.")
-	return publicLink, nil
+	media := io.NewSectionReader(r, 0, size)
+	_, err = s.service.Objects.Insert(s.bucket, object).Media(media, googleapi.ChunkSize(int(uploadChunkSize))).Do()
+	return err
 }
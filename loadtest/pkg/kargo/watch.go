@@ -0,0 +1,270 @@
+package kargo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// errStopWatch is returned by a watch handler to end the watch without error.
+var errStopWatch = errors.New("stop watch")
+
+// errWatchExpired means the resource version the watch started from is too
+// old and the objects have to be listed again.
+var errWatchExpired = errors.New("watch expired")
+
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type Status struct {
+	Kind    string `json:"kind"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
+
+// watchPods calls handle with every pod matching labelSelector, first as
+// ADDED for the pods that already exist and then for each change, until
+// handle returns an error or ctx is done. Dropped watches are resumed from the
+// last resource version seen.
+func watchPods(ctx context.Context, namespace, labelSelector string, handle func(eventType string, pod *Pod) error) error {
+	path := fmt.Sprintf(podsEndpoint, namespace)
+	return watchCollection(ctx, path, labelSelector, "", func(eventType string, object json.RawMessage) error {
+		var pod Pod
+		err := json.Unmarshal(object, &pod)
+		if err != nil {
+			return err
+		}
+		return handle(eventType, &pod)
+	})
+}
+
+// watchCollection lists and then watches the objects in the collection at
+// path, as watchPods does for pods. When a watch expires the collection is
+// listed again, and objects deleted in the meantime are handled as DELETED.
+func watchCollection(ctx context.Context, path, labelSelector, fieldSelector string, handle func(eventType string, object json.RawMessage) error) error {
+	seen := make(map[string]json.RawMessage)
+	track := func(eventType string, object json.RawMessage) error {
+		name := objectName(object)
+		if eventType == "DELETED" {
+			delete(seen, name)
+		} else {
+			seen[name] = object
+		}
+		return handle(eventType, object)
+	}
+
+	for {
+		list, err := listCollection(ctx, path, labelSelector, fieldSelector)
+		if err != nil {
+			return stopWatchError(err)
+		}
+
+		err = relist(seen, list.Items, track)
+		if err != nil {
+			return stopWatchError(err)
+		}
+
+		resourceVersion := list.Metadata.ResourceVersion
+		for {
+			resourceVersion, err = watchFrom(ctx, path, labelSelector, fieldSelector, resourceVersion, track)
+			if err == errWatchExpired {
+				break
+			}
+			if err != nil {
+				return stopWatchError(err)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// relist handles the objects of seen that are missing from a new list as
+// DELETED, and then every listed object as ADDED.
+func relist(seen map[string]json.RawMessage, items []json.RawMessage, handle func(string, json.RawMessage) error) error {
+	listed := make(map[string]bool)
+	for _, item := range items {
+		listed[objectName(item)] = true
+	}
+	gone := make([]string, 0)
+	for name := range seen {
+		if !listed[name] {
+			gone = append(gone, name)
+		}
+	}
+	sort.Strings(gone)
+	for _, name := range gone {
+		err := handle("DELETED", seen[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, item := range items {
+		err := handle("ADDED", item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func objectName(object json.RawMessage) string {
+	var o struct {
+		Metadata Metadata `json:"metadata"`
+	}
+	json.Unmarshal(object, &o)
+	return o.Metadata.Name
+}
+
+func stopWatchError(err error) error {
+	if err == errStopWatch || err == context.Canceled || err == context.DeadlineExceeded {
+		return nil
+	}
+	return err
+}
+
+type objectList struct {
+	Metadata ListMetadata      `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+func listCollection(ctx context.Context, path, labelSelector, fieldSelector string) (*objectList, error) {
+	var list objectList
+
+	v := url.Values{}
+	if labelSelector != "" {
+		v.Set("labelSelector", labelSelector)
+	}
+	if fieldSelector != "" {
+		v.Set("fieldSelector", fieldSelector)
+	}
+
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("List error non 200 reponse: " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// watchFrom runs a single watch request and returns the last resource version
+// seen once the server closes it.
+func watchFrom(ctx context.Context, path, labelSelector, fieldSelector, resourceVersion string, handle func(string, json.RawMessage) error) (string, error) {
+	v := url.Values{}
+	if labelSelector != "" {
+		v.Set("labelSelector", labelSelector)
+	}
+	if fieldSelector != "" {
+		v.Set("fieldSelector", fieldSelector)
+	}
+	v.Set("watch", "true")
+	v.Set("allowWatchBookmarks", "true")
+	if resourceVersion != "" {
+		v.Set("resourceVersion", resourceVersion)
+	}
+
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Path:     path,
+			RawQuery: v.Encode(),
+		},
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := kubeClient.Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return resourceVersion, ctx.Err()
+		}
+		fmt.Println("Watch error: ", err)
+		time.Sleep(time.Second)
+		return resourceVersion, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 410 {
+		return resourceVersion, errWatchExpired
+	}
+	if resp.StatusCode != 200 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		fmt.Println(string(data))
+		return resourceVersion, errors.New("Watch error non 200 reponse: " + resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event WatchEvent
+		err := decoder.Decode(&event)
+		if err == io.EOF || ctx.Err() != nil {
+			return resourceVersion, ctx.Err()
+		}
+		if err != nil {
+			return resourceVersion, nil
+		}
+
+		if event.Type == "ERROR" {
+			var status Status
+			json.Unmarshal(event.Object, &status)
+			if status.Code == 410 {
+				return resourceVersion, errWatchExpired
+			}
+			return resourceVersion, fmt.Errorf("watch %s: %s", path, status.Message)
+		}
+
+		var object struct {
+			Metadata Metadata `json:"metadata"`
+		}
+		err = json.Unmarshal(event.Object, &object)
+		if err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = object.Metadata.ResourceVersion
+		if event.Type == "BOOKMARK" {
+			continue
+		}
+
+		err = handle(event.Type, event.Object)
+		if err != nil {
+			return resourceVersion, err
+		}
+	}
+}
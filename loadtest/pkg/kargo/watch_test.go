@@ -0,0 +1,30 @@
+package kargo
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRelist(t *testing.T) {
+	pod := func(name, phase string) json.RawMessage {
+		return json.RawMessage(`{"metadata":{"name":"` + name + `"},"status":{"phase":"` + phase + `"}}`)
+	}
+	seen := map[string]json.RawMessage{
+		"a": pod("a", "Running"),
+		"b": pod("b", "Running"),
+		"c": pod("c", "Pending"),
+	}
+	events := make([]string, 0)
+	err := relist(seen, []json.RawMessage{pod("b", "Running"), pod("d", "Pending")}, func(eventType string, object json.RawMessage) error {
+		events = append(events, eventType+" "+objectName(object))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"DELETED a", "DELETED c", "ADDED b", "ADDED d"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("relist events are %v, want %v", events, want)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/sbinet/go-gnuplot"
@@ -20,15 +21,35 @@ func (cr *gnuChartRenderer) Start() {
 
 	for {
 		time.Sleep(time.Second * 5)
-		toPlot := []float64{}
-		for _, res := range *cr.parser.GetResults() {
-			toPlot = append(toPlot, float64(res.totalDurationMillis))
+		summaries := cr.parser.GetSummaries()
+		if len(summaries) == 0 {
+			continue
 		}
 
-		if len(toPlot) > 0 {
-			p.ResetPlot()
-			p.PlotX(toPlot, "Req duration (ms)")
+		elapsed := []float64{}
+		p50 := []float64{}
+		p99 := []float64{}
+		for _, summary := range summaries {
+			if summary.totalDurations.total == 0 {
+				continue
+			}
+			elapsed = append(elapsed, time.Duration(summary.start-summaries[0].start).Seconds())
+			p50 = append(p50, float64(summary.totalDurations.quantile(0.5)))
+			p99 = append(p99, float64(summary.totalDurations.quantile(0.99)))
+		}
 
+		if len(elapsed) > 0 {
+			p.CheckedCmd("unset arrow")
+			p.CheckedCmd("unset label")
+			for _, a := range cr.parser.GetAnnotations() {
+				x := time.Duration(a.at.UnixNano() - summaries[0].start).Seconds()
+				p.CheckedCmd(fmt.Sprintf("set arrow from %g, graph 0 to %g, graph 1 nohead dashtype 2", x, x))
+				p.CheckedCmd(fmt.Sprintf("set label %q at %g, graph 0.95 offset 0.5, 0", a.text, x))
+			}
+
+			p.ResetPlot()
+			p.PlotXY(elapsed, p50, "Req duration p50 (ms)")
+			p.PlotXY(elapsed, p99, "Req duration p99 (ms)")
 		}
 	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"os"
+	"sync"
 )
 
 type clientManager struct {
@@ -11,7 +12,6 @@ type clientManager struct {
 	errorChannel  chan error
 	sigChannel    chan os.Signal
 	hostname      string
-	reqPerMinute  int
 	batchSize     int
 	stdoutChannel chan string
 }
@@ -23,19 +23,26 @@ func makeClientManager(config *loadtestConfig) *clientManager {
 		errorChannel:  config.errChan,
 		sigChannel:    config.sigChan,
 		hostname:      config.hostname,
-		reqPerMinute:  config.requestsPerMinute,
 		batchSize:     config.batchSize,
 		stdoutChannel: config.stdoutChannel,
 	}
 }
 
+// startWorkers runs the clients until the request channel is closed, then
+// closes the result channel so the aggregator can flush its last interval.
 func (cm *clientManager) startWorkers(ctx context.Context, config *loadtestConfig) {
-
+	var wg sync.WaitGroup
 	for i := 0; i < cm.numWorkers; i++ {
 		// time.Sleep(500 * time.Millisecond)
 		client := cm.createClient(config)
-		go client.startWorking(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.startWorking(ctx)
+		}()
 	}
+	wg.Wait()
+	close(config.resultChannel)
 }
 
 func (cm *clientManager) createClient(config *loadtestConfig) *client {
@@ -11,6 +11,7 @@ import (
 type client struct {
 	httpClient    *http.Client
 	reqChannel    chan *http.Request
+	resultChannel chan *result
 	stdoutChannel chan string
 }
 
@@ -20,6 +21,7 @@ func makeClient(config *loadtestConfig) *client {
 			Timeout: time.Duration(int(time.Second) * config.httpTimeoutSecs),
 		},
 		reqChannel:    config.reqChannel,
+		resultChannel: config.resultChannel,
 		stdoutChannel: config.stdoutChannel,
 	}
 }
@@ -31,6 +33,7 @@ func (c *client) startWorking(ctx context.Context) {
 
 		if err != nil {
 			c.stdoutChannel <- err.Error()
+			c.resultChannel <- &result{success: false}
 			continue
 		} else {
 			bodyBytes, err := ioutil.ReadAll(resp.Body)
@@ -44,11 +47,11 @@ func (c *client) startWorking(ctx context.Context) {
 				c.stdoutChannel <- err.Error()
 			}
 			durationMillis := int(time.Since(startTime) / time.Millisecond)
-			c.stdoutChannel <- encodeResult(&result{
+			c.resultChannel <- &result{
 				success:             true,
 				hashDurationMillis:  hashDuration,
 				totalDurationMillis: durationMillis,
-			})
+			}
 		}
 
 	}
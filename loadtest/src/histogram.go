@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Values below subBucketCount are recorded exactly. Above that every power of
+// two is split into subBucketHalf equal buckets, which keeps the relative error
+// of any recorded value within 1/subBucketHalf, about 1.6%.
+const subBucketBits = 7
+const subBucketCount = 1 << subBucketBits
+const subBucketHalf = subBucketCount / 2
+
+// histogram is a log-linear latency histogram in the style of HdrHistogram.
+// Bucket boundaries are fixed, so histograms recorded by different workers can
+// be merged exactly by adding their counts.
+type histogram struct {
+	counts map[int]uint64
+	total  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make(map[int]uint64)}
+}
+
+func bucketIndex(v int) int {
+	if v < 0 {
+		v = 0
+	}
+	if v < subBucketCount {
+		return v
+	}
+	exp := bits.Len(uint(v)) - subBucketBits
+	return exp*subBucketHalf + v>>uint(exp)
+}
+
+// bucketBounds returns the lowest and highest value recorded into a bucket.
+func bucketBounds(index int) (int, int) {
+	if index < subBucketCount {
+		return index, index
+	}
+	exp := uint(index/subBucketHalf - 1)
+	sub := index%subBucketHalf + subBucketHalf
+	return sub << exp, (sub+1)<<exp - 1
+}
+
+func (h *histogram) record(v int) {
+	h.counts[bucketIndex(v)]++
+	h.total++
+}
+
+func (h *histogram) merge(other *histogram) {
+	for index, count := range other.counts {
+		h.counts[index] += count
+	}
+	h.total += other.total
+}
+
+func (h *histogram) sortedIndexes() []int {
+	indexes := make([]int, 0, len(h.counts))
+	for index := range h.counts {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// quantile returns the highest value equivalent to the value at quantile q,
+// where q is between 0 and 1.
+func (h *histogram) quantile(q float64) int {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	indexes := h.sortedIndexes()
+	for _, index := range indexes {
+		seen += h.counts[index]
+		if seen >= rank {
+			_, high := bucketBounds(index)
+			return high
+		}
+	}
+	_, high := bucketBounds(indexes[len(indexes)-1])
+	return high
+}
+
+func (h *histogram) max() int {
+	return h.quantile(1)
+}
+
+// encode renders the non-empty buckets as comma separated index=count pairs.
+func (h *histogram) encode() string {
+	parts := make([]string, 0, len(h.counts))
+	for _, index := range h.sortedIndexes() {
+		parts = append(parts, fmt.Sprintf("%d=%d", index, h.counts[index]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func decodeHistogram(s string) (*histogram, error) {
+	h := newHistogram()
+	if s == "" {
+		return h, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid histogram bucket %q", part)
+		}
+		index, err := strconv.Atoi(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseUint(pair[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		h.counts[index] += count
+		h.total += count
+	}
+	return h, nil
+}
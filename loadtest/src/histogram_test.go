@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBucketIndex(t *testing.T) {
+	tests := []struct {
+		value     int
+		index     int
+		low, high int
+	}{
+		{-5, 0, 0, 0},
+		{0, 0, 0, 0},
+		{1, 1, 1, 1},
+		{127, 127, 127, 127},
+		{128, 128, 128, 129},
+		{129, 128, 128, 129},
+		{130, 129, 130, 131},
+		{255, 191, 254, 255},
+		{256, 192, 256, 259},
+		{1000, 317, 1000, 1007},
+	}
+	for _, test := range tests {
+		index := bucketIndex(test.value)
+		if index != test.index {
+			t.Errorf("bucketIndex(%d) = %d, want %d", test.value, index, test.index)
+		}
+		low, high := bucketBounds(index)
+		if low != test.low || high != test.high {
+			t.Errorf("bucketBounds(%d) = %d, %d, want %d, %d", index, low, high, test.low, test.high)
+		}
+	}
+}
+
+func TestBucketError(t *testing.T) {
+	for v := 0; v < 1<<20; v += 1 + v/1000 {
+		low, high := bucketBounds(bucketIndex(v))
+		if v < low || v > high {
+			t.Fatalf("%d is recorded in a bucket from %d to %d", v, low, high)
+		}
+		if float64(high-low) > float64(low)/subBucketHalf {
+			t.Fatalf("%d is recorded in a bucket from %d to %d, wider than 1/%d of its values", v, low, high, subBucketHalf)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	h := newHistogram()
+	for v := 1; v <= 100; v++ {
+		h.record(v)
+	}
+	tests := []struct {
+		q    float64
+		want int
+	}{
+		{0, 1},
+		{0.01, 1},
+		{0.5, 50},
+		{0.99, 99},
+		{1, 100},
+	}
+	for _, test := range tests {
+		if got := h.quantile(test.q); got != test.want {
+			t.Errorf("quantile(%g) = %d, want %d", test.q, got, test.want)
+		}
+	}
+
+	if got := newHistogram().quantile(0.5); got != 0 {
+		t.Errorf("quantile of an empty histogram = %d, want 0", got)
+	}
+	h = newHistogram()
+	h.record(1000)
+	if got := h.max(); got != 1007 {
+		t.Errorf("max = %d, want the top of the bucket of 1000, 1007", got)
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a := newHistogram()
+	b := newHistogram()
+	for v := 1; v <= 50; v++ {
+		a.record(v)
+	}
+	for v := 51; v <= 100; v++ {
+		b.record(v)
+	}
+	b.record(10)
+	a.merge(b)
+	if a.total != 101 || a.counts[10] != 2 || a.counts[100] != 1 {
+		t.Errorf("merged histogram has total %d and counts %v", a.total, a.counts)
+	}
+	if got := a.quantile(0.5); got != 50 {
+		t.Errorf("merged median = %d, want 50", got)
+	}
+	if b.total != 51 {
+		t.Errorf("merge changed the merged histogram's total to %d", b.total)
+	}
+}
+
+func TestHistogramEncoding(t *testing.T) {
+	h := newHistogram()
+	h.record(3)
+	h.record(1000)
+	h.record(1000)
+	encoded := h.encode()
+	if encoded != "3=1,317=2" {
+		t.Errorf("encode() = %q, want %q", encoded, "3=1,317=2")
+	}
+	decoded, err := decodeHistogram(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.total != 3 || decoded.counts[3] != 1 || decoded.counts[317] != 2 {
+		t.Errorf("decoded histogram has total %d and counts %v", decoded.total, decoded.counts)
+	}
+
+	empty, err := decodeHistogram("")
+	if err != nil || empty.total != 0 {
+		t.Errorf("decodeHistogram(\"\") = %v, %v", empty, err)
+	}
+	for _, invalid := range []string{"3", "a=1", "3=a", "3=-1"} {
+		if _, err := decodeHistogram(invalid); err == nil {
+			t.Errorf("decodeHistogram(%q) succeeded", invalid)
+		}
+	}
+}
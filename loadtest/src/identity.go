@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"github.sc-corp.net/scaddlive/women-who-go.git/loadtest/pkg/kargo"
+)
+
+// workerIdentity is the pod and node a worker runs on, stamped on every
+// summary it reports so that latency can be attributed to them.
+type workerIdentity struct {
+	pod       string
+	namespace string
+	ip        string
+	node      string
+}
+
+// currentWorkerIdentity reads the identity kargo injects through the downward
+// API. Outside Kubernetes the worker is identified by its hostname.
+func currentWorkerIdentity(hostname string) workerIdentity {
+	id := workerIdentity{
+		pod:       os.Getenv(kargo.PodNameEnv),
+		namespace: os.Getenv(kargo.PodNamespaceEnv),
+		ip:        os.Getenv(kargo.PodIPEnv),
+		node:      os.Getenv(kargo.NodeNameEnv),
+	}
+	if id.pod == "" {
+		id.pod = hostname
+	}
+	return id
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"fmt"
 	"io"
+	"net/url"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type result struct {
@@ -14,21 +19,88 @@ type result struct {
 	totalDurationMillis int
 }
 
+// intervalSummary holds the counters and latency histograms for every result
+// completed within one report interval, which began at the Unix time start in
+// nanoseconds. Summaries from different workers that
+// share a start time are merged into one. worker is only set on summaries of
+// a single worker. behind counts the requests that were skipped because the
+// worker fell behind its schedule.
+type intervalSummary struct {
+	start          int64
+	successes      uint64
+	failures       uint64
+	behind         uint64
+	hashDurations  *histogram
+	totalDurations *histogram
+	worker         workerIdentity
+}
+
+func newIntervalSummary(start int64) *intervalSummary {
+	return &intervalSummary{
+		start:          start,
+		hashDurations:  newHistogram(),
+		totalDurations: newHistogram(),
+	}
+}
+
+func (s *intervalSummary) record(res *result) {
+	if !res.success {
+		s.failures++
+		return
+	}
+	s.successes++
+	s.hashDurations.record(res.hashDurationMillis)
+	s.totalDurations.record(res.totalDurationMillis)
+}
+
+func (s *intervalSummary) merge(other *intervalSummary) {
+	s.successes += other.successes
+	s.failures += other.failures
+	s.behind += other.behind
+	s.hashDurations.merge(other.hashDurations)
+	s.totalDurations.merge(other.totalDurations)
+}
+
+func (s *intervalSummary) count() uint64 {
+	return s.successes + s.failures
+}
+
+// annotation marks when something changed during the run, such as the number
+// of workers.
+type annotation struct {
+	at   time.Time
+	text string
+}
+
 type LogParser interface {
 	Parse(string)
 	Write(p []byte) (n int, err error)
-	GetResults() *[]*result
+	GetSummaries() []*intervalSummary
+	GetTotals() *intervalSummary
+	GetWorkerTotals() []*intervalSummary
+	Annotate(at time.Time, text string)
+	GetAnnotations() []annotation
 }
 
 type resultLogParser struct {
-	results *[]*result
-	writer  io.Writer
+	mu          sync.Mutex
+	summaries   map[int64]*intervalSummary
+	totals      *intervalSummary
+	workers     map[workerIdentity]*intervalSummary
+	annotations []annotation
+	writer      io.Writer
+}
+
+func init() {
+	parser = makeResultLogParser(os.Stdout)
 }
 
-func makeResultLogParser(results *[]*result, writer io.Writer) *resultLogParser {
+func makeResultLogParser(writer io.Writer) *resultLogParser {
 	return &resultLogParser{
-		results: results,
-		writer:  writer,
+		summaries: make(map[int64]*intervalSummary),
+		totals:    newIntervalSummary(0),
+		workers:   make(map[workerIdentity]*intervalSummary),
+		writer:    writer,
 	}
 }
 
@@ -36,51 +108,175 @@ const startResultTag = "-~:"
 const endResultTag = ":~-"
 const delimiter = ":"
 
-func encodeResult(res *result) string {
-	if !res.success {
-		return fmt.Sprintf(
-			"%s%d%s%s%s%d%s",
-			startResultTag,
-			0, delimiter,
-			"false",
-			delimiter,
-			0,
-			endResultTag)
-	}
+// encodeSummary writes s as a single log line. The worker identity is query
+// escaped, since pod IPs may contain the delimiter.
+func encodeSummary(s *intervalSummary) string {
 	return fmt.Sprintf(
-		"%s%d%s%s%s%d%s",
+		"%s%d%s%d%s%d%s%s%s%s%s%s%s%s%s%s%s%s%s%d%s",
 		startResultTag,
-		res.hashDurationMillis,
-		delimiter,
-		"true",
-		delimiter,
-		res.totalDurationMillis,
+		s.start, delimiter,
+		s.successes, delimiter,
+		s.failures, delimiter,
+		s.hashDurations.encode(), delimiter,
+		s.totalDurations.encode(), delimiter,
+		url.QueryEscape(s.worker.pod), delimiter,
+		url.QueryEscape(s.worker.namespace), delimiter,
+		url.QueryEscape(s.worker.ip), delimiter,
+		url.QueryEscape(s.worker.node), delimiter,
+		s.behind,
 		endResultTag)
 }
 
-func decodeResult(s string) *result {
-	stripped := strings.Replace(s, startResultTag, "", 1)
-	stripped = strings.Replace(stripped, endResultTag, "", 1)
+func decodeSummary(s string) (*intervalSummary, error) {
+	stripped := strings.TrimPrefix(s, startResultTag)
+	stripped = strings.TrimSuffix(stripped, endResultTag)
 	parts := strings.Split(stripped, delimiter)
-	hashDurationMillis, err := strconv.Atoi(parts[0])
+	if len(parts) != 5 && len(parts) != 9 && len(parts) != 10 {
+		return nil, fmt.Errorf("invalid summary %q", s)
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	success, err := strconv.ParseBool(parts[1])
+	summary := newIntervalSummary(start)
+	summary.successes, err = strconv.ParseUint(parts[1], 10, 64)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	totalDurationMillis, err := strconv.Atoi(parts[2])
+	summary.failures, err = strconv.ParseUint(parts[2], 10, 64)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	return &result{
-		hashDurationMillis:  hashDurationMillis,
-		success:             success,
-		totalDurationMillis: totalDurationMillis,
+	summary.hashDurations, err = decodeHistogram(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	summary.totalDurations, err = decodeHistogram(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 5 {
+		// Written by a worker that predates identities.
+		return summary, nil
 	}
 
+	fields := []*string{&summary.worker.pod, &summary.worker.namespace, &summary.worker.ip, &summary.worker.node}
+	for i, field := range fields {
+		*field, err = url.QueryUnescape(parts[5+i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(parts) == 10 {
+		summary.behind, err = strconv.ParseUint(parts[9], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return summary, nil
 }
 
 var r = regexp.MustCompile(fmt.Sprintf(`%s(.*?)%s`, startResultTag, endResultTag))
+
+func (lp *resultLogParser) Parse(log string) {
+	matches := r.FindAllString(log, -1)
+	if len(matches) == 0 {
+		return
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for _, match := range matches {
+		summary, err := decodeSummary(match)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		existing, ok := lp.summaries[summary.start]
+		if !ok {
+			existing = newIntervalSummary(summary.start)
+			lp.summaries[summary.start] = existing
+		}
+		existing.merge(summary)
+		lp.totals.merge(summary)
+
+		if summary.worker.pod != "" {
+			worker, ok := lp.workers[summary.worker]
+			if !ok {
+				worker = newIntervalSummary(0)
+				worker.worker = summary.worker
+				lp.workers[summary.worker] = worker
+			}
+			worker.merge(summary)
+		}
+	}
+}
+
+func (lp *resultLogParser) Write(p []byte) (n int, err error) {
+	stringRep := string(p)
+	lp.Parse(stringRep)
+	return lp.writer.Write(p)
+}
+
+// GetSummaries returns a copy of the merged summaries ordered by start time.
+func (lp *resultLogParser) GetSummaries() []*intervalSummary {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	summaries := make([]*intervalSummary, 0, len(lp.summaries))
+	for _, summary := range lp.summaries {
+		copied := newIntervalSummary(summary.start)
+		copied.merge(summary)
+		summaries = append(summaries, copied)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].start < summaries[j].start
+	})
+	return summaries
+}
+
+func (lp *resultLogParser) GetTotals() *intervalSummary {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	totals := newIntervalSummary(0)
+	totals.merge(lp.totals)
+	return totals
+}
+
+// GetWorkerTotals returns a copy of the totals of each worker ordered by node
+// and pod.
+func (lp *resultLogParser) GetWorkerTotals() []*intervalSummary {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	workers := make([]*intervalSummary, 0, len(lp.workers))
+	for _, worker := range lp.workers {
+		copied := newIntervalSummary(0)
+		copied.worker = worker.worker
+		copied.merge(worker)
+		workers = append(workers, copied)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		if workers[i].worker.node != workers[j].worker.node {
+			return workers[i].worker.node < workers[j].worker.node
+		}
+		return workers[i].worker.pod < workers[j].worker.pod
+	})
+	return workers
+}
+
+func (lp *resultLogParser) Annotate(at time.Time, text string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	lp.annotations = append(lp.annotations, annotation{at: at, text: text})
+}
+
+func (lp *resultLogParser) GetAnnotations() []annotation {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	return append([]annotation{}, lp.annotations...)
+}
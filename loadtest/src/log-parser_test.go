@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummaryRoundTrip(t *testing.T) {
+	s := newIntervalSummary(1549011600)
+	s.record(&result{success: true, hashDurationMillis: 3, totalDurationMillis: 40})
+	s.record(&result{success: true, hashDurationMillis: 5, totalDurationMillis: 1000})
+	s.record(&result{success: false})
+	s.behind = 4
+	s.worker = workerIdentity{pod: "loadtest-5d8f-x2k9", namespace: "load", ip: "fd00::1:2", node: "node-1"}
+
+	decoded, err := decodeSummary(encodeSummary(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, s) {
+		t.Errorf("decoded summary is %+v, want %+v", decoded, s)
+	}
+}
+
+func TestDecodeSummary(t *testing.T) {
+	tests := []struct {
+		line      string
+		successes uint64
+		failures  uint64
+		total     int
+		worker    workerIdentity
+		behind    uint64
+	}{
+		// Workers before identities wrote five fields, and before the
+		// behind count nine.
+		{"-~:10:2:1:3=2:40=1,317=1:~-", 2, 1, 1007, workerIdentity{}, 0},
+		{"-~:10:2:0:3=2:40=2:pod-1:default:10.0.0.1:node-1:~-", 2, 0, 40, workerIdentity{"pod-1", "default", "10.0.0.1", "node-1"}, 0},
+		{"-~:10:1:0:3=1:40=1:pod-1:default:fd00%3A%3A1:node-1:7:~-", 1, 0, 40, workerIdentity{"pod-1", "default", "fd00::1", "node-1"}, 7},
+	}
+	for _, test := range tests {
+		s, err := decodeSummary(test.line)
+		if err != nil {
+			t.Errorf("decodeSummary(%q): %s", test.line, err)
+			continue
+		}
+		if s.start != 10 || s.successes != test.successes || s.failures != test.failures || s.behind != test.behind {
+			t.Errorf("decodeSummary(%q) = %+v", test.line, s)
+		}
+		if got := s.totalDurations.max(); got != test.total {
+			t.Errorf("decodeSummary(%q) has a longest request of %d ms, want %d", test.line, got, test.total)
+		}
+		if s.worker != test.worker {
+			t.Errorf("decodeSummary(%q) has worker %+v, want %+v", test.line, s.worker, test.worker)
+		}
+	}
+
+	for _, invalid := range []string{
+		"-~:10:2:1:3=2:~-",
+		"-~:10:2:1:3=2:40=1:pod-1:~-",
+		"-~:x:2:1:3=2:40=1:~-",
+		"-~:10:2:1:3=2:40=1:pod-1:default:10.0.0.1:node-1:x:~-",
+	} {
+		if _, err := decodeSummary(invalid); err == nil {
+			t.Errorf("decodeSummary(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestResultLogParser(t *testing.T) {
+	var out bytes.Buffer
+	lp := makeResultLogParser(&out)
+	lp.Write([]byte("worker started\n-~:10:2:0:3=2:40=2:pod-1:default:10.0.0.1:node-1:1:~-\n"))
+	lp.Write([]byte("-~:10:1:1:3=1:50=1:pod-2:default:10.0.0.2:node-2:0:~- -~:20:1:0:3=1:40=1:pod-1:default:10.0.0.1:node-1:0:~-\n"))
+
+	summaries := lp.GetSummaries()
+	if len(summaries) != 2 || summaries[0].start != 10 || summaries[0].successes != 3 || summaries[0].failures != 1 || summaries[1].start != 20 {
+		t.Errorf("summaries are %+v", summaries)
+	}
+	totals := lp.GetTotals()
+	if totals.successes != 4 || totals.failures != 1 || totals.behind != 1 {
+		t.Errorf("totals are %+v", totals)
+	}
+	workers := lp.GetWorkerTotals()
+	if len(workers) != 2 || workers[0].worker.pod != "pod-1" || workers[0].successes != 3 || workers[1].worker.node != "node-2" {
+		t.Errorf("worker totals are %+v", workers)
+	}
+	if out.String() == "" {
+		t.Error("the parser did not pass its input on")
+	}
+
+	at := time.Unix(15, 0)
+	lp.Annotate(at, "scaled to 2 replicas")
+	annotations := lp.GetAnnotations()
+	if len(annotations) != 1 || !annotations[0].at.Equal(at) || annotations[0].text != "scaled to 2 replicas" {
+		t.Errorf("annotations are %+v", annotations)
+	}
+}
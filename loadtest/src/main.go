@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,19 +15,69 @@ import (
 )
 
 var (
-	hostname string
-	replicas int
+	hostname       string
+	replicas       int
+	scalingPlan    string
+	reportInterval time.Duration
+	duration       time.Duration
+	runAsJob       bool
+	backoffLimit   int
+	activeDeadline time.Duration
+	gcRunID        string
+
+	maxRunTime            time.Duration
+	heartbeatTimeout      time.Duration
+	cleanupServiceAccount string
+
+	nodeSelector string
+	tolerations  string
+	spread       string
+	antiAffinity string
+
+	rate            float64
+	rateFile        string
+	maxReplicas     int
+	calibrationTime time.Duration
 )
 
-var resultsBuffer = &[]*result{}
 var parser LogParser
 
+// binaryServer serves the worker binary with --serve-binary.
+var binaryServer *kargo.BinaryServer
+
+// archAffinity is set by newBackend when nodes are labelled with their
+// architecture, so workers can be scheduled by it.
+var archAffinity bool
+
 func init() {
 	flag.IntVar(&replicas, "replicas", 1, "Number of replicas")
+	flag.StringVar(&scalingPlan, "scaling-plan", "", "Replica counts to step through instead of --replicas: 1@30s,5@1m,10 or linear:1-10+1@30s or exp:1-64*2@1m")
+	flag.DurationVar(&reportInterval, "report-interval", 5*time.Second, "How often workers report latency histograms")
+	flag.DurationVar(&duration, "duration", 0, "Stop generating load and exit after this long (0 runs forever)")
+	flag.BoolVar(&runAsJob, "job", false, "Run workers as a Kubernetes Job that completes after --duration")
+	flag.IntVar(&backoffLimit, "backoff-limit", 0, "Number of failed worker pods tolerated before the Job fails")
+	flag.DurationVar(&activeDeadline, "active-deadline", 0, "Fail the Job if it runs longer than this (0 for no deadline)")
+	flag.StringVar(&gcRunID, "run-id", "", "With gc, delete the objects of this run once its workers have stopped")
+	flag.DurationVar(&maxRunTime, "max-run-time", 0, "Workers stop generating load this long after they are deployed (0 for no limit)")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", 5*time.Minute, "Workers stop generating load when the coordinator has been gone this long (0 to disable)")
+	flag.StringVar(&cleanupServiceAccount, "cleanup-service-account", "", "Run a Job as this service account that deletes the run once its workers have stopped")
+	flag.StringVar(&nodeSelector, "node-selector", "", "Only run workers on nodes with these labels, as key=value,...")
+	flag.StringVar(&tolerations, "tolerations", "", "Let workers run on nodes with these taints, as key[=value]:effect,...")
+	flag.StringVar(&spread, "spread", "", "Spread workers evenly across node, zone, or other node label keys, as a comma separated list")
+	flag.StringVar(&antiAffinity, "anti-affinity", "", "Keep workers on separate nodes: preferred, or required to leave extra workers pending")
+	flag.Float64Var(&rate, "rate", 0, "Requests per second to send across all workers; on Kubernetes the workers are calibrated and scaled to reach it (0 sends 1000 per minute from each worker)")
+	flag.StringVar(&rateFile, "rate-file", "", "Read the worker's requests per second from this file, which the coordinator updates as it scales")
+	flag.IntVar(&maxReplicas, "max-replicas", 100, "Most replicas --rate scales to")
+	flag.DurationVar(&calibrationTime, "calibration-time", 30*time.Second, "How long one worker is measured before the run is sized for --rate")
 
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		flag.CommandLine.Parse(os.Args[2:])
+		runGC()
+		return
+	}
 	flag.Parse()
 
 	var err error
@@ -36,51 +87,134 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("Starting loadtest on %s...", hostname)
+	if !kargo.DryRun {
+		fmt.Printf("Starting loadtest on %s...", hostname)
+	}
 	errChan := make(chan error, 10)
+	doneChan := make(chan error, 1)
 	signalChan := make(chan os.Signal, 1)
 
-	var dm *kargo.DeploymentManager
+	var dm kargo.Backend
 
-	if kargo.EnableKubernetes {
-		link, err := kargo.Upload(kargo.UploadConfig{
-			ProjectID:  "staging-glass-pen-358",
-			BucketName: "test-binaries",
-			ObjectName: "loadtest",
-			BuildPath:  "../loadtest/src",
-		})
+	if kargo.EnableKubernetes || kargo.EnableLocal || kargo.EnableDocker {
+		if runAsJob && duration <= 0 {
+			fmt.Println("--job requires a --duration")
+			os.Exit(1)
+		}
+		if rate > 0 && (runAsJob || scalingPlan != "") {
+			fmt.Println("--rate cannot be combined with --job or --scaling-plan")
+			os.Exit(1)
+		}
+		if (kargo.EnableLocal || kargo.EnableDocker) && (runAsJob || rate > 0 || kargo.ServeBinary != "") {
+			fmt.Println("--job, --rate and --serve-binary need --kubernetes")
+			os.Exit(1)
+		}
 
+		var artifacts []kargo.Artifact
+		dm, artifacts, err = newBackend()
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
+		}
+		plan := []kargo.ScalingStep{{Replicas: replicas}}
+		if rate > 0 {
+			// Start with the one worker that is calibrated.
+			plan = []kargo.ScalingStep{{Replicas: 1}}
+		}
+		if scalingPlan != "" {
+			plan, err = kargo.ParseScalingPlan(scalingPlan)
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
 		}
 
-		dm = kargo.New()
+		artifact := artifacts[0]
 		config := kargo.DeploymentConfig{
-			Args:      []string{},
-			Name:      "loadtest",
-			BinaryURL: link,
-			Namespace: "default",
-			Replicas:  1,
+			Args:        []string{},
+			Name:        "loadtest",
+			BinaryURL:   artifact.URL,
+			Namespace:   "default",
+			Replicas:    plan[0].Replicas,
+			ScalingPlan: plan,
+
+			BinarySHA256:    artifact.SHA256,
+			BinarySignature: artifact.Signature,
+			BinaryPublicKey: artifact.PublicKey,
+			Binaries:        artifacts,
+			ArchAffinity:    archAffinity,
+
+			MaxRunTime:            maxRunTime,
+			HeartbeatTimeout:      heartbeatTimeout,
+			CleanupServiceAccount: cleanupServiceAccount,
+		}
+		if binaryServer != nil {
+			config.BinaryToken = binaryServer.Token()
+		}
+		err = setScheduling(&config)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		if rate > 0 {
+			withRateFile(&config)
+		}
+		if runAsJob {
+			config.Args = append(config.Args, "--duration="+duration.String())
+			completions := 0
+			for _, step := range plan {
+				if step.Replicas > completions {
+					completions = step.Replicas
+				}
+			}
+			config.Job = &kargo.JobConfig{
+				Parallelism:           plan[0].Replicas,
+				Completions:           completions,
+				BackoffLimit:          backoffLimit,
+				ActiveDeadlineSeconds: int64(activeDeadline / time.Second),
+			}
 		}
 		err = dm.Create(config)
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(1)
+			exit(1)
+		}
+		if kargo.DryRun {
+			exit(0)
+		}
+		err = dm.WaitReady(config.Replicas)
+		if err != nil {
+			fmt.Println(err)
+			dm.Delete()
+			exit(1)
+		}
+		if runAsJob {
+			go waitForJob(dm.(*kargo.DeploymentManager), doneChan)
+		}
+		if rate <= 0 {
+			go runScalingPlan(dm, config, doneChan)
 		}
-		go runScalingLoop(dm, config)
 
 		err = dm.Logs(parser)
 		if err != nil {
 			fmt.Println("Local logging has been disabled.")
 		}
+		if rate > 0 {
+			go runAutoSizing(dm.(*kargo.DeploymentManager), config)
+		}
 
 	} else {
-		go runMain(errChan, hostname, signalChan)
+		go func() {
+			runMain(errChan, hostname, signalChan)
+			doneChan <- nil
+		}()
 	}
 
-	renderer := makeChartRenderer(parser)
-	go renderer.Start()
+	// Workers started by a backend leave the charts to their coordinator.
+	if os.Getenv(kargo.PodNameEnv) == "" {
+		renderer := makeChartRenderer(parser)
+		go renderer.Start()
+	}
 
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	for {
@@ -88,79 +222,339 @@ func main() {
 		case err := <-errChan:
 			if err != nil {
 				fmt.Printf("%s - %s\n", hostname, err)
-				os.Exit(1)
+				exit(1)
 			}
+		case err := <-doneChan:
+			shutdown(dm, err)
 		case <-signalChan:
 			fmt.Printf("%s - Shutdown signal received, exiting...\n", hostname)
-			if kargo.EnableKubernetes {
-				err := dm.Delete()
-				if err != nil {
-					fmt.Printf("%s - %s\n", hostname, err)
-					os.Exit(1)
-				}
+			shutdown(dm, nil)
+		}
+	}
+
+}
+
+func shutdown(dm kargo.Backend, exitErr error) {
+	printReport(os.Stdout, parser.GetTotals())
+	printWorkerReport(os.Stdout, parser.GetWorkerTotals())
+	printScalingReport(os.Stdout, parser.GetAnnotations(), parser.GetSummaries(), reportInterval)
+	if dm != nil {
+		status, err := dm.Status()
+		if err != nil {
+			fmt.Printf("%s - %s\n", hostname, err)
+		} else {
+			printStatus(os.Stdout, status)
+		}
+		if k8s, ok := dm.(*kargo.DeploymentManager); ok {
+			placements, err := k8s.Placements()
+			if err != nil {
+				fmt.Printf("%s - %s\n", hostname, err)
+			}
+			printPlacements(os.Stdout, placements)
+			diagnostics, err := k8s.Diagnostics()
+			if err == nil {
+				printDiagnostics(os.Stdout, diagnostics)
 			}
-			os.Exit(0)
 		}
+
+		err = dm.Delete()
+		if err != nil {
+			fmt.Printf("%s - %s\n", hostname, err)
+			exit(1)
+		}
+	}
+	if exitErr != nil {
+		fmt.Printf("%s - %s\n", hostname, exitErr)
+		exit(1)
 	}
+	exit(0)
+}
 
+// exit stops the binary server, if there is one, and removes the binaries it
+// kept before exiting with code.
+func exit(code int) {
+	if binaryServer != nil {
+		binaryServer.Close()
+	}
+	os.Exit(code)
 }
 
-func runScalingLoop(dm *kargo.DeploymentManager, config kargo.DeploymentConfig) {
-	scaleTo := replicas
-	fmt.Printf("started scaling loop from 1 to %d\n", scaleTo)
+// newBackend returns the backend selected by --kubernetes, --docker or
+// --local, and the binaries its workers run. For Kubernetes a binary is built
+// and uploaded for each architecture of the nodes, and for Docker one is
+// built and mounted into the containers; local workers run this binary, so
+// only Kubernetes workers get a checksum to verify.
+func newBackend() (kargo.Backend, []kargo.Artifact, error) {
+	if kargo.EnableLocal {
+		binary, err := os.Executable()
+		if err != nil {
+			return nil, nil, err
+		}
+		return kargo.NewLocal(), []kargo.Artifact{{URL: binary}}, nil
+	}
 
-	for i := 2; i < scaleTo; i++ {
-		time.Sleep(time.Duration(15) * time.Second)
-		fmt.Printf("Scaling to %d replicas\n", i)
+	uploadConfig := kargo.UploadConfig{
+		ProjectID:  "staging-glass-pen-358",
+		BucketName: "test-binaries",
+		ObjectName: "loadtest",
+		BuildPath:  "../loadtest/src",
+	}
+	if kargo.EnableDocker {
+		binary, err := kargo.Build(uploadConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		dm, err := kargo.NewDocker()
+		if err != nil {
+			return nil, nil, err
+		}
+		return dm, []kargo.Artifact{{URL: binary}}, nil
+	}
 
-		err := dm.Scale(config, i)
+	if kargo.ServeBinary != "" {
+		var err error
+		binaryServer, err = kargo.NewBinaryServer()
 		if err != nil {
-			fmt.Println("Failed to scale")
-			fmt.Println(err)
+			return nil, nil, err
 		}
-		err = dm.Logs(os.Stdout)
+		uploadConfig.Store = binaryServer
+	}
+	dm, err := kargo.New()
+	if err != nil {
+		return nil, nil, err
+	}
+	if binaryServer != nil {
+		err = dm.CheckBinaryServer(binaryServer)
 		if err != nil {
-			fmt.Println("Failed to update log parser")
+			return nil, nil, err
 		}
 	}
+	selector, err := kargo.ParseNodeSelector(nodeSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	arches, labelled, err := dm.Architectures(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	archAffinity = labelled
+	artifacts := make([]kargo.Artifact, 0)
+	for _, arch := range arches {
+		uploadConfig.Arch = arch
+		artifact, err := kargo.Upload(uploadConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		artifacts = append(artifacts, *artifact)
+	}
+	return dm, artifacts, nil
+}
+
+// setScheduling sets where workers run from the scheduling flags.
+func setScheduling(config *kargo.DeploymentConfig) error {
+	var err error
+	config.NodeSelector, err = kargo.ParseNodeSelector(nodeSelector)
+	if err != nil {
+		return err
+	}
+	config.Tolerations, err = kargo.ParseTolerations(tolerations)
+	if err != nil {
+		return err
+	}
+
+	if spread != "" {
+		keys := make([]string, 0)
+		for _, key := range strings.Split(spread, ",") {
+			switch key {
+			case "node":
+				key = kargo.HostnameTopologyKey
+			case "zone":
+				key = kargo.ZoneTopologyKey
+			}
+			keys = append(keys, key)
+		}
+		config.TopologySpreadConstraints = kargo.SpreadConstraints(keys...)
+	}
+
+	switch antiAffinity {
+	case "":
+	case "preferred":
+		config.Affinity = kargo.NodeAntiAffinity(false)
+	case "required":
+		config.Affinity = kargo.NodeAntiAffinity(true)
+	default:
+		return fmt.Errorf("invalid --anti-affinity %q, expected preferred or required", antiAffinity)
+	}
+	return nil
+}
+
+func waitForJob(dm *kargo.DeploymentManager, doneChan chan error) {
+	result, err := dm.Wait()
+	if err != nil {
+		doneChan <- err
+		return
+	}
+
+	for _, pod := range result.Pods {
+		fmt.Printf("%s exited with code %d %s %s\n", pod.Pod, pod.ExitCode, pod.Reason, pod.Message)
+	}
+	fmt.Printf("Job finished: %d succeeded, %d failed\n", result.Succeeded, result.Failed)
+	if !result.Complete {
+		doneChan <- fmt.Errorf("job failed: %s %s", result.Reason, result.Message)
+		return
+	}
+	doneChan <- nil
+}
+
+// runScalingPlan steps through the scaling plan and records each step in the
+// results. A Deployment run ends after the last step's hold; a Job run ends
+// when the Job does.
+func runScalingPlan(dm kargo.Backend, config kargo.DeploymentConfig, doneChan chan error) {
+	plan := config.ScalingPlan
+	kargo.RunScalingPlan(dm, config, func(event kargo.ScalingEvent) {
+		text := fmt.Sprintf("%d replicas", event.Replicas)
+		if event.Err != nil {
+			text += " (not ready)"
+		}
+		parser.Annotate(event.Ready, text)
+	})
+	if !runAsJob && plan[len(plan)-1].Hold > 0 {
+		doneChan <- nil
+	}
 }
 
 type loadtestConfig struct {
-	endpoint          string
-	requestsPerMinute int
-	batchSize         int
-	numWorkers        int
-	reqChannel        chan *http.Request
-	stdoutChannel     chan string
-	errChan           chan error
-	sigChan           chan os.Signal
-	hostname          string
-	httpTimeoutSecs   int
+	endpoint        string
+	rate            *rateSource
+	behind          *uint64
+	batchSize       int
+	numWorkers      int
+	reqChannel      chan *http.Request
+	resultChannel   chan *result
+	stdoutChannel   chan string
+	errChan         chan error
+	sigChan         chan os.Signal
+	hostname        string
+	httpTimeoutSecs int
+	reportInterval  time.Duration
+	identity        workerIdentity
+}
+
+// runGC deletes the kargo objects left behind by runs whose coordinator died
+// before it could clean up. With --run-id it runs as a run's cleanup Job: it
+// waits for the run's workers to stop on their own and then deletes the run.
+func runGC() {
+	dm, err := kargo.New()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if gcRunID != "" {
+		selfDestruct, err := kargo.SelfDestructFromEnv()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if selfDestruct != nil {
+			fmt.Printf("Waiting to clean up run %s...\n", gcRunID)
+			fmt.Println(selfDestruct.Wait(context.Background()))
+		}
+		err = dm.DeleteRun(gcRunID, kargo.DryRun)
+	} else {
+		err = dm.GC(kargo.DryRun)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
 func runMain(errChan chan error, hostname string, sigChan chan os.Signal) {
-	ctx := context.Background()
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	selfDestruct, err := kargo.SelfDestructFromEnv()
+	if err != nil {
+		errChan <- err
+		return
+	}
+	stopped := make(chan struct{})
+	if selfDestruct != nil {
+		go func() {
+			reason := selfDestruct.Wait(ctx)
+			if reason != "" {
+				fmt.Printf("%s - %s, stopping load\n", hostname, reason)
+				close(stopped)
+				stop()
+			}
+		}()
+	}
 	numWorkers := 10
+	workerRate := rate
+	if workerRate <= 0 && rateFile == "" {
+		workerRate = float64(100*numWorkers) / 60
+	}
+	rates := newRateSource(workerRate, rateFile)
+	err = rates.read()
+	if err != nil {
+		errChan <- err
+		return
+	}
+
 	config := &loadtestConfig{
-		endpoint:          "http://35.232.238.57/",
-		requestsPerMinute: 100 * numWorkers,
-		batchSize:         numWorkers,
-		numWorkers:        numWorkers,
-		reqChannel:        make(chan *http.Request, numWorkers),
-		stdoutChannel:     make(chan string),
-		errChan:           errChan,
-		sigChan:           sigChan,
-		hostname:          hostname,
-		httpTimeoutSecs:   10,
+		endpoint:        "http://35.232.238.57/",
+		rate:            rates,
+		behind:          new(uint64),
+		batchSize:       numWorkers,
+		numWorkers:      numWorkers,
+		reqChannel:      make(chan *http.Request, numWorkers),
+		resultChannel:   make(chan *result, numWorkers),
+		stdoutChannel:   make(chan string),
+		errChan:         errChan,
+		sigChan:         sigChan,
+		hostname:        hostname,
+		httpTimeoutSecs: 10,
+		reportInterval:  reportInterval,
+		identity:        currentWorkerIdentity(hostname),
 	}
 
 	reqGenerator := makeReqGenerator(config)
 	clientMgr := makeClientManager(config)
+	aggregator := makeResultAggregator(config)
 
+	if rateFile != "" {
+		go rates.watch(ctx, config.stdoutChannel)
+	}
 	go reqGenerator.generate(ctx)
 	go clientMgr.startWorkers(ctx, config)
 
-	for msg := range config.stdoutChannel {
-		logLine(msg)
+	done := make(chan struct{})
+	go func() {
+		aggregator.aggregate()
+		close(done)
+	}()
+
+	for {
+		select {
+		case msg := <-config.stdoutChannel:
+			logLine(msg)
+		case <-done:
+			select {
+			case <-stopped:
+				if selfDestruct.IdleOnStop {
+					// A Deployment would restart a worker that exits, so wait
+					// to be deleted instead.
+					fmt.Printf("%s - Idle until deleted\n", hostname)
+					select {}
+				}
+			default:
+			}
+			return
+		}
 	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --rate on Kubernetes the coordinator sets the rate of each worker by
+// writing it to a ConfigMap mounted into the worker.
+const (
+	rateConfigMap = "loadtest-rate"
+	rateVolume    = "rate"
+	rateMountPath = "/etc/loadtest/rate"
+	rateKey       = "rate"
+)
+
+var ratePollInterval = 5 * time.Second
+
+// rateSource is the rate a worker sends requests at, in requests per second.
+// Zero means as fast as its clients take them, which is how a worker is
+// calibrated.
+type rateSource struct {
+	mu   sync.Mutex
+	rate float64
+	file string
+}
+
+func newRateSource(rate float64, file string) *rateSource {
+	return &rateSource{rate: rate, file: file}
+}
+
+func (rs *rateSource) get() float64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.rate
+}
+
+// read loads the rate from the rate file, if there is one.
+func (rs *rateSource) read() error {
+	if rs.file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(rs.file)
+	if err != nil {
+		return err
+	}
+	rate, err := parseRate(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s: %s", rs.file, err)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.rate = rate
+	return nil
+}
+
+// watch rereads the rate file until ctx is done. A file that cannot be read
+// keeps the last rate.
+func (rs *rateSource) watch(ctx context.Context, stdoutChannel chan string) {
+	ticker := time.NewTicker(ratePollInterval)
+	defer ticker.Stop()
+
+	last := rs.get()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := rs.read()
+		if err != nil {
+			stdoutChannel <- err.Error()
+			continue
+		}
+		if rate := rs.get(); rate != last {
+			stdoutChannel <- fmt.Sprintf("Rate changed to %.1f requests/s", rate)
+			last = rate
+		}
+	}
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 {
+		return 0, fmt.Errorf("invalid rate %s, expected requests per second", s)
+	}
+	return rate, nil
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', -1, 64)
+}
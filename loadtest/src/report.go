@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.sc-corp.net/scaddlive/women-who-go.git/loadtest/pkg/kargo"
+)
+
+var reportQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+func printReport(w io.Writer, totals *intervalSummary) {
+	if totals.count() == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Requests: %d (%d succeeded, %d failed)\n", totals.count(), totals.successes, totals.failures)
+	if totals.behind > 0 {
+		fmt.Fprintf(w, "Behind schedule: %d requests were not sent\n", totals.behind)
+	}
+	printQuantiles(w, "Request duration", totals.totalDurations)
+	printQuantiles(w, "Hash duration", totals.hashDurations)
+}
+
+func printQuantiles(w io.Writer, name string, h *histogram) {
+	if h.total == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "%s (ms):", name)
+	for _, q := range reportQuantiles {
+		fmt.Fprintf(w, " p%g=%d", q*100, h.quantile(q))
+	}
+	fmt.Fprintf(w, " max=%d\n", h.max())
+}
+
+// printStatus says how many workers were running when the run ended, and
+// what had happened to the others.
+func printStatus(w io.Writer, status *kargo.RunStatus) {
+	fmt.Fprintf(w, "%d/%d workers running at the end of the run\n", status.Ready, status.Replicas)
+	for _, worker := range status.Workers {
+		if !worker.Ready {
+			fmt.Fprintf(w, "  %s: %s\n", worker.Name, worker.State)
+		}
+	}
+}
+
+// printPlacements lists the node and zone each worker ran in, and how many
+// workers shared each node and zone.
+func printPlacements(w io.Writer, placements []kargo.Placement) {
+	if len(placements) == 0 {
+		return
+	}
+
+	nodes := make(map[string]int)
+	zones := make(map[string]int)
+	fmt.Fprintln(w, "Workers:")
+	for _, p := range placements {
+		zone := p.Zone
+		if zone == "" {
+			zone = "-"
+		}
+		fmt.Fprintf(w, "  %s node=%s zone=%s\n", p.Pod, p.Node, zone)
+		nodes[p.Node]++
+		zones[zone]++
+	}
+	fmt.Fprintf(w, "%d workers on %d nodes in %d zones\n", len(placements), len(nodes), len(zones))
+}
+
+// printWorkerReport breaks the totals down by node and by pod, so that a slow
+// node or worker stands out.
+func printWorkerReport(w io.Writer, workers []*intervalSummary) {
+	if len(workers) < 2 {
+		return
+	}
+
+	nodes := make([]string, 0)
+	byNode := make(map[string]*intervalSummary)
+	for _, worker := range workers {
+		node, ok := byNode[worker.worker.node]
+		if !ok {
+			node = newIntervalSummary(0)
+			byNode[worker.worker.node] = node
+			nodes = append(nodes, worker.worker.node)
+		}
+		node.merge(worker)
+	}
+
+	if len(nodes) > 1 {
+		fmt.Fprintln(w, "By node:")
+		for _, name := range nodes {
+			printWorkerLine(w, name, byNode[name])
+		}
+	}
+	fmt.Fprintln(w, "By pod:")
+	for _, worker := range workers {
+		name := worker.worker.pod
+		if worker.worker.node != "" {
+			name += " (" + worker.worker.node + ")"
+		}
+		printWorkerLine(w, name, worker)
+	}
+}
+
+func printWorkerLine(w io.Writer, name string, s *intervalSummary) {
+	if name == "" {
+		name = "-"
+	}
+	fmt.Fprintf(w, "  %s: %d requests, %d failed", name, s.count(), s.failures)
+	if s.behind > 0 {
+		fmt.Fprintf(w, ", %d behind", s.behind)
+	}
+	if s.totalDurations.total > 0 {
+		fmt.Fprintf(w, ", p50=%d p99=%d max=%d ms", s.totalDurations.quantile(0.5), s.totalDurations.quantile(0.99), s.totalDurations.max())
+	}
+	fmt.Fprintln(w)
+}
+
+// printDiagnostics lists the problems seen with the run's pods and other
+// objects while it ran.
+func printDiagnostics(w io.Writer, diagnostics []kargo.Diagnostic) {
+	if len(diagnostics) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Problems (%d):\n", len(diagnostics))
+	for _, d := range diagnostics {
+		count := ""
+		if d.Count > 1 {
+			count = fmt.Sprintf(" (x%d)", d.Count)
+		}
+		fmt.Fprintf(w, "  %s %s: %s: %s%s\n", d.Last.Format("15:04:05"), d.Object, d.Reason, d.Message, count)
+	}
+}
+
+// printScalingReport summarises the results of each step of the scaling plan,
+// from when its workers were ready until the next step's were.
+func printScalingReport(w io.Writer, annotations []annotation, summaries []*intervalSummary, interval time.Duration) {
+	if len(annotations) < 2 || len(summaries) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, "Scaling steps:")
+	first := annotations[0].at
+	for i, a := range annotations {
+		from := a.at.UnixNano()
+		to := summaries[len(summaries)-1].start + int64(interval)
+		if i+1 < len(annotations) {
+			to = annotations[i+1].at.UnixNano()
+		}
+
+		step := newIntervalSummary(from)
+		for _, summary := range summaries {
+			if summary.start >= from && summary.start < to {
+				step.merge(summary)
+			}
+		}
+
+		fmt.Fprintf(w, "  +%s %s: %d requests", a.at.Sub(first).Round(time.Second), a.text, step.count())
+		if to > from {
+			fmt.Fprintf(w, " (%.1f/s)", float64(step.count())/time.Duration(to-from).Seconds())
+		}
+		if step.behind > 0 {
+			fmt.Fprintf(w, ", %d behind", step.behind)
+		}
+		if step.totalDurations.total > 0 {
+			fmt.Fprintf(w, ", p50=%d p99=%d ms", step.totalDurations.quantile(0.5), step.totalDurations.quantile(0.99))
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -3,35 +3,40 @@ package main
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
+// A worker that falls further behind its schedule than this skips the late
+// requests instead of sending them in a burst, and reports them as behind.
+var maxScheduleLag = time.Second
+
 type reqGenerator struct {
-	requestsPerMinute int
-	batchSize         int
-	reqChannel        chan *http.Request
-	endpoint          string
-	stdoutChannel     chan string
+	rate          *rateSource
+	behind        *uint64
+	batchSize     int
+	reqChannel    chan *http.Request
+	endpoint      string
+	stdoutChannel chan string
 }
 
 func makeReqGenerator(config *loadtestConfig) *reqGenerator {
 	return &reqGenerator{
-		requestsPerMinute: config.requestsPerMinute,
-		batchSize:         config.batchSize,
-		reqChannel:        config.reqChannel,
-		endpoint:          config.endpoint,
-		stdoutChannel:     config.stdoutChannel,
+		rate:          config.rate,
+		behind:        config.behind,
+		batchSize:     config.batchSize,
+		reqChannel:    config.reqChannel,
+		endpoint:      config.endpoint,
+		stdoutChannel: config.stdoutChannel,
 	}
 }
 
 func (rg *reqGenerator) generate(ctx context.Context) {
 	defer close(rg.reqChannel)
 
-	messagesPerSec := int64(float64(rg.requestsPerMinute) / float64(60))
-	durationPerMessage := time.Duration(int64(time.Second) * int64(rg.batchSize) / messagesPerSec)
-
+	rate := rg.rate.get()
+	next := time.Now()
 	for {
-		deadline := time.Now().Add(durationPerMessage)
 		for i := 0; i < rg.batchSize; i++ {
 			req, err := http.NewRequest("GET", rg.endpoint, nil)
 			if err != nil {
@@ -42,7 +47,23 @@ func (rg *reqGenerator) generate(ctx context.Context) {
 
 		}
 
-		time.Sleep(time.Until(deadline))
+		if current := rg.rate.get(); current != rate {
+			rate = current
+			next = time.Now()
+		}
+		durationPerBatch := time.Duration(0)
+		if rate > 0 {
+			durationPerBatch = time.Duration(float64(time.Second) * float64(rg.batchSize) / rate)
+		}
+		if durationPerBatch > 0 {
+			next = next.Add(durationPerBatch)
+			if lag := time.Since(next); lag > maxScheduleLag {
+				missed := uint64(lag/durationPerBatch) * uint64(rg.batchSize)
+				atomic.AddUint64(rg.behind, missed)
+				next = time.Now()
+			}
+			time.Sleep(time.Until(next))
+		}
 
 		// check if the context is done, close out channel and stop
 		select {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// resultAggregator collects individual results into one intervalSummary per
+// report interval and writes a single summary line when the interval closes,
+// instead of a line per request.
+type resultAggregator struct {
+	interval      time.Duration
+	resultChannel chan *result
+	stdoutChannel chan string
+	identity      workerIdentity
+	behind        *uint64
+}
+
+func makeResultAggregator(config *loadtestConfig) *resultAggregator {
+	return &resultAggregator{
+		interval:      config.reportInterval,
+		resultChannel: config.resultChannel,
+		stdoutChannel: config.stdoutChannel,
+		identity:      config.identity,
+		behind:        config.behind,
+	}
+}
+
+// intervalStart returns the Unix time in nanoseconds of the start of the
+// interval t falls in, so that intervals shorter than a second get keys of
+// their own.
+func (ra *resultAggregator) intervalStart(t time.Time) int64 {
+	ns := t.UnixNano()
+	return ns - ns%int64(ra.interval)
+}
+
+// aggregate runs until the result channel is closed.
+func (ra *resultAggregator) aggregate() {
+	ticker := time.NewTicker(ra.interval)
+	defer ticker.Stop()
+
+	current := newIntervalSummary(ra.intervalStart(time.Now()))
+	current.worker = ra.identity
+	flush := func(start int64) {
+		current.behind = atomic.SwapUint64(ra.behind, 0)
+		if current.count() > 0 || current.behind > 0 {
+			ra.stdoutChannel <- encodeSummary(current)
+		}
+		current = newIntervalSummary(start)
+		current.worker = ra.identity
+	}
+
+	for {
+		select {
+		case res, ok := <-ra.resultChannel:
+			if !ok {
+				flush(0)
+				return
+			}
+			if start := ra.intervalStart(time.Now()); start != current.start {
+				flush(start)
+			}
+			current.record(res)
+		case now := <-ticker.C:
+			if start := ra.intervalStart(now); start != current.start {
+				flush(start)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIntervalStart(t *testing.T) {
+	ra := &resultAggregator{interval: 500 * time.Millisecond}
+	second := time.Unix(1549011600, 0)
+	tests := []struct {
+		at    time.Time
+		start time.Time
+	}{
+		{second, second},
+		{second.Add(499 * time.Millisecond), second},
+		{second.Add(500 * time.Millisecond), second.Add(500 * time.Millisecond)},
+		{second.Add(999 * time.Millisecond), second.Add(500 * time.Millisecond)},
+		{second.Add(time.Second), second.Add(time.Second)},
+	}
+	for _, test := range tests {
+		if got := ra.intervalStart(test.at); got != test.start.UnixNano() {
+			t.Errorf("intervalStart(%s) = %d, want %d", test.at.Format("15:04:05.000"), got, test.start.UnixNano())
+		}
+	}
+}
+
+func TestAggregateSubSecond(t *testing.T) {
+	interval := 500 * time.Millisecond
+	config := &loadtestConfig{
+		behind:         new(uint64),
+		resultChannel:  make(chan *result),
+		stdoutChannel:  make(chan string, 10),
+		reportInterval: interval,
+	}
+	done := make(chan struct{})
+	go func() {
+		makeResultAggregator(config).aggregate()
+		close(done)
+	}()
+
+	config.resultChannel <- &result{success: true, totalDurationMillis: 10}
+	time.Sleep(interval + 100*time.Millisecond)
+	config.resultChannel <- &result{success: true, totalDurationMillis: 20}
+	close(config.resultChannel)
+	<-done
+	close(config.stdoutChannel)
+
+	var summaries []*intervalSummary
+	for line := range config.stdoutChannel {
+		s, err := decodeSummary(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summaries = append(summaries, s)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("got %d summaries, want one per interval", len(summaries))
+	}
+	for _, s := range summaries {
+		if s.count() != 1 || s.start%int64(interval) != 0 {
+			t.Errorf("summary %+v should hold one result and start on an interval", s)
+		}
+	}
+	if d := summaries[1].start - summaries[0].start; d < int64(interval) {
+		t.Errorf("the summaries start %s apart, want at least %s", time.Duration(d), interval)
+	}
+}
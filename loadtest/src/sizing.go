@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.sc-corp.net/scaddlive/women-who-go.git/loadtest/pkg/kargo"
+)
+
+// Workers are sized to run at this fraction of the rate one worker reached
+// while calibrating, so that they have room for slower responses.
+const sizingHeadroom = 0.8
+
+// Workers are behind schedule when they skip more than this fraction of the
+// target rate.
+const behindTolerance = 0.05
+
+var (
+	// The kubelet takes up to a minute or two to update the mounted rate
+	// file, so workers are not judged until it has.
+	rateSettleTime = 2 * time.Minute
+	// How long workers are measured for each time they are judged.
+	sizingWindow = time.Minute
+)
+
+// withRateFile gives the workers a rate file that the coordinator updates as
+// it scales them. It starts at zero, so the first worker sends as fast as it
+// can while it is calibrated.
+func withRateFile(config *kargo.DeploymentConfig) {
+	config.ConfigMaps = append(config.ConfigMaps, kargo.ConfigMap{
+		Metadata: kargo.Metadata{Name: rateConfigMap},
+		Data:     map[string]string{rateKey: "0"},
+	})
+	config.Volumes = append(config.Volumes, kargo.Volume{
+		Name: rateVolume,
+		VolumeSource: kargo.VolumeSource{
+			ConfigMap: &kargo.ConfigMapVolumeSource{Name: rateConfigMap},
+		},
+	})
+	config.VolumeMounts = append(config.VolumeMounts, kargo.VolumeMount{
+		Name:      rateVolume,
+		MountPath: rateMountPath,
+		ReadOnly:  true,
+	})
+	config.Args = append(config.Args, "--rate-file="+rateMountPath+"/"+rateKey)
+}
+
+// runAutoSizing measures how fast the single worker the run starts with can
+// send requests, then scales the run to as many workers as --rate needs. It
+// keeps watching the workers and adds more whenever they fall behind.
+func runAutoSizing(dm *kargo.DeploymentManager, config kargo.DeploymentConfig) {
+	start := time.Now()
+	parser.Annotate(start, "calibrating 1 replica")
+	fmt.Printf("Calibrating one worker for %s...\n", calibrationTime)
+	time.Sleep(calibrationTime)
+
+	capacity, _, err := measureRate(parser.GetSummaries(), start, time.Now(), reportInterval)
+	if err != nil {
+		fmt.Printf("Calibration error: %s\n", err)
+		return
+	}
+	if capacity == 0 {
+		fmt.Println("Calibration error: the worker sent no requests")
+		return
+	}
+	fmt.Printf("One worker can send %.1f requests/s\n", capacity)
+	replicas := resize(dm, config, 1, replicasFor(rate, capacity))
+
+	window := sizingWindow
+	if window < 3*reportInterval {
+		window = 3 * reportInterval
+	}
+	for {
+		time.Sleep(rateSettleTime)
+		from := time.Now()
+		time.Sleep(window)
+
+		sent, behind, err := measureRate(parser.GetSummaries(), from, time.Now(), reportInterval)
+		if err != nil {
+			fmt.Printf("Sizing error: %s\n", err)
+			continue
+		}
+		if behind <= rate*behindTolerance {
+			continue
+		}
+		fmt.Printf("Workers are behind schedule, sending %.1f of %.1f requests/s\n", sent, rate)
+		if replicas >= maxReplicas {
+			fmt.Printf("Already at --max-replicas=%d\n", maxReplicas)
+			continue
+		}
+
+		next := replicasFor(rate, sent/float64(replicas))
+		if next <= replicas {
+			next = replicas + 1
+		}
+		replicas = resize(dm, config, replicas, next)
+	}
+}
+
+// replicasFor is how many workers that can each send capacity requests per
+// second are needed to send rate, leaving them some headroom.
+func replicasFor(rate, capacity float64) int {
+	if capacity <= 0 {
+		return maxReplicas
+	}
+	return int(math.Ceil(rate / (capacity * sizingHeadroom)))
+}
+
+// resize splits --rate between n workers and scales the run from current to
+// them. It returns the number of workers, which is at most --max-replicas.
+func resize(dm *kargo.DeploymentManager, config kargo.DeploymentConfig, current, n int) int {
+	if n > maxReplicas {
+		fmt.Printf("--rate needs %d replicas, limited to --max-replicas=%d\n", n, maxReplicas)
+		n = maxReplicas
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	perWorker := rate / float64(n)
+	err := dm.UpdateConfigMap(rateConfigMap, map[string]string{rateKey: formatRate(perWorker)})
+	if err != nil {
+		fmt.Println(err)
+		return current
+	}
+	fmt.Printf("Scaling to %d replicas at %.1f requests/s each\n", n, perWorker)
+	err = dm.Scale(config, n)
+	if err == nil {
+		err = dm.WaitReady(n)
+	}
+	text := fmt.Sprintf("%d replicas at %.1f/s", n, perWorker)
+	if err != nil {
+		fmt.Println(err)
+		text += " (not ready)"
+	}
+	parser.Annotate(time.Now(), text)
+	return n
+}
+
+// measureRate returns how many requests per second were sent and how many
+// were skipped for being behind schedule, over the report intervals that lie
+// entirely between from and to.
+func measureRate(summaries []*intervalSummary, from, to time.Time, interval time.Duration) (float64, float64, error) {
+	first := from.Truncate(interval)
+	if first.Before(from) {
+		first = first.Add(interval)
+	}
+	end := to.Truncate(interval)
+	if !end.After(first) {
+		return 0, 0, fmt.Errorf("no report interval of %s fits between %s and %s", interval, from.Format("15:04:05"), to.Format("15:04:05"))
+	}
+
+	total := newIntervalSummary(0)
+	for _, summary := range summaries {
+		if summary.start >= first.UnixNano() && summary.start < end.UnixNano() {
+			total.merge(summary)
+		}
+	}
+	elapsed := end.Sub(first).Seconds()
+	return float64(total.count()) / elapsed, float64(total.behind) / elapsed, nil
+}